@@ -0,0 +1,157 @@
+// Package identity holds what peers and super peers share to authenticate each other:
+// peer IDs derived from Ed25519 keys, signed requests and certificates from the cluster CA.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carrying the signature of a request from a peer
+const (
+	HeaderKey       = "X-Peer-Key"       // Base64 Ed25519 public key of the peer
+	HeaderTimestamp = "X-Peer-Timestamp" // Unix time the request was signed at
+	HeaderNonce     = "X-Peer-Nonce"     // Random value making every signed request unique
+	HeaderSignature = "X-Peer-Signature" // Base64 signature of SignedMessage
+)
+
+// MaxAge bounds how far a signed request's timestamp may be from now. Nonces are
+// remembered for as long, so a captured request cannot be replayed at all.
+const MaxAge = 5 * time.Minute
+
+// PeerID derives a peer's ID from its public key, so nobody can claim an ID without
+// holding the matching private key
+func PeerID(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return "peer-" + hex.EncodeToString(sum[:10])
+}
+
+// SignedMessage is what a peer signs for a request: the method, destination host, path
+// with the query, Range header, timestamp, nonce and the SHA-256 of the body
+func SignedMessage(method, host, uri, byteRange, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		method, strings.ToLower(host), uri, byteRange, timestamp, nonce, hex.EncodeToString(bodyHash[:]),
+	}, "\n"))
+}
+
+// Sign adds the public key of key and its signature over the request to req. It must
+// be called after the Range header is set.
+func Sign(req *http.Request, key ed25519.PrivateKey, body []byte) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	nonce := hex.EncodeToString(buf)
+	signature := ed25519.Sign(key, SignedMessage(req.Method, host, req.URL.RequestURI(), req.Header.Get("Range"), timestamp, nonce, body))
+
+	req.Header.Set(HeaderKey, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(signature))
+}
+
+// Verifier checks signed requests and rejects any it has accepted before
+type Verifier struct {
+	seen      map[string]time.Time // Nonces accepted, with the time their request expires
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+// NewVerifier creates a verifier that has not seen any requests yet
+func NewVerifier() *Verifier {
+	return &Verifier{seen: make(map[string]time.Time)}
+}
+
+// Verify checks the signature over a request and returns the public key that made it
+func (v *Verifier) Verify(r *http.Request, body []byte) (ed25519.PublicKey, error) {
+	encodedKey := r.Header.Get(HeaderKey)
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	if encodedKey == "" || timestamp == "" || nonce == "" || r.Header.Get(HeaderSignature) == "" {
+		return nil, errors.New("request is not signed")
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	signedAt := time.Unix(unix, 0)
+	if age := time.Since(signedAt); age > MaxAge || age < -MaxAge {
+		return nil, fmt.Errorf("signature timestamp is %s off", age.Round(time.Second))
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(HeaderSignature))
+	message := SignedMessage(r.Method, r.Host, r.URL.RequestURI(), r.Header.Get("Range"), timestamp, nonce, body)
+	if err != nil || !ed25519.Verify(publicKey, message, signature) {
+		return nil, errors.New("invalid signature")
+	}
+
+	if !v.markSeen(encodedKey+" "+nonce, signedAt.Add(MaxAge)) {
+		return nil, errors.New("request has already been used")
+	}
+	return publicKey, nil
+}
+
+// markSeen records a nonce until it expires and reports whether it was new
+func (v *Verifier) markSeen(nonce string, expires time.Time) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(v.lastPrune) > time.Minute {
+		for seen, seenExpires := range v.seen {
+			if now.After(seenExpires) {
+				delete(v.seen, seen)
+			}
+		}
+		v.lastPrune = now
+	}
+
+	if _, exists := v.seen[nonce]; exists {
+		return false
+	}
+	v.seen[nonce] = expires
+	return true
+}
+
+// VerifyChain checks that the leaf of certs was issued by a CA in roots for the given usage
+func VerifyChain(certs []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+// CertRole returns the role a certificate was issued for
+func CertRole(cert *x509.Certificate) string {
+	return strings.Join(cert.Subject.OrganizationalUnit, ",")
+}
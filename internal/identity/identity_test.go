@@ -0,0 +1,95 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// signed returns a request signed for peer-a:8081 as its receiver sees it
+	signed := func(body []byte) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://peer-a:8081/file?name=a.txt", nil)
+		req.Header.Set("Range", "bytes=0-99")
+		Sign(req, key, body)
+		return req
+	}
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		body    []byte
+		wantErr bool
+	}{
+		{"valid", func() *http.Request { return signed(nil) }, nil, false},
+		{"unsigned", func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "http://peer-a:8081/file?name=a.txt", nil)
+		}, nil, true},
+		{"other host", func() *http.Request {
+			req := signed(nil)
+			req.Host = "peer-b:8081"
+			return req
+		}, nil, true},
+		{"other range", func() *http.Request {
+			req := signed(nil)
+			req.Header.Set("Range", "bytes=100-199")
+			return req
+		}, nil, true},
+		{"other path", func() *http.Request {
+			req := signed(nil)
+			req.URL.RawQuery = "name=b.txt"
+			return req
+		}, nil, true},
+		{"other body", func() *http.Request { return signed([]byte("a")) }, []byte("b"), true},
+		{"expired", func() *http.Request {
+			req := signed(nil)
+			req.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Add(-2*MaxAge).Unix(), 10))
+			return req
+		}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewVerifier().Verify(tt.request(), tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "http://super-peer:8080/heartbeat", nil)
+	Sign(req, key, []byte("{}"))
+
+	verifier := NewVerifier()
+	publicKey, err := verifier.Verify(req, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if PeerID(publicKey) != PeerID(key.Public().(ed25519.PublicKey)) {
+		t.Errorf("verified key does not belong to the signer")
+	}
+	if _, err := verifier.Verify(req, []byte("{}")); err == nil {
+		t.Error("replayed request was accepted")
+	}
+
+	// A request signed again gets a new nonce
+	Sign(req, key, []byte("{}"))
+	if _, err := verifier.Verify(req, []byte("{}")); err != nil {
+		t.Errorf("fresh signature rejected: %v", err)
+	}
+}
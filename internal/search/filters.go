@@ -0,0 +1,37 @@
+// Package search holds the search filters that super peers and peers searching each
+// other directly apply alike
+package search
+
+import (
+	"path"
+	"strings"
+)
+
+// Filters narrow a search down by content, size and file type. All given filters must match.
+type Filters struct {
+	Hash       string   `json:"hash,omitempty"`       // Exact SHA-256 of the content
+	MinSize    int64    `json:"minSize,omitempty"`    // Minimum size in bytes
+	MaxSize    int64    `json:"maxSize,omitempty"`    // Maximum size in bytes, 0 for no limit
+	Extensions []string `json:"extensions,omitempty"` // File extensions such as "csv", with or without the dot
+}
+
+// Match reports whether a file with the given name, content hash and size passes the filters
+func (f Filters) Match(name, hash string, size int64) bool {
+	if f.Hash != "" && !strings.EqualFold(hash, f.Hash) {
+		return false
+	}
+	if size < f.MinSize || (f.MaxSize > 0 && size > f.MaxSize) {
+		return false
+	}
+	if len(f.Extensions) == 0 {
+		return true
+	}
+
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	for _, want := range f.Extensions {
+		if strings.TrimPrefix(strings.ToLower(want), ".") == ext {
+			return true
+		}
+	}
+	return false
+}
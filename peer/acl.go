@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ACL limits which peers may see and download shared files. Files no rule matches are
+// public. The owning peer may always access its own files.
+type ACL struct {
+	Groups map[string][]string `json:"groups,omitempty"` // Group name to the peer IDs in it
+	Rules  []ACLRule           `json:"rules"`            // Checked in order, the first match applies
+}
+
+// ACLRule lists the peers allowed to access the shared files matching a glob
+type ACLRule struct {
+	Path  string   `json:"path"`  // Glob over paths relative to the shared directory, a matching directory covers everything under it
+	Allow []string `json:"allow"` // Peer IDs and group names
+}
+
+// LoadACL reads an access control list, a missing file shares everything publicly
+func LoadACL(filename string) (*ACL, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var acl ACL
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, fmt.Errorf("invalid access control list %s: %v", filename, err)
+	}
+	for _, rule := range acl.Rules {
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid path %q in %s: %v", rule.Path, filename, err)
+		}
+	}
+	return &acl, nil
+}
+
+// matches reports whether a rule applies to a shared file, by its path or by the path of
+// any directory it is in. A leading separator does not make the name escape the rules.
+func (rule ACLRule) matches(name string) bool {
+	for p := strings.TrimLeft(filepath.ToSlash(name), "/"); p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if ok, _ := path.Match(rule.Path, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns the IDs of the peers besides owner that may access a shared file, with
+// groups expanded, or nil if the file is public
+func (acl *ACL) allowed(name, owner string) []string {
+	if acl == nil {
+		return nil
+	}
+	for _, rule := range acl.Rules {
+		if !rule.matches(name) {
+			continue
+		}
+		peerIDs := []string{owner}
+		for _, entry := range rule.Allow {
+			members, isGroup := acl.Groups[entry]
+			if !isGroup {
+				members = []string{entry}
+			}
+			for _, peerID := range members {
+				if !contains(peerIDs, peerID) {
+					peerIDs = append(peerIDs, peerID)
+				}
+			}
+		}
+		return peerIDs
+	}
+	return nil
+}
+
+// allows reports whether a peer may see and download a file, anonymous requesters
+// only get public files
+func (f File) allows(peerID string) bool {
+	return len(f.ACL) == 0 || (peerID != "" && contains(f.ACL, peerID))
+}
+
+// isRestricted reports whether any of the peers shares some content under an access control list
+func isRestricted(fileHash string, peers []*Peer) bool {
+	for _, peer := range peers {
+		for _, file := range peer.Files {
+			if file.Hash == fileHash && len(file.ACL) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requesterID returns the ID of the peer making a request to the file server: the name
+// in its certificate over TLS, otherwise the ID its signature proves, or "" when anonymous.
+// The signature covers this peer's address and the requested range and is only accepted
+// once, so a peer it was sent to cannot replay it to reach files the ACL restricts.
+func (pc *PeerClient) requesterID(r *http.Request) string {
+	if name, role := connectionIdentity(r.TLS); role == rolePeer {
+		return name
+	}
+	peerID, err := pc.signerID(r, nil)
+	if err != nil {
+		return ""
+	}
+	return peerID
+}
+
+// mayAccess reports whether a peer may download a shared file by its name relative to
+// the shared directory
+func (pc *PeerClient) mayAccess(name, peerID string) bool {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+
+	return File{ACL: pc.acl.allowed(name, pc.ID)}.allows(peerID)
+}
+
+// mayAccessHash reports whether a peer may download any shared file with the given content
+func (pc *PeerClient) mayAccessHash(fileHash, peerID string) bool {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+
+	for _, file := range pc.Files {
+		if file.Hash == fileHash && file.allows(peerID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"p2p-file-sharing/internal/identity"
+)
+
+func TestRequesterIDRejectsReplays(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloader := &PeerClient{}
+	downloader.setIdentity(key)
+
+	// The downloader asks holder A for a piece of a restricted file
+	original := httptest.NewRequest(http.MethodGet, "http://holder-a:8081/file?name=secret.txt", nil)
+	original.Header.Set("Range", "bytes=0-1023")
+	downloader.signRequest(original, nil)
+
+	// replay copies the signed request as A could send it on to host
+	replay := func(host, byteRange string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/file?name=secret.txt", nil)
+		req.Header = original.Header.Clone()
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		return req
+	}
+
+	holderA := &PeerClient{signatures: identity.NewVerifier()}
+	holderB := &PeerClient{signatures: identity.NewVerifier()}
+
+	tests := []struct {
+		name   string
+		holder *PeerClient
+		req    *http.Request
+		want   string
+	}{
+		{"original request", holderA, original, downloader.ID},
+		{"replayed to the same holder", holderA, replay("holder-a:8081", ""), ""},
+		{"replayed to another holder", holderB, replay("holder-b:8081", ""), ""},
+		{"replayed with another range", holderB, replay("holder-a:8081", "bytes=0-"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.holder.requesterID(tt.req); got != tt.want {
+				t.Errorf("requester = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileServerEnforcesACL(t *testing.T) {
+	sharedDir := t.TempDir()
+	for _, name := range []string{"secret.txt", "public.txt"} {
+		if err := os.WriteFile(filepath.Join(sharedDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pc := &PeerClient{
+		ID:         "owner",
+		SharedDir:  sharedDir,
+		signatures: identity.NewVerifier(),
+		acl:        &ACL{Rules: []ACLRule{{Path: "secret.txt", Allow: []string{"friend"}}}},
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want int
+	}{
+		{"public file", "public.txt", http.StatusOK},
+		{"restricted file", "secret.txt", http.StatusForbidden},
+		{"restricted file with a leading slash", "/secret.txt", http.StatusBadRequest},
+		{"restricted file through a directory", "sub/../secret.txt", http.StatusForbidden},
+		{"outside the shared directory", "../secret.txt", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://owner:8081/file?name="+url.QueryEscape(tt.file), nil)
+			rec := httptest.NewRecorder()
+			pc.handleFile(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLRuleMatchesLeadingSlash(t *testing.T) {
+	rule := ACLRule{Path: "private"}
+	for _, name := range []string{"private", "/private", "private/a.txt", "/private/a.txt"} {
+		if !rule.matches(name) {
+			t.Errorf("rule %q does not match %q", rule.Path, name)
+		}
+	}
+}
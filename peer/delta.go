@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// FileDelta is an incremental change to the files a peer shares, made to the file list
+// the super peer holds at BaseVersion
+type FileDelta struct {
+	PeerID      string   `json:"peerId"`
+	BaseVersion int64    `json:"baseVersion"`        // FilesVersion the change applies to
+	Version     int64    `json:"version"`            // FilesVersion after the change
+	Added       []File   `json:"added,omitempty"`    // Files not shared before
+	Modified    []File   `json:"modified,omitempty"` // New content or access control list under an existing name
+	Removed     []string `json:"removed,omitempty"`  // Names of files no longer shared
+}
+
+// newFilesVersion returns a version for a new file list. Versions are timestamps, so a
+// restarted peer never reuses one the super peer may still hold.
+func newFilesVersion() int64 {
+	return time.Now().UnixNano()
+}
+
+// diffFiles returns the changes from the previous file list to the current one, matching files by name
+func diffFiles(previous, current []File) FileDelta {
+	byName := make(map[string]File, len(previous))
+	for _, file := range previous {
+		byName[file.Name] = file
+	}
+
+	var delta FileDelta
+	for _, file := range current {
+		old, existed := byName[file.Name]
+		delete(byName, file.Name)
+		switch {
+		case !existed:
+			delta.Added = append(delta.Added, file)
+		case old.Hash != file.Hash || old.Size != file.Size || old.MerkleRoot != file.MerkleRoot || !slices.Equal(old.ACL, file.ACL):
+			delta.Modified = append(delta.Modified, file)
+		}
+	}
+	for _, file := range previous {
+		if _, removed := byName[file.Name]; removed {
+			delta.Removed = append(delta.Removed, file.Name)
+		}
+	}
+	return delta
+}
+
+// empty reports whether a delta changes nothing
+func (d *FileDelta) empty() bool {
+	return len(d.Added) == 0 && len(d.Modified) == 0 && len(d.Removed) == 0
+}
+
+// setRegisteredFiles records the file list the super peer acknowledged
+func (pc *PeerClient) setRegisteredFiles(files []File, version int64) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	pc.registeredFiles = files
+	pc.filesVersion = version
+}
+
+// UpdateRegistration sends the super peer the changes to the shared files since it last
+// acknowledged them, registering in full when it does not hold that file list
+func (pc *PeerClient) UpdateRegistration() error {
+	pc.mutex.RLock()
+	previous, baseVersion := pc.registeredFiles, pc.filesVersion
+	current := append([]File{}, pc.Files...)
+	pc.mutex.RUnlock()
+
+	if baseVersion == 0 {
+		return pc.Register()
+	}
+	delta := diffFiles(previous, current)
+	if delta.empty() {
+		return nil
+	}
+	delta.PeerID = pc.ID
+	delta.BaseVersion = baseVersion
+	delta.Version = newFilesVersion()
+
+	jsonData, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+
+	resp, err := pc.postSuperPeer("/update", jsonData)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		pc.setRegisteredFiles(current, delta.Version)
+		log.Printf("Sent file changes to super peer: %d added, %d modified, %d removed",
+			len(delta.Added), len(delta.Modified), len(delta.Removed))
+		return nil
+	case http.StatusNotFound, http.StatusConflict:
+		log.Printf("Super peer does not hold this peer's current files, registering again")
+		return pc.Register()
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to update registration: %s", body)
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dhtK is the size of a routing table bucket and the number of nodes a record is stored on
+	dhtK = 20
+
+	// dhtAlpha is the number of nodes queried in parallel during a lookup
+	dhtAlpha = 3
+
+	// dhtProviderTTL is how long a provider record is kept without being republished
+	dhtProviderTTL = time.Hour
+
+	// dhtRepublishInterval is how often a peer announces its files again
+	dhtRepublishInterval = 30 * time.Minute
+
+	// dhtRPCTimeout bounds a single request to another node
+	dhtRPCTimeout = 5 * time.Second
+)
+
+// NodeID identifies a DHT node, or the file hash a provider record is stored under
+type NodeID [sha256.Size]byte
+
+// nodeIDFor derives the node ID of a peer from its peer ID
+func nodeIDFor(peerID string) NodeID {
+	return sha256.Sum256([]byte(peerID))
+}
+
+// parseNodeID decodes a hex encoded node ID or SHA-256 file hash
+func parseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != len(id) {
+		return id, fmt.Errorf("invalid key %q", s)
+	}
+	copy(id[:], data)
+	return id, nil
+}
+
+// distance returns the XOR distance between two IDs
+func (id NodeID) distance(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// bucketIndex returns the routing table bucket for a distance, the position of its
+// highest set bit, or -1 for a zero distance
+func bucketIndex(d NodeID) int {
+	for i, b := range d {
+		if b != 0 {
+			return (len(d)-i)*8 - bits.LeadingZeros8(b) - 1
+		}
+	}
+	return -1
+}
+
+// DHTContact is the address of a DHT node, which is a peer's file server
+type DHTContact struct {
+	PeerID  string `json:"peerId"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// nodeID returns the node ID of the contact
+func (c DHTContact) nodeID() NodeID {
+	return nodeIDFor(c.PeerID)
+}
+
+// peer converts the contact to the peer form used for downloads
+func (c DHTContact) peer() *Peer {
+	return &Peer{ID: c.PeerID, Address: c.Address, Port: c.Port}
+}
+
+// DHTProvider records that a peer shares the file stored under a hash
+type DHTProvider struct {
+	Contact    DHTContact `json:"contact"`
+	Name       string     `json:"name"`
+	Size       int64      `json:"size"`
+	MerkleRoot string     `json:"merkleRoot,omitempty"`
+	expires    time.Time
+}
+
+// dhtRequest is the body of every DHT RPC
+type dhtRequest struct {
+	Sender   DHTContact   `json:"sender"`
+	Key      string       `json:"key,omitempty"`      // Hex node ID or file hash to look up
+	Provider *DHTProvider `json:"provider,omitempty"` // Record to store for add_provider
+}
+
+// dhtResponse is the answer to every DHT RPC
+type dhtResponse struct {
+	Sender    DHTContact    `json:"sender"`
+	Contacts  []DHTContact  `json:"contacts,omitempty"`  // Closest known nodes to the key
+	Providers []DHTProvider `json:"providers,omitempty"` // Known providers of the key
+}
+
+// DHT is a Kademlia node running on the peer's file server. Files are located by their
+// SHA-256 hash through provider records, without a super peer.
+type DHT struct {
+	pc         *PeerClient
+	id         NodeID
+	buckets    [sha256.Size * 8][]DHTContact     // Contacts by distance, least recently seen first
+	providers  map[string]map[string]DHTProvider // Provider records by file hash, then peer ID
+	republish  chan struct{}                     // Signals that the shared files changed
+	httpClient *http.Client
+	mutex      sync.Mutex
+}
+
+// EnableDHT makes the peer join the DHT when it starts
+func (pc *PeerClient) EnableDHT() {
+	pc.dht = &DHT{
+		pc:         pc,
+		id:         nodeIDFor(pc.ID),
+		providers:  make(map[string]map[string]DHTProvider),
+		republish:  make(chan struct{}, 1),
+		httpClient: &http.Client{Timeout: dhtRPCTimeout, Transport: pc.transport},
+	}
+}
+
+// self returns this node's contact, the address is filled in by whoever receives it
+func (d *DHT) self() DHTContact {
+	return DHTContact{PeerID: d.pc.ID, Port: d.pc.LocalPort}
+}
+
+// Start joins the network through the bootstrap addresses and the peers known to the
+// super peer, then keeps the shared files published
+func (d *DHT) Start(bootstrap []string) {
+	for _, addr := range bootstrap {
+		host, portStr, err := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(portStr)
+		if err != nil || port == 0 {
+			log.Printf("Ignoring invalid DHT bootstrap address %q", addr)
+			continue
+		}
+		if _, err := d.call(DHTContact{Address: host, Port: port}, "/dht/ping", dhtRequest{}); err != nil {
+			log.Printf("DHT bootstrap node %s unreachable: %v", addr, err)
+		}
+	}
+	for _, peer := range d.pc.bootstrapPeers() {
+		contact := DHTContact{PeerID: peer.ID, Address: peer.Address, Port: peer.Port}
+		if _, err := d.call(contact, "/dht/ping", dhtRequest{}); err != nil {
+			log.Printf("DHT bootstrap peer %s unreachable: %v", peer.ID, err)
+		}
+	}
+
+	// Looking up our own ID fills the routing table with our neighbourhood
+	d.lookup(d.id, "/dht/find_node")
+	log.Printf("Joined DHT as node %s with %d contacts", hex.EncodeToString(d.id[:4]), d.contactCount())
+
+	ticker := time.NewTicker(dhtRepublishInterval)
+	defer ticker.Stop()
+	for {
+		// This publish covers any change signalled before it
+		select {
+		case <-d.republish:
+		default:
+		}
+		d.Publish()
+
+		select {
+		case <-ticker.C:
+		case <-d.republish:
+		}
+	}
+}
+
+// filesChanged asks for the shared files to be published again
+func (d *DHT) filesChanged() {
+	select {
+	case d.republish <- struct{}{}:
+	default:
+	}
+}
+
+// Publish stores a provider record for every public shared file on the nodes closest
+// to its hash. Anyone can look records up, so restricted files are left out.
+func (d *DHT) Publish() {
+	d.pc.mutex.RLock()
+	files := []File{}
+	for _, file := range d.pc.Files {
+		if len(file.ACL) == 0 {
+			files = append(files, file)
+		}
+	}
+	d.pc.mutex.RUnlock()
+
+	for _, file := range files {
+		key, err := parseNodeID(file.Hash)
+		if err != nil {
+			continue
+		}
+		record := DHTProvider{Contact: d.self(), Name: file.Name, Size: file.Size, MerkleRoot: file.MerkleRoot}
+		d.storeProvider(file.Hash, record)
+
+		contacts, _ := d.lookup(key, "/dht/find_node")
+		for _, contact := range contacts {
+			req := dhtRequest{Key: file.Hash, Provider: &record}
+			if _, err := d.call(contact, "/dht/add_provider", req); err != nil {
+				log.Printf("Failed to publish %s to %s: %v", file.Name, contact.PeerID, err)
+			}
+		}
+	}
+	log.Printf("Published %d files to the DHT", len(files))
+}
+
+// FindProviders looks up the peers sharing the file with the given hash
+func (d *DHT) FindProviders(fileHash string) ([]DHTProvider, error) {
+	key, err := parseNodeID(strings.ToLower(fileHash))
+	if err != nil {
+		return nil, err
+	}
+	_, providers := d.lookup(key, "/dht/find_providers")
+	return providers, nil
+}
+
+// Search answers a search by file hash from the DHT, with one file per name the content is shared under
+func (d *DHT) Search(req SearchRequest) (*SearchResponse, error) {
+	providers, err := d.FindProviders(req.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &SearchResponse{Files: []File{}, Peers: make(map[string]*Peer)}
+	byName := make(map[string]int)
+	for _, provider := range providers {
+		if len(req.PeerIDs) > 0 && !contains(req.PeerIDs, provider.Contact.PeerID) {
+			continue
+		}
+
+		i, exists := byName[provider.Name]
+		if !exists {
+			i = len(resp.Files)
+			byName[provider.Name] = i
+			resp.Files = append(resp.Files, File{
+				Name:       provider.Name,
+				Hash:       strings.ToLower(req.Hash),
+				Size:       provider.Size,
+				MerkleRoot: provider.MerkleRoot,
+			})
+		}
+		resp.Files[i].PeerIDs = append(resp.Files[i].PeerIDs, provider.Contact.PeerID)
+
+		peer, exists := resp.Peers[provider.Contact.PeerID]
+		if !exists {
+			peer = provider.Contact.peer()
+			resp.Peers[peer.ID] = peer
+		}
+		peer.Files = append(peer.Files, resp.Files[i])
+	}
+	resp.Total = len(resp.Files)
+	return resp, nil
+}
+
+// lookup iteratively queries the nodes closest to key, dhtAlpha at a time, until no
+// closer nodes turn up. Lookups for providers stop as soon as any are found.
+func (d *DHT) lookup(key NodeID, path string) ([]DHTContact, []DHTProvider) {
+	keyHex := hex.EncodeToString(key[:])
+	shortlist := d.closest(key, dhtK)
+	seen := map[string]bool{d.pc.ID: true}
+	for _, contact := range shortlist {
+		seen[contact.PeerID] = true
+	}
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+
+	providers := []DHTProvider{}
+	providerIDs := make(map[string]bool)
+	addProviders := func(records []DHTProvider) {
+		for _, record := range records {
+			// Our own record is no use for finding the file elsewhere
+			if record.Contact.PeerID != d.pc.ID && !providerIDs[record.Contact.PeerID] {
+				providerIDs[record.Contact.PeerID] = true
+				providers = append(providers, record)
+			}
+		}
+	}
+	if path == "/dht/find_providers" {
+		addProviders(d.localProviders(keyHex))
+	}
+
+	for {
+		if path == "/dht/find_providers" && len(providers) > 0 {
+			break
+		}
+
+		// Query the closest nodes not asked yet
+		batch := []DHTContact{}
+		for _, contact := range shortlist[:min(len(shortlist), dhtK)] {
+			if !queried[contact.PeerID] && len(batch) < dhtAlpha {
+				queried[contact.PeerID] = true
+				batch = append(batch, contact)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		type result struct {
+			contact DHTContact
+			resp    *dhtResponse
+			err     error
+		}
+		results := make(chan result, len(batch))
+		for _, contact := range batch {
+			go func(contact DHTContact) {
+				resp, err := d.call(contact, path, dhtRequest{Key: keyHex})
+				results <- result{contact, resp, err}
+			}(contact)
+		}
+
+		for range batch {
+			r := <-results
+			if r.err != nil {
+				failed[r.contact.PeerID] = true
+				continue
+			}
+			addProviders(r.resp.Providers)
+			for _, contact := range r.resp.Contacts {
+				if !seen[contact.PeerID] {
+					seen[contact.PeerID] = true
+					shortlist = append(shortlist, contact)
+				}
+			}
+		}
+
+		// Drop unreachable nodes and keep the shortlist ordered by distance
+		live := shortlist[:0]
+		for _, contact := range shortlist {
+			if !failed[contact.PeerID] {
+				live = append(live, contact)
+			}
+		}
+		shortlist = live
+		sortByDistance(shortlist, key)
+	}
+
+	return shortlist[:min(len(shortlist), dhtK)], providers
+}
+
+// sortByDistance orders contacts by their XOR distance to key
+func sortByDistance(contacts []DHTContact, key NodeID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		a := contacts[i].nodeID().distance(key)
+		b := contacts[j].nodeID().distance(key)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
+
+// contactCount returns the number of nodes in the routing table
+func (d *DHT) contactCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	count := 0
+	for _, bucket := range d.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// closest returns up to n known contacts closest to key
+func (d *DHT) closest(key NodeID, n int) []DHTContact {
+	d.mutex.Lock()
+	contacts := []DHTContact{}
+	for _, bucket := range d.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	d.mutex.Unlock()
+
+	sortByDistance(contacts, key)
+	return contacts[:min(len(contacts), n)]
+}
+
+// observe records a node that was heard from. A full bucket keeps its least recently
+// seen contact if that still answers, as long-lived nodes are the most likely to stay.
+func (d *DHT) observe(contact DHTContact) {
+	if contact.PeerID == "" || contact.PeerID == d.pc.ID {
+		return
+	}
+
+	d.mutex.Lock()
+	i := bucketIndex(d.id.distance(contact.nodeID()))
+	bucket := d.buckets[i]
+	for j, known := range bucket {
+		if known.PeerID == contact.PeerID {
+			// Move to the most recently seen end
+			d.buckets[i] = append(append(bucket[:j:j], bucket[j+1:]...), contact)
+			d.mutex.Unlock()
+			return
+		}
+	}
+	if len(bucket) < dhtK {
+		d.buckets[i] = append(bucket, contact)
+		d.mutex.Unlock()
+		return
+	}
+	oldest := bucket[0]
+	d.mutex.Unlock()
+
+	go func() {
+		if _, err := d.call(oldest, "/dht/ping", dhtRequest{}); err == nil {
+			return
+		}
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if bucket := d.buckets[i]; len(bucket) > 0 && bucket[0].PeerID == oldest.PeerID {
+			d.buckets[i] = append(bucket[1:len(bucket):len(bucket)], contact)
+		}
+	}()
+}
+
+// forget removes a node that failed to answer
+func (d *DHT) forget(peerID string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	i := bucketIndex(d.id.distance(nodeIDFor(peerID)))
+	if i < 0 {
+		return
+	}
+	for j, known := range d.buckets[i] {
+		if known.PeerID == peerID {
+			d.buckets[i] = append(d.buckets[i][:j:j], d.buckets[i][j+1:]...)
+			return
+		}
+	}
+}
+
+// storeProvider keeps a provider record until it expires
+func (d *DHT) storeProvider(fileHash string, record DHTProvider) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	record.expires = time.Now().Add(dhtProviderTTL)
+	if d.providers[fileHash] == nil {
+		d.providers[fileHash] = make(map[string]DHTProvider)
+	}
+	d.providers[fileHash][record.Contact.PeerID] = record
+}
+
+// localProviders returns the unexpired provider records stored for a file hash
+func (d *DHT) localProviders(fileHash string) []DHTProvider {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	records := []DHTProvider{}
+	for peerID, record := range d.providers[fileHash] {
+		if now.After(record.expires) {
+			delete(d.providers[fileHash], peerID)
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(d.providers[fileHash]) == 0 {
+		delete(d.providers, fileHash)
+	}
+	return records
+}
+
+// call sends an RPC to another node and records it in the routing table if it answers
+func (d *DHT) call(contact DHTContact, path string, req dhtRequest) (*dhtResponse, error) {
+	req.Sender = d.self()
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.httpClient.Post(d.pc.peerURL(contact.peer(), path), "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		d.forget(contact.PeerID)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+	if err := d.pc.checkResponder(resp, contact.PeerID, rolePeer); err != nil {
+		d.forget(contact.PeerID)
+		return nil, err
+	}
+
+	var dhtResp dhtResponse
+	if err := json.NewDecoder(resp.Body).Decode(&dhtResp); err != nil {
+		return nil, err
+	}
+
+	// The node only knows its own port, we know the address we reached it on
+	dhtResp.Sender.Address = contact.Address
+	for i, provider := range dhtResp.Providers {
+		if provider.Contact.PeerID == dhtResp.Sender.PeerID {
+			dhtResp.Providers[i].Contact = dhtResp.Sender
+		}
+	}
+	d.observe(dhtResp.Sender)
+	return &dhtResp, nil
+}
+
+// registerHandlers serves the DHT RPCs on the file server
+func (d *DHT) registerHandlers() {
+	for _, path := range []string{"/dht/ping", "/dht/find_node", "/dht/find_providers", "/dht/add_provider"} {
+		d.pc.fileMux.HandleFunc(path, d.handleRPC)
+	}
+}
+
+// handleRPC answers a DHT RPC from another node
+func (d *DHT) handleRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req dhtRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !d.pc.checkSender(w, r, req.Sender.PeerID) {
+		return
+	}
+
+	// The sender is reachable on the address it connected from
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Sender.Address = host
+	}
+	d.observe(req.Sender)
+
+	resp := dhtResponse{Sender: d.self()}
+	switch r.URL.Path {
+	case "/dht/find_node", "/dht/find_providers":
+		key, err := parseNodeID(req.Key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/dht/find_providers" {
+			resp.Providers = d.localProviders(req.Key)
+		}
+		for _, contact := range d.closest(key, dhtK) {
+			if contact.PeerID != req.Sender.PeerID {
+				resp.Contacts = append(resp.Contacts, contact)
+			}
+		}
+	case "/dht/add_provider":
+		// Nodes may only announce themselves
+		if req.Provider == nil || req.Provider.Contact.PeerID != req.Sender.PeerID || req.Sender.PeerID == "" {
+			http.Error(w, "provider must be the sender", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseNodeID(req.Key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Provider.Contact = req.Sender
+		d.storeProvider(req.Key, *req.Provider)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// bootstrapPeers asks the super peer for live peers to join the DHT through
+func (pc *PeerClient) bootstrapPeers() []*Peer {
+	jsonData, err := json.Marshal(map[string]string{"peerId": pc.ID})
+	if err != nil {
+		return nil
+	}
+
+	resp, err := pc.postSuperPeer("/bootstrap", jsonData)
+	if err != nil {
+		log.Printf("No DHT bootstrap peers from the super peer: %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var peers []*Peer
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&peers) != nil {
+		log.Printf("No DHT bootstrap peers from the super peer: status %d", resp.StatusCode)
+		return nil
+	}
+	return peers
+}
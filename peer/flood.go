@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-file-sharing/internal/identity"
+)
+
+const (
+	// floodTTL is the number of hops a flooded query travels
+	floodTTL = 4
+
+	// floodTimeout is how long the origin of a flooded query collects hits
+	floodTimeout = 3 * time.Second
+
+	// floodRouteTTL is how long a query is remembered for dropping duplicates and routing hits back
+	floodRouteTTL = time.Minute
+
+	// maxNeighbours caps the number of peers queries are flooded to
+	maxNeighbours = 32
+
+	// maxNeighboursPerHost caps how many neighbours peers on one address can add by
+	// sending us queries and hits
+	maxNeighboursPerHost = 2
+)
+
+// floodQuery is a search flooded from peer to peer
+type floodQuery struct {
+	QueryID    string        `json:"queryId"`
+	TTL        int           `json:"ttl"`  // Remaining hops
+	Hops       int           `json:"hops"` // Hops travelled so far
+	Search     SearchRequest `json:"search"`
+	SenderID   string        `json:"senderId"`   // Peer that forwarded the query to us
+	SenderPort int           `json:"senderPort"` // File server port of that peer
+}
+
+// limitHops checks the hops a received query claims to have travelled and cuts its
+// remaining hops so it goes no further than floodTTL from its origin, whatever the
+// sender asked for
+func (q *floodQuery) limitHops() error {
+	if q.Hops < 0 || q.Hops >= floodTTL {
+		return fmt.Errorf("query claims %d hops, at most %d are allowed", q.Hops, floodTTL-1)
+	}
+	q.TTL = min(q.TTL, floodTTL-q.Hops)
+	return nil
+}
+
+// queryHit carries a peer's matching files back along the path the query came from
+type queryHit struct {
+	QueryID   string `json:"queryId"`
+	Hops      int    `json:"hops"`      // Hops travelled back so far
+	Responder Peer   `json:"responder"` // Peer sharing the files, with the matching files only
+	Signature string `json:"signature"` // Base64 signature over hitMessage by the key in Responder.PublicKey
+}
+
+// neighbour is a peer that queries are flooded to
+type neighbour struct {
+	peer     *Peer
+	lastSeen time.Time
+}
+
+// floodRoute remembers where a query came from so hits can be sent back
+type floodRoute struct {
+	upstream   *Peer           // nil for queries we started
+	downstream map[string]bool // Neighbours the query was sent on to, the only peers hits are taken from
+	seen       time.Time
+}
+
+// Flood searches the peers this peer knows about directly, without the super peer
+type Flood struct {
+	neighbours map[string]*neighbour    // Known peers by ID
+	routes     map[string]*floodRoute   // Queries seen recently, by query ID
+	pending    map[string]chan queryHit // Hits for the queries we started, by query ID
+	httpClient *http.Client
+	mutex      sync.Mutex
+}
+
+// NewFlood creates an empty flooding state, connecting to peers through transport
+func NewFlood(transport http.RoundTripper) *Flood {
+	return &Flood{
+		neighbours: make(map[string]*neighbour),
+		routes:     make(map[string]*floodRoute),
+		pending:    make(map[string]chan queryHit),
+		httpClient: &http.Client{Timeout: floodTimeout, Transport: transport},
+	}
+}
+
+// learn adds peers as neighbours, replacing the least recently seen ones when full
+func (f *Flood) learn(selfID string, peers ...*Peer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	for _, peer := range peers {
+		if peer == nil || peer.ID == "" || peer.ID == selfID || peer.Address == "" {
+			continue
+		}
+		if known, exists := f.neighbours[peer.ID]; exists {
+			known.peer = &Peer{ID: peer.ID, Address: peer.Address, Port: peer.Port}
+			known.lastSeen = now
+			continue
+		}
+
+		if len(f.neighbours) >= maxNeighbours {
+			oldest := ""
+			for id, known := range f.neighbours {
+				if oldest == "" || known.lastSeen.Before(f.neighbours[oldest].lastSeen) {
+					oldest = id
+				}
+			}
+			delete(f.neighbours, oldest)
+		}
+		f.neighbours[peer.ID] = &neighbour{
+			peer:     &Peer{ID: peer.ID, Address: peer.Address, Port: peer.Port},
+			lastSeen: now,
+		}
+	}
+}
+
+// learnSender adds a peer that contacted us directly as a neighbour. Unlike peers the
+// super peer or the local network vouch for, it only takes a free slot and only a few
+// may share an address, so one host cannot push out the other neighbours.
+func (f *Flood) learnSender(selfID string, peer *Peer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if peer.ID == "" || peer.ID == selfID || peer.Address == "" {
+		return
+	}
+	if known, exists := f.neighbours[peer.ID]; exists {
+		known.lastSeen = time.Now()
+		return
+	}
+	if len(f.neighbours) >= maxNeighbours {
+		return
+	}
+
+	sameHost := 0
+	for _, known := range f.neighbours {
+		if known.peer.Address == peer.Address {
+			sameHost++
+		}
+	}
+	if sameHost >= maxNeighboursPerHost {
+		return
+	}
+	f.neighbours[peer.ID] = &neighbour{
+		peer:     &Peer{ID: peer.ID, Address: peer.Address, Port: peer.Port},
+		lastSeen: time.Now(),
+	}
+}
+
+// forget drops a neighbour that could not be reached
+func (f *Flood) forget(peerID string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.neighbours, peerID)
+}
+
+// neighbourPeers returns every neighbour except the one with the given ID
+func (f *Flood) neighbourPeers(except string) []*Peer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	peers := []*Peer{}
+	for id, known := range f.neighbours {
+		if id != except {
+			peers = append(peers, known.peer)
+		}
+	}
+	return peers
+}
+
+// route records where a query came from and reports whether it was new
+func (f *Flood) route(queryID string, upstream *Peer) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	for id, route := range f.routes {
+		if now.Sub(route.seen) > floodRouteTTL {
+			delete(f.routes, id)
+		}
+	}
+
+	if _, exists := f.routes[queryID]; exists {
+		return false
+	}
+	f.routes[queryID] = &floodRoute{upstream: upstream, downstream: make(map[string]bool), seen: now}
+	return true
+}
+
+// sentTo reports whether a query was sent on to a neighbour
+func (f *Flood) sentTo(queryID, peerID string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	route := f.routes[queryID]
+	return route != nil && route.downstream[peerID]
+}
+
+// postFlood sends a signed flooding message to a peer, dropping it as a neighbour if it is unreachable
+func (pc *PeerClient) postFlood(peer *Peer, path string, msg interface{}) {
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, pc.peerURL(peer, path), bytes.NewReader(jsonData))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	pc.signRequest(req, jsonData)
+
+	resp, err := pc.flood.httpClient.Do(req)
+	if err != nil {
+		pc.flood.forget(peer.ID)
+		return
+	}
+	resp.Body.Close()
+}
+
+// forwardQuery sends a query on to every neighbour except the one it came from and
+// records them as the peers hits may come back from
+func (pc *PeerClient) forwardQuery(q floodQuery, except string) {
+	q.SenderID = pc.ID
+	q.SenderPort = pc.LocalPort
+	peers := pc.flood.neighbourPeers(except)
+
+	pc.flood.mutex.Lock()
+	if route := pc.flood.routes[q.QueryID]; route != nil {
+		for _, peer := range peers {
+			route.downstream[peer.ID] = true
+		}
+	}
+	pc.flood.mutex.Unlock()
+
+	for _, peer := range peers {
+		go pc.postFlood(peer, "/query", q)
+	}
+}
+
+// hitMessage is what a responder signs for a hit: the query and its own entry without
+// the address, which the first hop back fills in
+func hitMessage(hit queryHit) []byte {
+	data, _ := json.Marshal(struct {
+		QueryID string `json:"queryId"`
+		ID      string `json:"id"`
+		Port    int    `json:"port"`
+		Files   []File `json:"files"`
+	}{hit.QueryID, hit.Responder.ID, hit.Responder.Port, hit.Responder.Files})
+	return data
+}
+
+// signHit makes this peer the responder of a hit and signs it
+func (pc *PeerClient) signHit(hit *queryHit) {
+	hit.Responder.ID = pc.ID
+	hit.Responder.PublicKey = base64.StdEncoding.EncodeToString(pc.key.Public().(ed25519.PublicKey))
+	hit.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(pc.key, hitMessage(*hit)))
+}
+
+// verifyHit checks that a hit was signed by the key its responder's ID is derived from
+func verifyHit(hit queryHit) error {
+	publicKey, err := base64.StdEncoding.DecodeString(hit.Responder.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid responder key")
+	}
+	if id := identity.PeerID(publicKey); id != hit.Responder.ID {
+		return fmt.Errorf("responder key belongs to %s, not %s", id, hit.Responder.ID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(hit.Signature)
+	if err != nil || !ed25519.Verify(publicKey, hitMessage(hit), signature) {
+		return errors.New("invalid responder signature")
+	}
+	return nil
+}
+
+// FloodSearch floods a search to the neighbouring peers and collects the hits that
+// arrive within floodTimeout
+func (pc *PeerClient) FloodSearch(req SearchRequest) (*SearchResponse, error) {
+	if len(pc.flood.neighbourPeers("")) == 0 {
+		return nil, fmt.Errorf("no neighbouring peers known to flood the search to")
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	queryID := hex.EncodeToString(buf)
+
+	hits := make(chan queryHit, 100)
+	pc.flood.route(queryID, nil)
+	pc.flood.mutex.Lock()
+	pc.flood.pending[queryID] = hits
+	pc.flood.mutex.Unlock()
+	defer func() {
+		pc.flood.mutex.Lock()
+		delete(pc.flood.pending, queryID)
+		pc.flood.mutex.Unlock()
+	}()
+
+	req.FromPeer = pc.ID
+	pc.forwardQuery(floodQuery{QueryID: queryID, TTL: floodTTL, Search: req}, "")
+
+	responders := []Peer{}
+	timeout := time.After(floodTimeout)
+collect:
+	for {
+		select {
+		case hit := <-hits:
+			responders = append(responders, hit.Responder)
+		case <-timeout:
+			break collect
+		}
+	}
+	return responseFromPeers(responders, req.Limit), nil
+}
+
+// responseFromPeers builds a search response from peers carrying their matching files,
+// grouping the files by name and content. limit <= 0 returns every file.
+func responseFromPeers(responders []Peer, limit int) *SearchResponse {
+	type variant struct{ name, hash string }
+	files := make(map[variant]*File)
+	resp := &SearchResponse{Files: []File{}, Peers: make(map[string]*Peer)}
+	for i := range responders {
+		responder := &responders[i]
+		resp.Peers[responder.ID] = responder
+		for _, file := range responder.Files {
+			key := variant{file.Name, file.Hash}
+			if files[key] == nil {
+				files[key] = &File{Name: file.Name, Hash: file.Hash, Size: file.Size, MerkleRoot: file.MerkleRoot}
+			}
+			if !contains(files[key].PeerIDs, responder.ID) {
+				files[key].PeerIDs = append(files[key].PeerIDs, responder.ID)
+			}
+		}
+	}
+
+	for _, file := range files {
+		resp.Files = append(resp.Files, *file)
+	}
+	sort.Slice(resp.Files, func(i, j int) bool {
+		a, b := resp.Files[i], resp.Files[j]
+		if len(a.PeerIDs) != len(b.PeerIDs) {
+			return len(a.PeerIDs) > len(b.PeerIDs)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Hash < b.Hash
+	})
+	resp.Total = len(resp.Files)
+	if limit > 0 && len(resp.Files) > limit {
+		resp.Files = resp.Files[:limit]
+	}
+	return resp
+}
+
+// handleQuery answers a flooded query from the shared files and passes it on
+func (pc *PeerClient) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var q floodQuery
+	if err := json.Unmarshal(body, &q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !pc.checkSender(w, r, q.SenderID) {
+		return
+	}
+	if senderID, err := pc.signerID(r, body); err != nil || senderID != q.SenderID {
+		http.Error(w, fmt.Sprintf("query is not signed by sender %q", q.SenderID), http.StatusUnauthorized)
+		return
+	}
+
+	if err := q.limitHops(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upstream := &Peer{ID: q.SenderID, Port: q.SenderPort}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		upstream.Address = host
+	}
+	pc.flood.learnSender(pc.ID, upstream)
+
+	// Duplicates arriving over other paths are dropped
+	if !pc.flood.route(q.QueryID, upstream) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Queries are relayed by other peers, so nobody can prove who asked and only
+	// public files are matched
+	if matches := pc.localMatches(q.Search, ""); len(matches) > 0 {
+		hit := queryHit{
+			QueryID:   q.QueryID,
+			Responder: Peer{Port: pc.LocalPort, Files: matches},
+		}
+		pc.signHit(&hit)
+		go pc.postFlood(upstream, "/queryhit", hit)
+	}
+
+	if q.TTL > 1 {
+		q.TTL--
+		q.Hops++
+		pc.forwardQuery(q, upstream.ID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleQueryHit delivers a hit for one of our queries or passes it back towards the origin
+func (pc *PeerClient) handleQueryHit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var hit queryHit
+	if err := json.Unmarshal(body, &hit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Hits are only taken from the neighbours the query was sent to
+	senderID, err := pc.signerID(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !pc.checkSender(w, r, senderID) {
+		return
+	}
+	if !pc.flood.sentTo(hit.QueryID, senderID) {
+		http.Error(w, "query was not sent to "+senderID, http.StatusForbidden)
+		return
+	}
+	if err := verifyHit(hit); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// A hit travels back at most as far as its query went out
+	if hit.Hops < 0 || hit.Hops >= floodTTL {
+		http.Error(w, fmt.Sprintf("hit claims %d hops, at most %d are allowed", hit.Hops, floodTTL-1), http.StatusBadRequest)
+		return
+	}
+
+	// The responder does not know its own address, the first hop back sees it. Later hops
+	// can only be peers on the query's route.
+	if hit.Hops == 0 {
+		if senderID != hit.Responder.ID {
+			http.Error(w, "first hop of a hit must come from its responder", http.StatusForbidden)
+			return
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			hit.Responder.Address = host
+		}
+		pc.flood.learnSender(pc.ID, &hit.Responder)
+	}
+
+	pc.flood.mutex.Lock()
+	hits, isOurs := pc.flood.pending[hit.QueryID]
+	route := pc.flood.routes[hit.QueryID]
+	pc.flood.mutex.Unlock()
+
+	switch {
+	case isOurs:
+		select {
+		case hits <- hit:
+		default:
+		}
+	case route != nil && route.upstream != nil:
+		hit.Hops++
+		go pc.postFlood(route.upstream, "/queryhit", hit)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// localMatches returns the shared files matching a flooded search that requester may
+// access. Every query term must appear in the name, or match it as a glob such as *.csv.
+func (pc *PeerClient) localMatches(req SearchRequest, requester string) []File {
+	if len(req.PeerIDs) > 0 && !contains(req.PeerIDs, pc.ID) {
+		return nil
+	}
+
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+
+	terms := strings.Fields(strings.ToLower(req.Query))
+	matches := []File{}
+	for _, file := range pc.Files {
+		name := strings.ToLower(file.Name)
+		matched := true
+		for _, term := range terms {
+			if strings.ContainsAny(term, "*?[") {
+				ok, _ := path.Match(term, name)
+				okBase, _ := path.Match(term, path.Base(name))
+				matched = ok || okBase
+			} else {
+				matched = strings.Contains(name, term)
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched && req.Match(file.Name, file.Hash, file.Size) && file.allows(requester) {
+			matches = append(matches, file)
+		}
+	}
+	return matches
+}
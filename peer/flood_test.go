@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+// newTestPeer returns a peer client with a fresh identity
+func newTestPeer(t *testing.T) *PeerClient {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := &PeerClient{LocalPort: 8081}
+	pc.setIdentity(key)
+	return pc
+}
+
+func TestVerifyHit(t *testing.T) {
+	responder := newTestPeer(t)
+	other := newTestPeer(t)
+
+	signed := func() queryHit {
+		hit := queryHit{
+			QueryID:   "q1",
+			Responder: Peer{Port: 8081, Files: []File{{Name: "a.txt", Hash: "aa", Size: 1}}},
+		}
+		responder.signHit(&hit)
+		return hit
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(hit *queryHit)
+		wantErr bool
+	}{
+		{"signed", func(hit *queryHit) {}, false},
+		{"address filled in on the way back", func(hit *queryHit) { hit.Responder.Address = "10.0.0.1" }, false},
+		{"files changed", func(hit *queryHit) { hit.Responder.Files[0].Hash = "bb" }, true},
+		{"port changed", func(hit *queryHit) { hit.Responder.Port = 9999 }, true},
+		{"other query", func(hit *queryHit) { hit.QueryID = "q2" }, true},
+		{"claims another ID", func(hit *queryHit) { hit.Responder.ID = other.ID }, true},
+		{"signed by another key", func(hit *queryHit) { other.signHit(hit); hit.Responder.ID = responder.ID }, true},
+		{"unsigned", func(hit *queryHit) { hit.Signature = "" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hit := signed()
+			tt.tamper(&hit)
+			if err := verifyHit(hit); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLearnSenderCapsNeighbours(t *testing.T) {
+	f := NewFlood(nil)
+	f.learn("self", &Peer{ID: "trusted", Address: "10.0.0.1", Port: 8081})
+
+	// One host sending queries under many IDs only adds a few neighbours
+	for i := 0; i < 100; i++ {
+		f.learnSender("self", &Peer{ID: fmt.Sprintf("sybil-%d", i), Address: "10.0.0.66", Port: 8081})
+	}
+	if got := len(f.neighbourPeers("")); got != 1+maxNeighboursPerHost {
+		t.Errorf("got %d neighbours, want %d", got, 1+maxNeighboursPerHost)
+	}
+
+	// Senders never push out neighbours once the list is full
+	for i := 0; i < 2*maxNeighbours; i++ {
+		f.learnSender("self", &Peer{ID: fmt.Sprintf("peer-%d", i), Address: fmt.Sprintf("10.1.0.%d", i), Port: 8081})
+	}
+	if got := len(f.neighbourPeers("")); got != maxNeighbours {
+		t.Errorf("got %d neighbours, want %d", got, maxNeighbours)
+	}
+	if len(f.neighbourPeers("trusted")) == len(f.neighbourPeers("")) {
+		t.Error("trusted neighbour was pushed out")
+	}
+}
+
+func TestFloodQueryLimitHops(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     int
+		hops    int
+		wantTTL int
+		wantErr bool
+	}{
+		{"from the origin", floodTTL, 0, floodTTL, false},
+		{"relayed", 2, 2, 2, false},
+		{"inflated TTL", 1000000, 0, floodTTL, false},
+		{"inflated TTL after hops", 1000000, 3, floodTTL - 3, false},
+		{"negative hops", 2, -5, 0, true},
+		{"too many hops", 1, floodTTL, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := floodQuery{TTL: tt.ttl, Hops: tt.hops}
+			err := q.limitHops()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && q.TTL != tt.wantTTL {
+				t.Errorf("TTL = %d, want %d", q.TTL, tt.wantTTL)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// hashCacheEntry is the hashes of a file as it was when they were computed
+type hashCacheEntry struct {
+	Size    int64    `json:"size"`
+	ModTime int64    `json:"modTime"`         // Unix nanoseconds
+	Inode   uint64   `json:"inode,omitempty"` // 0 where the system has no inodes
+	Hash    string   `json:"hash"`
+	Leaves  [][]byte `json:"leaves"` // Merkle leaves of the pieces
+}
+
+// HashCache remembers the hashes of shared files on disk, so files whose size,
+// modification time and inode are unchanged are not read again
+type HashCache struct {
+	path    string
+	entries map[string]*hashCacheEntry // By absolute file path
+	dirty   bool                       // Changed since it was last saved
+	mutex   sync.Mutex
+}
+
+// OpenHashCache loads the hash cache at path. A missing or unreadable cache starts empty.
+func OpenHashCache(path string) *HashCache {
+	c := &HashCache{path: path, entries: make(map[string]*hashCacheEntry)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &c.entries)
+	}
+	if err != nil {
+		log.Printf("Ignoring hash cache %s, every file will be hashed again: %v", path, err)
+		c.entries = make(map[string]*hashCacheEntry)
+	}
+	return c
+}
+
+// cacheKey returns the absolute path a file is cached under
+func cacheKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// lookup returns the cached hashes of a file if the file is unchanged since they were computed
+func (c *HashCache) lookup(path string, info os.FileInfo) (*hashCacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, exists := c.entries[cacheKey(path)]
+	if !exists || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() || entry.Inode != fileInode(info) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// store records the hashes of a file
+func (c *HashCache) store(path string, info os.FileInfo, hash string, leaves [][]byte) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[cacheKey(path)] = &hashCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   fileInode(info),
+		Hash:    hash,
+		Leaves:  leaves,
+	}
+	c.dirty = true
+}
+
+// retain drops the entries of every file not in paths, after a full scan
+func (c *HashCache) retain(paths map[string]bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.entries {
+		if !paths[key] {
+			delete(c.entries, key)
+			c.dirty = true
+		}
+	}
+}
+
+// Save writes the cache to disk if it changed
+func (c *HashCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// EnableHashCache keeps the hashes of shared files in a cache at path. With rehash the
+// first scan reads every file anyway and reports content that changed behind the cache.
+func (pc *PeerClient) EnableHashCache(path string, rehash bool) {
+	pc.hashCache = OpenHashCache(path)
+	pc.rehash.Store(rehash)
+}
+
+// hashFile returns the SHA-256 and Merkle leaves of a shared file, from the cache while
+// the file is unchanged. progress, if not nil, is told how many bytes were hashed.
+func (pc *PeerClient) hashFile(ctx context.Context, path string, info os.FileInfo, progress func(int64)) (string, [][]byte, error) {
+	cached, found := pc.hashCache.lookup(path, info)
+	if found && !pc.rehash.Load() {
+		if progress != nil {
+			progress(info.Size())
+		}
+		return cached.Hash, cached.Leaves, nil
+	}
+
+	hash, leaves, err := pc.calculateFileHashes(ctx, path, progress)
+	if err != nil {
+		return "", nil, err
+	}
+	if found && cached.Hash != hash {
+		log.Printf("Content of %s changed without its size or modification time changing", path)
+	}
+	pc.hashCache.store(path, info, hash, leaves)
+	return hash, leaves, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"p2p-file-sharing/internal/identity"
+)
+
+// setIdentity makes key the peer's identity and derives its ID from it
+func (pc *PeerClient) setIdentity(key ed25519.PrivateKey) {
+	pc.key = key
+	pc.ID = identity.PeerID(key.Public().(ed25519.PublicKey))
+}
+
+// LoadIdentity loads the peer's private key from path, creating it on first start, so
+// the peer keeps its ID across restarts
+func (pc *PeerClient) LoadIdentity(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return err
+		}
+		pc.setIdentity(key)
+		log.Printf("Created identity %s in %s", pc.ID, path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no key found in %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s does not hold an Ed25519 key", path)
+	}
+	pc.setIdentity(key)
+	return nil
+}
+
+// signRequest adds the peer's public key and its signature over the request to req,
+// it must be called once every header is set
+func (pc *PeerClient) signRequest(req *http.Request, body []byte) {
+	identity.Sign(req, pc.key, body)
+}
+
+// resignRedirect signs a request again when a redirect sends it to another host, as the
+// signature covers the destination
+func (pc *PeerClient) resignRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.Header.Get(identity.HeaderKey) == "" {
+		return nil
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		reader, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		if body, err = io.ReadAll(reader); err != nil {
+			return err
+		}
+	}
+	pc.signRequest(req, body)
+	return nil
+}
+
+// signerID verifies the signature over a request from another peer and returns the ID
+// derived from the key that made it
+func (pc *PeerClient) signerID(r *http.Request, body []byte) (string, error) {
+	publicKey, err := pc.signatures.Verify(r, body)
+	if err != nil {
+		return "", err
+	}
+	return identity.PeerID(publicKey), nil
+}
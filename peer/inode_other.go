@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileInode returns 0 where files have no inode, the size and modification time alone
+// decide whether a cached hash is still valid
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
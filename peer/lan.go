@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lanAnnounceInterval is how often a peer announces itself on the local network
+	lanAnnounceInterval = 10 * time.Second
+
+	// lanPeerTimeout is how long a peer stays in the local table without announcing
+	lanPeerTimeout = 35 * time.Second
+
+	// lanSearchTimeout bounds the search request sent to each local peer
+	lanSearchTimeout = 3 * time.Second
+
+	// defaultLANGroup is the multicast group and port peers announce themselves on
+	defaultLANGroup = "239.255.42.99:9999"
+)
+
+// lanAnnouncement is the datagram a peer multicasts to make itself known
+type lanAnnouncement struct {
+	ID        string `json:"id"`
+	Port      int    `json:"port"`      // File server port
+	FileCount int    `json:"fileCount"` // Number of shared files
+}
+
+// lanPeer is a peer heard on the local network
+type lanPeer struct {
+	peer      *Peer
+	fileCount int
+	lastSeen  time.Time
+}
+
+// LAN discovers peers on the local subnet through UDP multicast and searches them
+// directly, without a super peer
+type LAN struct {
+	pc         *PeerClient
+	group      *net.UDPAddr
+	peers      map[string]*lanPeer // Peers heard recently, by ID
+	reply      chan struct{}       // Signals that a new peer needs to hear from us
+	httpClient *http.Client
+	mutex      sync.Mutex
+}
+
+// EnableLAN makes the peer announce itself on and discover peers from the given
+// multicast group when it starts
+func (pc *PeerClient) EnableLAN(group string) error {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return err
+	}
+	if !addr.IP.IsMulticast() {
+		return fmt.Errorf("%s is not a multicast address", group)
+	}
+
+	pc.lan = &LAN{
+		pc:         pc,
+		group:      addr,
+		peers:      make(map[string]*lanPeer),
+		reply:      make(chan struct{}, 1),
+		httpClient: &http.Client{Timeout: lanSearchTimeout, Transport: pc.transport},
+	}
+	return nil
+}
+
+// Start announces this peer and listens for the announcements of others
+func (l *LAN) Start() {
+	go l.listen()
+	go l.announce()
+	log.Printf("Discovering peers on the local network through %s", l.group)
+}
+
+// announce multicasts this peer's announcement periodically, and as soon as a new peer
+// is heard so that it does not wait a full interval to learn about us
+func (l *LAN) announce() {
+	conn, err := net.DialUDP("udp4", nil, l.group)
+	if err != nil {
+		log.Printf("LAN announcements disabled: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(lanAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		l.pc.mutex.RLock()
+		msg := lanAnnouncement{ID: l.pc.ID, Port: l.pc.LocalPort, FileCount: len(l.pc.Files)}
+		l.pc.mutex.RUnlock()
+
+		if data, err := json.Marshal(msg); err == nil {
+			if _, err := conn.Write(data); err != nil {
+				log.Printf("Failed to announce on the local network: %v", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-l.reply:
+		}
+	}
+}
+
+// listen records the peers announcing themselves on the multicast group
+func (l *LAN) listen() {
+	conn, err := net.ListenMulticastUDP("udp4", nil, l.group)
+	if err != nil {
+		log.Printf("LAN discovery disabled: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("LAN discovery stopped: %v", err)
+			return
+		}
+
+		var msg lanAnnouncement
+		if json.Unmarshal(buf[:n], &msg) != nil || msg.ID == "" || msg.ID == l.pc.ID || msg.Port <= 0 {
+			continue
+		}
+
+		// The announcement only carries the port, the peer is reachable on the address it was sent from
+		peer := &Peer{ID: msg.ID, Address: src.IP.String(), Port: msg.Port}
+		l.mutex.Lock()
+		if _, known := l.peers[msg.ID]; !known {
+			log.Printf("Discovered peer %s on the local network at %s:%d", msg.ID, peer.Address, peer.Port)
+			select {
+			case l.reply <- struct{}{}:
+			default:
+			}
+		}
+		l.peers[msg.ID] = &lanPeer{peer: peer, fileCount: msg.FileCount, lastSeen: time.Now()}
+		l.mutex.Unlock()
+
+		// Local peers are good neighbours for flooded searches too
+		l.pc.flood.learn(l.pc.ID, peer)
+	}
+}
+
+// Peers returns the local peers heard from recently that share any files
+func (l *LAN) Peers() []*Peer {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	peers := []*Peer{}
+	for id, known := range l.peers {
+		if now.Sub(known.lastSeen) > lanPeerTimeout {
+			delete(l.peers, id)
+			continue
+		}
+		if known.fileCount > 0 {
+			peers = append(peers, known.peer)
+		}
+	}
+	return peers
+}
+
+// Search asks every local peer for its matching files and merges the answers
+func (l *LAN) Search(req SearchRequest) (*SearchResponse, error) {
+	peers := l.Peers()
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers found on the local network")
+	}
+
+	params := url.Values{}
+	params.Set("query", req.Query)
+	params.Set("hash", req.Hash)
+	params.Set("ext", strings.Join(req.Extensions, ","))
+	params.Set("peer", strings.Join(req.PeerIDs, ","))
+	params.Set("minSize", strconv.FormatInt(req.MinSize, 10))
+	params.Set("maxSize", strconv.FormatInt(req.MaxSize, 10))
+
+	answers := make(chan *Peer, len(peers))
+	for _, peer := range peers {
+		go func(peer *Peer) {
+			answers <- l.searchPeer(peer, params)
+		}(peer)
+	}
+
+	responders := []Peer{}
+	for range peers {
+		if responder := <-answers; responder != nil && len(responder.Files) > 0 {
+			responders = append(responders, *responder)
+		}
+	}
+	return responseFromPeers(responders, req.Limit), nil
+}
+
+// searchPeer returns a local peer carrying its files matching the search, or nil if it
+// could not be asked
+func (l *LAN) searchPeer(peer *Peer, params url.Values) *Peer {
+	req, err := http.NewRequest(http.MethodGet, l.pc.peerURL(peer, "/files")+"?"+params.Encode(), nil)
+	if err != nil {
+		log.Printf("Local peer %s did not answer the search: %v", peer.ID, err)
+		return nil
+	}
+	l.pc.signRequest(req, nil)
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		log.Printf("Local peer %s did not answer the search: %v", peer.ID, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	// Anyone can announce an ID, only the peer holding its certificate can answer for it
+	if err := l.pc.checkResponder(resp, peer.ID, rolePeer); err != nil {
+		log.Printf("Local peer %s did not answer the search: %v", peer.ID, err)
+		return nil
+	}
+
+	var files []File
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&files) != nil {
+		log.Printf("Local peer %s did not answer the search: status %d", peer.ID, resp.StatusCode)
+		return nil
+	}
+	return &Peer{ID: peer.ID, Address: peer.Address, Port: peer.Port, Files: files}
+}
+
+// handleFiles answers a direct search from a peer on the local network with the
+// matching shared files it may access
+func (pc *PeerClient) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pc.localMatches(searchRequestFromQuery(r), pc.requesterID(r)))
+}
@@ -1,20 +1,78 @@
-// SearchRequest represents a search query to the super peer
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p-file-sharing/internal/identity"
+	"p2p-file-sharing/internal/search"
+)
+
+// Peer represents a node in the P2P network
+type Peer struct {
+	ID           string    `json:"id"`
+	Address      string    `json:"address"`
+	Port         int       `json:"port"`
+	LastSeen     time.Time `json:"lastSeen"`
+	Files        []File    `json:"files"`
+	PublicKey    string    `json:"publicKey,omitempty"`    // Base64 Ed25519 key the ID is derived from
+	FilesVersion int64     `json:"filesVersion,omitempty"` // Version of Files, later deltas are based on it
+}
+
+// File represents a file in the P2P network
+type File struct {
+	Name       string   `json:"name"`
+	Hash       string   `json:"hash"`
+	Size       int64    `json:"size"`
+	MerkleRoot string   `json:"merkleRoot,omitempty"` // Root of the Merkle tree over the file's pieces
+	PeerIDs    []string `json:"peerIds"`
+	ACL        []string `json:"acl,omitempty"` // Peers allowed to see and download the file, empty when public
+}
+
+// SearchRequest represents a search query to the super peer. All given filters must match.
 type SearchRequest struct {
 	Query    string `json:"query"`
 	Limit    int    `json:"limit"`
+	Cursor   string `json:"cursor,omitempty"` // NextCursor of the previous page
 	FromPeer string `json:"fromPeer"`
+	search.Filters
+	PeerIDs []string `json:"peerIds,omitempty"` // Only files shared by these peers
 }
 
 // SearchResponse represents the response from the super peer
 type SearchResponse struct {
-	Files []File           `json:"files"`
-	Peers map[string]*Peer `json:"peers"`
+	Files      []File           `json:"files"`
+	Peers      map[string]*Peer `json:"peers"`
+	Total      int              `json:"total"`                // Number of matching files over all pages
+	NextCursor string           `json:"nextCursor,omitempty"` // Cursor of the next page, empty on the last one
 }
 
 // PeerClient is the client that communicates with the super peer and other peers
 type PeerClient struct {
-	ID              string
-	SuperPeerURL    string
+	ID              string             // Derived from the public key of key
+	key             ed25519.PrivateKey // Signs requests to the super peer
+	SuperPeerURL    string             // Super peer currently in use, the cluster leader once redirected to it
+	SuperPeerURLs   []string           // Every known super peer, tried in turn when the current one fails
 	LocalPort       int
 	WebPort         int
 	SharedDir       string
@@ -24,36 +82,89 @@ type PeerClient struct {
 		Progress int
 		Total    int64
 	}
-	mutex        sync.RWMutex
-	httpClient   *http.Client
-	searchResults []File
-	resultPeers   map[string]*Peer
-	statusMessage string
+	mutex           sync.RWMutex
+	httpClient      *http.Client
+	searchResults   []File
+	resultPeers     map[string]*Peer
+	searchTotal     int    // Total matches of the last search over all pages
+	nextPage        string // Web UI link to the next page of the last search
+	statusMessage   string
+	BlameBadPeers   bool                        // Avoid peers that supplied corrupt content
+	blame           map[string]int              // Corrupt downloads each peer contributed to
+	pieceHashes     map[string][][]byte         // Merkle leaves of each shared file, by file hash
+	online          bool                        // Whether the last request reached a super peer
+	superPeerHealth map[string]*superPeerHealth // Failures and backoff of each super peer, by URL
+	dht             *DHT                        // Decentralized lookup by file hash, nil unless enabled
+	flood           *Flood                      // Neighbouring peers for searching without the super peer
+	lan             *LAN                        // Peers discovered on the local network, nil unless enabled
+	watcher         *Watcher                    // Notices changes to the shared directory, nil unless enabled
+	hashCache       *HashCache                  // Hashes of unchanged shared files, nil unless enabled
+	rehash          atomic.Bool                 // Hash every file on the next full scan despite the cache
+	ScanWorkers     int                         // Files hashed at once by a scan of the shared directory
+	scan            *scanJob                    // Running or last scan of the shared directory
+	scanMutex       sync.Mutex                  // Guards scan, separately so progress never waits for the file list
+	filesGeneration uint64                      // Counts the changes rescanPaths made to Files
+	rescanned       map[string]uint64           // Paths rescanPaths changed, by filesGeneration, until a scan publishes
+	queue           *DownloadQueue              // Downloads waiting for or holding a transfer slot
+	MaxDownloads    int                         // Downloads transferred at once, the rest wait in the queue
+	QueueFile       string                      // Keeps the download queue across restarts, empty to forget it
+	fileMux         *http.ServeMux              // Handlers of the file server, the web UI uses the default mux
+	tlsConfig       *tls.Config                 // Mutual TLS for the file server, nil when serving plain HTTP
+	transport       *http.Transport             // Shared by every client connecting to super peers and peers
+	signatures      *identity.Verifier          // Rejects requests from other peers that were signed before
+	DHTBootstrap    []string                    // host:port file server addresses of peers to join the DHT through
+	ACLFile         string                      // Access control list of the shared files, re-read on every scan
+	acl             *ACL                        // Loaded from ACLFile, nil when every file is public
+	registeredFiles []File                      // Files as the super peer last acknowledged them
+	filesVersion    int64                       // Version of registeredFiles at the super peer, 0 before registering
 }
 
 // NewPeerClient creates a new peer client
-func NewPeerClient(superPeerURL string, localPort, webPort int, sharedDir, downloadDir string) *PeerClient {
-	// Generate a random ID
-	rand.Seed(time.Now().UnixNano())
-	id := fmt.Sprintf("peer-%d", rand.Intn(10000))
-
-	return &PeerClient{
-		ID:              id,
-		SuperPeerURL:    superPeerURL,
-		LocalPort:       localPort,
-		WebPort:         webPort,
-		SharedDir:       sharedDir,
-		DownloadDir:     downloadDir,
-		Files:           []File{},
+func NewPeerClient(superPeerURLs []string, localPort, webPort int, sharedDir, downloadDir string) *PeerClient {
+	// Generate a throwaway identity, LoadIdentity replaces it with a persistent one
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Failed to generate peer key: %v", err)
+	}
+
+	// Without super peers the peer only searches its neighbours directly
+	superPeerURL := ""
+	if len(superPeerURLs) > 0 {
+		superPeerURL = superPeerURLs[0]
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	pc := &PeerClient{
+		SuperPeerURL:  superPeerURL,
+		SuperPeerURLs: superPeerURLs,
+		LocalPort:     localPort,
+		WebPort:       webPort,
+		SharedDir:     sharedDir,
+		DownloadDir:   downloadDir,
+		Files:         []File{},
 		ActiveDownloads: make(map[string]struct {
 			Progress int
 			Total    int64
 		}),
-		httpClient:    &http.Client{Timeout: 30 * time.Second},
-		searchResults: []File{},
-		resultPeers:   make(map[string]*Peer),
-		statusMessage: "Ready",
+		httpClient:      &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		searchResults:   []File{},
+		resultPeers:     make(map[string]*Peer),
+		statusMessage:   "Ready",
+		blame:           make(map[string]int),
+		pieceHashes:     make(map[string][][]byte),
+		superPeerHealth: make(map[string]*superPeerHealth),
+		flood:           NewFlood(transport),
+		fileMux:         http.NewServeMux(),
+		transport:       transport,
+		signatures:      identity.NewVerifier(),
+		ScanWorkers:     runtime.NumCPU(),
+		MaxDownloads:    2,
 	}
+	pc.httpClient.CheckRedirect = pc.resignRedirect
+	pc.queue = NewDownloadQueue(pc)
+	pc.setIdentity(key)
+	return pc
 }
 
 // Start starts the peer client
@@ -62,68 +173,76 @@ func (pc *PeerClient) Start() {
 	os.MkdirAll(pc.SharedDir, 0755)
 	os.MkdirAll(pc.DownloadDir, 0755)
 
-	// Scan shared directory for files
-	pc.ScanSharedDirectory()
-
-	// Register with super peer
-	err := pc.Register()
-	if err != nil {
-		log.Fatalf("Failed to register with super peer: %v", err)
+	// Share files as they appear, change or disappear. The watcher starts before the
+	// scan so nothing changed while the scan walks the directory goes unnoticed.
+	if pc.watcher != nil {
+		pc.watcher.Start()
 	}
 
-	// Start heartbeat service
-	go pc.heartbeatService()
+	// Scan shared directory for files in the background, the web UI shows its progress
+	pc.setStatus("Scanning shared directory...")
+	scan := pc.StartScan()
 
-	// Start file server
-	go pc.startFileServer()
-
-	// Start web UI
-	pc.startWebUI()
-}
+	// Restore the download queue, its downloads resume once the shared files are known
+	if err := pc.queue.load(); err != nil {
+		log.Printf("Starting with an empty download queue: %v", err)
+	}
 
-// ScanSharedDirectory scans the shared directory for files
-func (pc *PeerClient) ScanSharedDirectory() {
-	pc.mutex.Lock()
-	defer pc.mutex.Unlock()
+	go func() {
+		scan.Wait()
+		pc.setStatus("Ready")
+		pc.queue.Start()
 
-	pc.Files = []File{}
+		// Register with super peer, keep running offline until one is reachable
+		if len(pc.SuperPeerURLs) > 0 {
+			err := pc.Register()
+			if err != nil {
+				log.Printf("Failed to register with super peer, starting offline: %v", err)
+				pc.setStatus("Offline: no super peer reachable, retrying in the background")
+			}
 
-	err := filepath.Walk(pc.SharedDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+			// Start heartbeat service
+			go pc.heartbeatService()
 		}
+	}()
 
-		if !info.IsDir() {
-			relPath, err := filepath.Rel(pc.SharedDir, path)
-			if err != nil {
-				return err
-			}
+	// Start file server
+	go pc.startFileServer()
 
-			// Calculate file hash
-			hash, err := pc.calculateFileHash(path)
-			if err != nil {
-				log.Printf("Failed to calculate hash for %s: %v", path, err)
-				return nil
-			}
+	// Discover peers on the local network
+	if pc.lan != nil {
+		pc.lan.Start()
+	}
 
-			file := File{
-				Name:    relPath,
-				Hash:    hash,
-				Size:    info.Size(),
-				PeerIDs: []string{pc.ID},
-			}
+	// Join the DHT
+	if pc.dht != nil {
+		pc.dht.registerHandlers()
+		go pc.dht.Start(pc.DHTBootstrap)
+	}
 
-			pc.Files = append(pc.Files, file)
-		}
+	// Start web UI
+	pc.startWebUI()
+}
 
-		return nil
-	})
+// sharedFileHash returns the hash of a shared file by its name relative to the shared directory
+func (pc *PeerClient) sharedFileHash(name string) (string, bool) {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
 
-	if err != nil {
-		log.Printf("Error scanning shared directory: %v", err)
+	for _, file := range pc.Files {
+		if file.Name == name {
+			return file.Hash, true
+		}
 	}
+	return "", false
+}
+
+// setStatus replaces the message shown at the top of the web UI
+func (pc *PeerClient) setStatus(message string) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
 
-	log.Printf("Found %d files in shared directory", len(pc.Files))
+	pc.statusMessage = message
 }
 
 // calculateFileHash calculates the SHA-256 hash of a file
@@ -145,21 +264,21 @@ func (pc *PeerClient) calculateFileHash(filePath string) (string, error) {
 // Register registers the peer with the super peer
 func (pc *PeerClient) Register() error {
 	pc.mutex.RLock()
-	defer pc.mutex.RUnlock()
-
 	peer := Peer{
-		ID:      pc.ID,
-		Address: "localhost", // This will be overridden by the super peer
-		Port:    pc.LocalPort,
-		Files:   pc.Files,
+		ID:           pc.ID,
+		Address:      "localhost", // This will be overridden by the super peer
+		Port:         pc.LocalPort,
+		Files:        append([]File{}, pc.Files...),
+		FilesVersion: newFilesVersion(),
 	}
+	pc.mutex.RUnlock()
 
 	jsonData, err := json.Marshal(peer)
 	if err != nil {
 		return err
 	}
 
-	resp, err := pc.httpClient.Post(pc.SuperPeerURL+"/register", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := pc.postSuperPeer("/register", jsonData)
 	if err != nil {
 		return err
 	}
@@ -170,6 +289,7 @@ func (pc *PeerClient) Register() error {
 		return fmt.Errorf("failed to register: %s", body)
 	}
 
+	pc.setRegisteredFiles(peer.Files, peer.FilesVersion)
 	log.Printf("Registered with super peer as %s", pc.ID)
 	return nil
 }
@@ -182,7 +302,7 @@ func (pc *PeerClient) Unregister() error {
 		return err
 	}
 
-	resp, err := pc.httpClient.Post(pc.SuperPeerURL+"/unregister", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := pc.postSuperPeer("/unregister", jsonData)
 	if err != nil {
 		return err
 	}
@@ -197,12 +317,21 @@ func (pc *PeerClient) Unregister() error {
 	return nil
 }
 
-// Search searches for files via the super peer
+// Search searches for files by name via the super peer
 func (pc *PeerClient) Search(query string, limit int) (*SearchResponse, error) {
-	req := SearchRequest{
-		Query:    query,
-		Limit:    limit,
-		FromPeer: pc.ID,
+	return pc.SearchWith(SearchRequest{
+		Query: query,
+		Limit: limit,
+	})
+}
+
+// SearchWith runs a structured search with filters via the super peer
+func (pc *PeerClient) SearchWith(req SearchRequest) (*SearchResponse, error) {
+	req.FromPeer = pc.ID
+
+	// Content hashes are resolved through the DHT when it is enabled
+	if pc.dht != nil && req.Hash != "" {
+		return pc.dht.Search(req)
 	}
 
 	jsonData, err := json.Marshal(req)
@@ -210,9 +339,19 @@ func (pc *PeerClient) Search(query string, limit int) (*SearchResponse, error) {
 		return nil, err
 	}
 
-	resp, err := pc.httpClient.Post(pc.SuperPeerURL+"/search", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := pc.postSuperPeer("/search", jsonData)
 	if err != nil {
-		return nil, err
+		// Fall back to asking the peers on the local network, then the peers we know elsewhere
+		if pc.lan != nil && len(pc.lan.Peers()) > 0 {
+			log.Printf("Super peer search failed, searching the local network instead: %v", err)
+			return pc.lan.Search(req)
+		}
+		log.Printf("Super peer search failed, flooding to neighbours instead: %v", err)
+		flooded, floodErr := pc.FloodSearch(req)
+		if floodErr != nil {
+			return nil, fmt.Errorf("%v, and %v", err, floodErr)
+		}
+		return flooded, nil
 	}
 	defer resp.Body.Close()
 
@@ -227,9 +366,17 @@ func (pc *PeerClient) Search(query string, limit int) (*SearchResponse, error) {
 		return nil, err
 	}
 
+	// Peers sharing the results become neighbours for flooded searches
+	for _, peer := range searchResp.Peers {
+		pc.flood.learn(pc.ID, peer)
+	}
+
 	return &searchResp, nil
 }
 
+// errUnknownPeer is returned by SendHeartbeat when the super peer has no record of this peer
+var errUnknownPeer = errors.New("super peer does not know this peer")
+
 // SendHeartbeat sends a heartbeat to the super peer
 func (pc *PeerClient) SendHeartbeat() error {
 	data := map[string]string{"peerId": pc.ID}
@@ -238,12 +385,15 @@ func (pc *PeerClient) SendHeartbeat() error {
 		return err
 	}
 
-	resp, err := pc.httpClient.Post(pc.SuperPeerURL+"/heartbeat", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := pc.postSuperPeer("/heartbeat", jsonData)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return errUnknownPeer
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("heartbeat failed: %s", body)
@@ -252,94 +402,129 @@ func (pc *PeerClient) SendHeartbeat() error {
 	return nil
 }
 
-// heartbeatService periodically sends heartbeats to the super peer
+// heartbeatService periodically sends heartbeats to the super peer, or tries to
+// register again while offline
 func (pc *PeerClient) heartbeatService() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-
 	for {
-		<-ticker.C
+		time.Sleep(pc.nextSuperPeerContact())
+		if !pc.isOnline() {
+			if err := pc.Register(); err != nil {
+				log.Printf("Still offline: %v", err)
+			}
+			continue
+		}
+
 		err := pc.SendHeartbeat()
+		if errors.Is(err, errUnknownPeer) {
+			// The super peer restarted or expired us, register again with the current files
+			log.Printf("Super peer forgot this peer, registering again")
+			err = pc.Register()
+		}
 		if err != nil {
 			log.Printf("Failed to send heartbeat: %v", err)
 		}
 	}
 }
 
-// startFileServer starts the HTTP server for serving files to other peers
-func (pc *PeerClient) startFileServer() {
-	// File request handler
-	http.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+// handleFile serves a shared file, or the byte range of it a piece request asks for
+func (pc *PeerClient) handleFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		fileName := r.URL.Query().Get("name")
-		if fileName == "" {
-			http.Error(w, "Missing file name", http.StatusBadRequest)
-			return
-		}
+	fileName := r.URL.Query().Get("name")
+	if fileName == "" {
+		http.Error(w, "Missing file name", http.StatusBadRequest)
+		return
+	}
 
-		// Sanitize the file name to prevent directory traversal
-		fileName = filepath.Clean(fileName)
-		if strings.Contains(fileName, "..") {
-			http.Error(w, "Invalid file name", http.StatusBadRequest)
-			return
-		}
+	// Only names inside the shared directory, an absolute name or one leaving it would
+	// escape the access control list as well
+	fileName = filepath.Clean(fileName)
+	if !filepath.IsLocal(fileName) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
 
-		filePath := filepath.Join(pc.SharedDir, fileName)
-		file, err := os.Open(filePath)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to open file: %v", err), http.StatusNotFound)
-			return
-		}
-		defer file.Close()
+	// Only the peers the access control list names may download restricted files
+	if !pc.mayAccess(fileName, pc.requesterID(r)) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
 
-		// Get file info
-		fileInfo, err := file.Stat()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get file info: %v", err), http.StatusInternalServerError)
-			return
-		}
+	filePath := filepath.Join(pc.SharedDir, fileName)
+	file, err := os.Open(filePath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open file: %v", err), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
 
-		// Set content type and length
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(fileName)))
+	// Get file info
+	fileInfo, err := file.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get file info: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-		// Copy the file to the response
-		_, err = io.Copy(w, file)
-		if err != nil {
-			log.Printf("Error sending file: %v", err)
-		}
-	})
+	// Set content type, ServeContent handles length and byte ranges for piece requests.
+	// The ETag lets downloaders resume with If-Range only while the content is unchanged.
+	// A file not hashed yet has none, its ranges are served as asked and the downloader
+	// checks the pieces against the Merkle root instead.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if hash, ok := pc.sharedFileHash(fileName); ok {
+		w.Header().Set("ETag", strconv.Quote(hash))
+	} else {
+		r.Header.Del("If-Range")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(fileName)))
+
+	http.ServeContent(w, r, fileName, fileInfo.ModTime(), file)
+}
+
+// startFileServer starts the HTTP server for serving files to other peers
+func (pc *PeerClient) startFileServer() {
+	// File request handler
+	pc.fileMux.HandleFunc("/file", pc.handleFile)
+
+	// Merkle proofs for verifying individual pieces
+	pc.fileMux.HandleFunc("/proof", pc.handleProof)
+
+	// Flooded searches from neighbouring peers
+	pc.fileMux.HandleFunc("/query", pc.handleQuery)
+	pc.fileMux.HandleFunc("/queryhit", pc.handleQueryHit)
+
+	// Direct searches from peers on the local network
+	pc.fileMux.HandleFunc("/files", pc.handleFiles)
 
 	// Start the server
 	addr := fmt.Sprintf(":%d", pc.LocalPort)
 	log.Printf("Starting file server on %s", addr)
 	go func() {
-		err := http.ListenAndServe(addr, nil)
+		err := pc.listenAndServe(addr, pc.fileMux, true)
 		if err != nil {
 			log.Fatalf("Failed to start file server: %v", err)
 		}
 	}()
 }
 
-// DownloadFile downloads a file from another peer
-func (pc *PeerClient) DownloadFile(fileName, fileHash string, peer *Peer) error {
+// DownloadFile downloads a file from all peers that share it. Cancelling ctx stops the
+// download, keeping the pieces fetched so far for the next attempt.
+func (pc *PeerClient) DownloadFile(ctx context.Context, file File, peers []*Peer) error {
+	fileHash := file.Hash
 	pc.mutex.Lock()
 	if _, exists := pc.ActiveDownloads[fileHash]; exists {
 		pc.mutex.Unlock()
 		return fmt.Errorf("already downloading this file")
 	}
-	
+
 	pc.ActiveDownloads[fileHash] = struct {
 		Progress int
 		Total    int64
 	}{
 		Progress: 0,
-		Total:    100, // Will be updated with actual size
+		Total:    file.Size,
 	}
 	pc.mutex.Unlock()
 
@@ -349,93 +534,69 @@ func (pc *PeerClient) DownloadFile(fileName, fileHash string, peer *Peer) error
 		pc.mutex.Unlock()
 	}()
 
-	// Create the URL for the file request
-	url := fmt.Sprintf("http://%s:%d/file?name=%s", peer.Address, peer.Port, fileName)
+	// Download into a partial file next to the destination, keeping any
+	// pieces left over from an interrupted attempt
+	destPath := filepath.Join(pc.DownloadDir, filepath.Base(file.Name))
+	partPath := destPath + partialSuffix
+	state := loadDownloadState(destPath+stateSuffix, file)
+	if offset := state.completedBytes(); offset > 0 {
+		log.Printf("Resuming download of %s, %d of %d bytes already present (verified up to offset %d)", file.Name, offset, file.Size, state.verifiedOffset())
+	}
 
-	// Send the request
-	resp, err := pc.httpClient.Get(url)
+	partFile, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("download failed: %s", body)
+	// Fetch the pieces from every usable peer in parallel
+	usable := pc.downloadSources(peers)
+	log.Printf("Downloading %s from %d peers", file.Name, len(usable))
+	pc.setStatus(fmt.Sprintf("Downloading %s from %d peers...", file.Name, len(usable)))
+	sources, err := pc.downloadPieces(ctx, file, usable, partFile, state)
+	closeErr := partFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
 	}
 
-	// Get content length
-	contentLength := resp.ContentLength
-	if contentLength > 0 {
-		pc.mutex.Lock()
-		download := pc.ActiveDownloads[fileHash]
-		download.Total = contentLength
-		pc.ActiveDownloads[fileHash] = download
-		pc.mutex.Unlock()
+	// Verify the assembled content before it is shared any further
+	err = pc.verifyDownload(file, partPath, sources)
+	if err != nil {
+		state.remove()
+		return err
 	}
 
-	// Create the destination file in downloads directory
-	destPath := filepath.Join(pc.DownloadDir, filepath.Base(fileName))
-	destFile, err := os.Create(destPath)
+	// Move the finished file into place
+	err = os.Rename(partPath, destPath)
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
+	state.remove()
 
-	// Create a buffer for reading
-	buf := make([]byte, 32*1024)
-	var totalRead int64
+	log.Printf("Downloaded %s to %s from %d peers", file.Name, destPath, len(sources))
 
-	// Read and write in chunks to update progress
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			_, writeErr := destFile.Write(buf[:n])
-			if writeErr != nil {
-				return writeErr
-			}
-			
-			totalRead += int64(n)
-			
-			// Update progress
-			if contentLength > 0 {
-				progress := int(float64(totalRead) / float64(contentLength) * 100)
-				pc.mutex.Lock()
-				download := pc.ActiveDownloads[fileHash]
-				download.Progress = progress
-				pc.ActiveDownloads[fileHash] = download
-				pc.mutex.Unlock()
-			}
-		}
-		
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
+	// Content its owner restricted is kept to this peer
+	if isRestricted(file.Hash, peers) {
+		log.Printf("Not sharing %s, its owner restricts access to it", file.Name)
+		return nil
 	}
 
-	log.Printf("Downloaded %s to %s", fileName, destPath)
-	
 	// Also copy the file to the shared directory to make it available to other peers
-	sharedPath := filepath.Join(pc.SharedDir, filepath.Base(fileName))
+	sharedPath := filepath.Join(pc.SharedDir, filepath.Base(file.Name))
 	err = copyFile(destPath, sharedPath)
 	if err != nil {
 		log.Printf("Warning: Failed to copy file to shared directory: %v", err)
 	} else {
-		log.Printf("Copied %s to shared directory for sharing", fileName)
-		
-		// Rescan shared directory and update registration
-		pc.ScanSharedDirectory()
-		err = pc.Register()
-		if err != nil {
-			log.Printf("Warning: Failed to update registration after download: %v", err)
-		} else {
-			log.Printf("Updated registration to share downloaded file")
+		log.Printf("Copied %s to shared directory for sharing", file.Name)
+
+		// Hash only the copy and send it to the super peer, a watcher notices it by itself
+		if pc.watcher == nil {
+			pc.rescanPaths([]string{filepath.Base(sharedPath)})
 		}
 	}
-	
+
 	return nil
 }
 
@@ -461,24 +622,70 @@ func copyFile(src, dst string) error {
 	return nil
 }
 
+// Helper function to check if a slice contains a string
+func contains(slice []string, str string) bool {
+	for _, item := range slice {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to split a comma separated list of URLs, dropping empty entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, strings.TrimSuffix(item, "/"))
+		}
+	}
+	return items
+}
+
 // GetDownloadProgress returns the progress of a download
 func (pc *PeerClient) GetDownloadProgress(fileHash string) (int, bool) {
 	pc.mutex.RLock()
 	defer pc.mutex.RUnlock()
-	
+
 	if download, exists := pc.ActiveDownloads[fileHash]; exists {
 		return download.Progress, true
 	}
 	return 0, false
 }
 
+// searchRequestFromQuery builds a search request from the URL parameters query, hash,
+// ext, peer, minSize and maxSize. ext and peer take comma separated lists.
+func searchRequestFromQuery(r *http.Request) SearchRequest {
+	params := r.URL.Query()
+	req := SearchRequest{
+		Query:  strings.TrimSpace(params.Get("query")),
+		Cursor: params.Get("cursor"),
+		Limit:  50,
+	}
+	req.Hash = strings.TrimSpace(params.Get("hash"))
+	req.MinSize, _ = strconv.ParseInt(params.Get("minSize"), 10, 64)
+	req.MaxSize, _ = strconv.ParseInt(params.Get("maxSize"), 10, 64)
+	for _, ext := range strings.Split(params.Get("ext"), ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			req.Extensions = append(req.Extensions, ext)
+		}
+	}
+	for _, peerID := range strings.Split(params.Get("peer"), ",") {
+		if peerID = strings.TrimSpace(peerID); peerID != "" {
+			req.PeerIDs = append(req.PeerIDs, peerID)
+		}
+	}
+	return req
+}
+
 // startWebUI starts the web-based user interface
 func (pc *PeerClient) startWebUI() {
 	// Serve static files
 	http.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
 		// Extract the file path from the URL
 		filePath := r.URL.Path[len("/static/"):]
-		
+
 		// Set appropriate content type based on file extension
 		switch {
 		case strings.HasSuffix(filePath, ".css"):
@@ -486,7 +693,7 @@ func (pc *PeerClient) startWebUI() {
 		case strings.HasSuffix(filePath, ".js"):
 			w.Header().Set("Content-Type", "application/javascript")
 		}
-		
+
 		// Serve the static content
 		switch filePath {
 		case "styles.css":
@@ -659,6 +866,40 @@ func (pc *PeerClient) startWebUI() {
 					background-color: #d90429;
 				}
 				
+				.button.small {
+					padding: 4px 10px;
+					font-size: 0.8rem;
+				}
+				
+				.inline-form {
+					display: inline-flex;
+					gap: 6px;
+					align-items: center;
+					margin: 0;
+				}
+				
+				.inline-form select {
+					padding: 6px;
+					border: 1px solid var(--border-color);
+					border-radius: 6px;
+				}
+				
+				.badge.paused {
+					background-color: #6c757d;
+				}
+				
+				.badge.failed {
+					background-color: var(--warning-color);
+				}
+				
+				.scan-progress {
+					margin-top: 10px;
+				}
+				
+				.scan-progress[hidden] {
+					display: none;
+				}
+				
 				table {
 					width: 100%;
 					border-collapse: collapse;
@@ -851,6 +1092,37 @@ func (pc *PeerClient) startWebUI() {
 					// Update progress every second
 					setInterval(updateDownloadProgress, 1000);
 					
+					// Follow a running scan of the shared directory, reloading once it is over
+					function formatBytes(size) {
+						if (size < 1024) return size + ' bytes';
+						if (size < 1024 * 1024) return (size / 1024).toFixed(1) + ' KB';
+						if (size < 1024 * 1024 * 1024) return (size / (1024 * 1024)).toFixed(1) + ' MB';
+						return (size / (1024 * 1024 * 1024)).toFixed(1) + ' GB';
+					}
+					
+					function updateScanProgress() {
+						const scanElement = document.getElementById('scan-progress');
+						if (!scanElement || scanElement.hidden) {
+							return;
+						}
+						fetch('/api/scan-progress')
+							.then(response => response.json())
+							.then(data => {
+								if (!data.running) {
+									window.location.reload();
+									return;
+								}
+								const percent = data.bytesTotal > 0 ? Math.floor(data.bytesDone * 100 / data.bytesTotal) : 0;
+								scanElement.querySelector('.progress-bar').style.width = percent + '%';
+								scanElement.querySelector('.scan-progress-text').textContent =
+									'Hashed ' + data.filesDone + ' of ' + data.filesTotal + ' files, ' +
+									formatBytes(data.bytesDone) + ' of ' + formatBytes(data.bytesTotal);
+							})
+							.catch(error => console.error('Error fetching scan progress:', error));
+					}
+					
+					setInterval(updateScanProgress, 1000);
+					
 					// Add animation to the status message
 					const statusElement = document.querySelector('.status');
 					if (statusElement) {
@@ -874,11 +1146,17 @@ func (pc *PeerClient) startWebUI() {
 			progress[hash] = download.Progress
 		}
 		pc.mutex.RUnlock()
-		
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(progress)
 	})
 
+	// API endpoint for the progress of the running or last scan
+	http.HandleFunc("/api/scan-progress", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pc.ScanProgress())
+	})
+
 	// HTML template for the web UI
 	const htmlTemplate = `
 <!DOCTYPE html>
@@ -905,6 +1183,14 @@ func (pc *PeerClient) startWebUI() {
             
             <div class="status">
                 <i class="fas fa-info-circle"></i> {{.StatusMessage}}
+                <br><i class="fas fa-server"></i> {{.SuperPeerStatus}}
+                <div id="scan-progress" class="scan-progress"{{if not .Scan.Running}} hidden{{end}}>
+                    <span class="scan-progress-text">Hashed {{.Scan.FilesDone}} of {{.Scan.FilesTotal}} files, {{formatSize .Scan.BytesDone}} of {{formatSize .Scan.BytesTotal}}</span>
+                    <form action="/scan/cancel" method="post" class="inline-form"><button type="submit" class="button danger small"><i class="fas fa-times"></i> Cancel</button></form>
+                    <div class="progress-container">
+                        <div class="progress-bar" style="width: {{.Scan.Percent}}%"></div>
+                    </div>
+                </div>
             </div>
             
             <div class="section">
@@ -943,7 +1229,12 @@ func (pc *PeerClient) startWebUI() {
                     <h2><i class="fas fa-search"></i> Search Files</h2>
                 </div>
                 <form class="search-form" action="/search" method="get">
-                    <input type="text" name="query" placeholder="Enter search term" required>
+                    <input type="text" name="query" placeholder="Enter search term, e.g. report *.csv" required>
+                    <select name="mode">
+                        <option value="">Super peer</option>
+                        <option value="lan">Local network</option>
+                        <option value="flood">Flood neighbours</option>
+                    </select>
                     <button type="submit"><i class="fas fa-search"></i> Search</button>
                 </form>
                 
@@ -971,14 +1262,28 @@ func (pc *PeerClient) startWebUI() {
                                         <div class="progress-bar" data-file-hash="{{$file.Hash}}" style="width: 0%"></div>
                                     </div>
                                 </div>
+                                {{else if isQueued $file.Hash}}
+                                <span class="badge">Queued</span>
                                 {{else}}
-                                <a href="/download?index={{$index}}" class="button"><i class="fas fa-download"></i> Download</a>
+                                <form action="/download" method="get" class="inline-form">
+                                    <input type="hidden" name="index" value="{{$index}}">
+                                    <select name="priority">
+                                        <option value="1">High</option>
+                                        <option value="0" selected>Normal</option>
+                                        <option value="-1">Low</option>
+                                    </select>
+                                    <button type="submit" class="button"><i class="fas fa-download"></i> Download</button>
+                                </form>
                                 {{end}}
                             </td>
                         </tr>
                         {{end}}
                     </tbody>
                 </table>
+                <div class="section-header">
+                    <span>Showing {{len .SearchResults}} of {{.SearchTotal}} files</span>
+                    {{if .NextPage}}<a href="{{.NextPage}}" class="button"><i class="fas fa-angle-right"></i> Next page</a>{{end}}
+                </div>
                 {{else}}
                 {{if .SearchPerformed}}
                 <div class="empty-state">
@@ -989,6 +1294,75 @@ func (pc *PeerClient) startWebUI() {
                 {{end}}
             </div>
             
+            <div class="section">
+                <div class="section-header">
+                    <h2><i class="fas fa-list-ol"></i> Download Queue</h2>
+                    <span>{{.MaxDownloads}} at a time</span>
+                </div>
+                <table>
+                    <thead>
+                        <tr>
+                            <th>Name</th>
+                            <th>Size</th>
+                            <th>Priority</th>
+                            <th>Status</th>
+                            <th>Action</th>
+                        </tr>
+                    </thead>
+                    <tbody>
+                        {{range .Queue}}
+                        <tr class="file-row">
+                            <td><i class="fas fa-file file-icon"></i> {{.File.Name}}</td>
+                            <td>{{formatSize .File.Size}}</td>
+                            <td>
+                                <form action="/queue/priority" method="post" class="inline-form">
+                                    <input type="hidden" name="hash" value="{{.File.Hash}}">
+                                    <select name="priority" onchange="this.form.submit()">
+                                        <option value="1"{{if eq (priorityName .Priority) "High"}} selected{{end}}>High</option>
+                                        <option value="0"{{if eq (priorityName .Priority) "Normal"}} selected{{end}}>Normal</option>
+                                        <option value="-1"{{if eq (priorityName .Priority) "Low"}} selected{{end}}>Low</option>
+                                    </select>
+                                </form>
+                            </td>
+                            <td>
+                                {{if eq .State "active"}}
+                                <div>
+                                    <span class="progress-text">Downloading...</span>
+                                    <div class="progress-container">
+                                        <div class="progress-bar" data-file-hash="{{.File.Hash}}" style="width: 0%"></div>
+                                    </div>
+                                </div>
+                                {{else if eq .State "failed"}}
+                                <span class="badge failed" title="{{.Error}}">Failed</span>
+                                {{else if eq .State "paused"}}
+                                <span class="badge paused">Paused</span>
+                                {{else}}
+                                <span class="badge">Queued</span>
+                                {{end}}
+                            </td>
+                            <td>
+                                <form action="/queue/up" method="post" class="inline-form"><input type="hidden" name="hash" value="{{.File.Hash}}"><button type="submit" class="button small" title="Move up"><i class="fas fa-arrow-up"></i></button></form>
+                                <form action="/queue/down" method="post" class="inline-form"><input type="hidden" name="hash" value="{{.File.Hash}}"><button type="submit" class="button small" title="Move down"><i class="fas fa-arrow-down"></i></button></form>
+                                {{if or (eq .State "paused") (eq .State "failed")}}
+                                <form action="/queue/resume" method="post" class="inline-form"><input type="hidden" name="hash" value="{{.File.Hash}}"><button type="submit" class="button small secondary" title="Resume"><i class="fas fa-play"></i></button></form>
+                                {{else}}
+                                <form action="/queue/pause" method="post" class="inline-form"><input type="hidden" name="hash" value="{{.File.Hash}}"><button type="submit" class="button small secondary" title="Pause"><i class="fas fa-pause"></i></button></form>
+                                {{end}}
+                                <form action="/queue/cancel" method="post" class="inline-form"><input type="hidden" name="hash" value="{{.File.Hash}}"><button type="submit" class="button small danger" title="Cancel"><i class="fas fa-times"></i></button></form>
+                            </td>
+                        </tr>
+                        {{else}}
+                        <tr>
+                            <td colspan="5" class="empty-state">
+                                <i class="fas fa-list-ol"></i>
+                                <p>No queued downloads</p>
+                            </td>
+                        </tr>
+                        {{end}}
+                    </tbody>
+                </table>
+            </div>
+            
             <div class="section">
                 <div class="section-header">
                     <h2><i class="fas fa-download"></i> Downloaded Files</h2>
@@ -1051,6 +1425,8 @@ func (pc *PeerClient) startWebUI() {
 			_, exists := pc.ActiveDownloads[hash]
 			return exists
 		},
+		"isQueued":     pc.queue.Contains,
+		"priorityName": priorityName,
 	}
 
 	// Parse the HTML template
@@ -1077,7 +1453,12 @@ func (pc *PeerClient) startWebUI() {
 				return err
 			}
 
-			if !info.IsDir() {
+			// Corrupt downloads are kept aside and not offered
+			if info.IsDir() && info.Name() == quarantineDirName {
+				return filepath.SkipDir
+			}
+
+			if !info.IsDir() && !isPartialDownload(path) {
 				downloadedFiles = append(downloadedFiles, struct {
 					Name string
 					Size int64
@@ -1098,22 +1479,38 @@ func (pc *PeerClient) startWebUI() {
 		data := struct {
 			ID              string
 			StatusMessage   string
+			SuperPeerStatus string
 			Files           []File
 			SearchResults   []File
 			SearchPerformed bool
+			SearchTotal     int
+			NextPage        string
+			Scan            ScanProgress
+			Queue           []QueuedDownload
+			MaxDownloads    int
 			DownloadedFiles []struct {
 				Name string
 				Size int64
 			}
 		}{
 			ID:              pc.ID,
-			StatusMessage:   pc.statusMessage,
-			Files:           pc.Files,
-			SearchResults:   pc.searchResults,
-			SearchPerformed: len(pc.searchResults) > 0,
+			SuperPeerStatus: pc.superPeerStatus(),
+			Scan:            pc.ScanProgress(),
+			Queue:           pc.queue.Items(),
+			MaxDownloads:    pc.MaxDownloads,
 			DownloadedFiles: downloadedFiles,
 		}
 
+		// The scan, searches and downloads change these from other goroutines
+		pc.mutex.RLock()
+		data.StatusMessage = pc.statusMessage
+		data.Files = pc.Files
+		data.SearchResults = pc.searchResults
+		data.SearchPerformed = len(pc.searchResults) > 0
+		data.SearchTotal = pc.searchTotal
+		data.NextPage = pc.nextPage
+		pc.mutex.RUnlock()
+
 		// Execute the template
 		w.Header().Set("Content-Type", "text/html")
 		err = tmpl.Execute(w, data)
@@ -1122,40 +1519,89 @@ func (pc *PeerClient) startWebUI() {
 		}
 	})
 
-	// Handler for scanning the shared directory
+	// Handler for scanning the shared directory in the background
 	http.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
-		pc.statusMessage = "Scanning shared directory..."
-		pc.ScanSharedDirectory()
-		err := pc.Register()
-		if err != nil {
-			pc.statusMessage = fmt.Sprintf("Failed to update registration: %v", err)
-		} else {
-			pc.statusMessage = fmt.Sprintf("Found %d files in shared directory", len(pc.Files))
+		pc.setStatus("Scanning shared directory...")
+		job := pc.StartScan()
+		go func() {
+			if err := job.Wait(); err != nil {
+				if progress := job.progress(); progress.Cancelled {
+					pc.setStatus("Scan cancelled, sharing the files found before it")
+				} else {
+					pc.setStatus(fmt.Sprintf("Scan failed: %v", err))
+				}
+				return
+			}
+			err := pc.UpdateRegistration()
+			if err != nil {
+				pc.setStatus(fmt.Sprintf("Failed to update registration: %v", err))
+			} else {
+				pc.mutex.RLock()
+				count := len(pc.Files)
+				pc.mutex.RUnlock()
+				pc.setStatus(fmt.Sprintf("Found %d files in shared directory", count))
+			}
+		}()
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
+	// Handler for cancelling a running scan
+	http.HandleFunc("/scan/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !pc.CancelScan() {
+			pc.setStatus("No scan is running")
 		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 
 	// Handler for searching files
 	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query().Get("query")
-		if query == "" {
+		req := searchRequestFromQuery(r)
+		if req.Query == "" && req.Hash == "" && len(req.Extensions) == 0 && len(req.PeerIDs) == 0 && req.MinSize == 0 && req.MaxSize == 0 {
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		pc.statusMessage = fmt.Sprintf("Searching for '%s'...", query)
-		results, err := pc.Search(query, 50)
+		pc.setStatus(fmt.Sprintf("Searching for '%s'...", req.Query))
+		var results *SearchResponse
+		var err error
+		switch r.URL.Query().Get("mode") {
+		case "flood":
+			results, err = pc.FloodSearch(req)
+		case "lan":
+			if pc.lan == nil {
+				err = fmt.Errorf("local network discovery is disabled")
+			} else {
+				results, err = pc.lan.Search(req)
+			}
+		default:
+			results, err = pc.SearchWith(req)
+		}
 		if err != nil {
-			pc.statusMessage = fmt.Sprintf("Search failed: %v", err)
+			pc.setStatus(fmt.Sprintf("Search failed: %v", err))
 		} else {
+			nextPage := ""
+			if results.NextCursor != "" {
+				params := r.URL.Query()
+				params.Set("cursor", results.NextCursor)
+				nextPage = "/search?" + params.Encode()
+			}
+
+			pc.mutex.Lock()
 			pc.searchResults = results.Files
 			pc.resultPeers = results.Peers
-
+			pc.searchTotal = results.Total
+			pc.nextPage = nextPage
 			if len(results.Files) == 0 {
 				pc.statusMessage = "No files found"
 			} else {
-				pc.statusMessage = fmt.Sprintf("Found %d files", len(results.Files))
+				pc.statusMessage = fmt.Sprintf("Found %d files", results.Total)
 			}
+			pc.mutex.Unlock()
 		}
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -1169,42 +1615,54 @@ func (pc *PeerClient) startWebUI() {
 			return
 		}
 
+		pc.mutex.RLock()
+		searchResults, resultPeers := pc.searchResults, pc.resultPeers
+		pc.mutex.RUnlock()
+
 		index, err := strconv.Atoi(indexStr)
-		if err != nil || index < 0 || index >= len(pc.searchResults) {
-			pc.statusMessage = "Invalid file index"
+		if err != nil || index < 0 || index >= len(searchResults) {
+			pc.setStatus("Invalid file index")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		file := pc.searchResults[index]
+		file := searchResults[index]
 		if len(file.PeerIDs) == 0 {
-			pc.statusMessage = "No peers available for this file"
+			pc.setStatus("No peers available for this file")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		// Pick the first available peer
-		peerID := file.PeerIDs[0]
-		peer, exists := pc.resultPeers[peerID]
-		if !exists {
-			pc.statusMessage = "Peer information not available"
+		// Download from every peer that holds this exact content
+		peers := pc.peersWithHash(file.Hash, resultPeers)
+		if len(peers) == 0 {
+			pc.setStatus("No trusted peers available for this file")
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 			return
 		}
 
-		pc.statusMessage = fmt.Sprintf("Downloading %s from peer %s...", file.Name, peer.ID)
-		go func() {
-			err := pc.DownloadFile(file.Name, file.Hash, peer)
+		// Downloads start in priority order as earlier ones finish
+		priority := priorityNormal
+		if value := r.URL.Query().Get("priority"); value != "" {
+			priority, err = strconv.Atoi(value)
 			if err != nil {
-				pc.statusMessage = fmt.Sprintf("Download failed: %v", err)
-			} else {
-				pc.statusMessage = fmt.Sprintf("Download complete: %s", file.Name)
+				pc.setStatus("Invalid priority")
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
 			}
-		}()
+		}
+		if err := pc.queue.Add(file, peers, priority); err != nil {
+			pc.setStatus(fmt.Sprintf("Download failed: %v", err))
+		} else {
+			pc.setStatus(fmt.Sprintf("Queued %s for download from %d peers", file.Name, len(peers)))
+		}
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 
+	// Handlers for reordering, pausing and cancelling queued downloads
+	pc.registerQueueHandlers()
+
 	// Handler for serving downloaded files
 	http.HandleFunc("/downloaded/", func(w http.ResponseWriter, r *http.Request) {
 		fileName := strings.TrimPrefix(r.URL.Path, "/downloaded/")
@@ -1226,9 +1684,9 @@ func (pc *PeerClient) startWebUI() {
 
 	// Handler for exiting the program
 	http.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
-		pc.statusMessage = "Unregistering from super peer..."
+		pc.setStatus("Unregistering from super peer...")
 		pc.Unregister()
-		
+
 		// Return a page that says the program is shutting down
 		w.Header().Set("Content-Type", "text/html")
 		w.Write([]byte(`
@@ -1290,7 +1748,7 @@ func (pc *PeerClient) startWebUI() {
 			</body>
 			</html>
 		`))
-		
+
 		// Shutdown the program after a short delay
 		go func() {
 			time.Sleep(2 * time.Second)
@@ -1300,20 +1758,83 @@ func (pc *PeerClient) startWebUI() {
 
 	// Start the web server
 	addr := fmt.Sprintf(":%d", pc.WebPort)
-	log.Printf("Starting web UI on http://localhost:%d", pc.WebPort)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	log.Printf("Starting web UI on %s://localhost:%d", pc.scheme(), pc.WebPort)
+	log.Fatal(pc.listenAndServe(addr, http.DefaultServeMux, false))
 }
 
 func main() {
 	// Parse command line flags
-	superPeerURL := flag.String("super", "http://localhost:8080", "URL of the super peer")
+	superPeerURLs := flag.String("super", "http://localhost:8080", "Comma separated URLs of the super peers in the cluster, empty to search the local network only")
 	localPort := flag.Int("port", 8081, "Local port for the file server")
 	webPort := flag.Int("webport", 8090, "Port for the web UI")
 	sharedDir := flag.String("shared", "./shared", "Directory to share files from")
 	downloadDir := flag.String("download", "./downloads", "Directory to download files to")
+	blame := flag.Bool("blame", true, "Avoid peers that supplied content failing hash verification")
+	dht := flag.Bool("dht", false, "Join the Kademlia DHT to look up files by hash without a super peer")
+	dhtBootstrap := flag.String("dht-bootstrap", "", "Comma separated host:port file server addresses of DHT peers to join through")
+	lan := flag.Bool("lan", true, "Discover peers on the local network through UDP multicast")
+	lanGroup := flag.String("lan-group", defaultLANGroup, "Multicast group and port for local network discovery")
+	keyFile := flag.String("key", "peer.key", "Private key file of the peer, created on first start, the peer ID is derived from it")
+	showID := flag.Bool("show-id", false, "Print the peer ID derived from the key file and exit")
+	tlsCert := flag.String("tls-cert", "", "Peer certificate issued with the super peer's 'ca issue -name <peer ID>', enables mutual TLS")
+	tlsKey := flag.String("tls-key", "", "Private key of the TLS certificate")
+	tlsCA := flag.String("tls-ca", "./ca/ca.pem", "CA certificate super peers and other peers must present a certificate from")
+	hashCache := flag.String("hash-cache", "hashcache.json", "File caching the hashes of shared files by path, size, modification time and inode, empty to hash every file on every scan")
+	maxDownloads := flag.Int("max-downloads", 2, "Number of queued downloads transferred at once")
+	queueFile := flag.String("queue", "queue.json", "File keeping the download queue across restarts, empty to forget it on exit")
+	hashWorkers := flag.Int("hash-workers", runtime.NumCPU(), "Number of shared files hashed at once while scanning the shared directory")
+	rehash := flag.Bool("rehash", false, "Hash every shared file on start despite the hash cache, reporting content that changed behind it")
+	watch := flag.Bool("watch", true, "Watch the shared directory and update the shared files as they change, with inotify on Linux and polling elsewhere")
+	aclFile := flag.String("acl", "acl.json", "Access control list naming the peers and groups allowed to access shared paths, every file is public without it")
 	flag.Parse()
 
+	superPeers := splitList(*superPeerURLs)
+	if len(superPeers) == 0 && !*lan {
+		log.Fatalf("A super peer URL is required when local network discovery is disabled")
+	}
+	if *hashWorkers < 1 {
+		log.Fatalf("At least one hash worker is required")
+	}
+	if *maxDownloads < 1 {
+		log.Fatalf("At least one simultaneous download is required")
+	}
+
 	// Create and start the peer client
-	client := NewPeerClient(*superPeerURL, *localPort, *webPort, *sharedDir, *downloadDir)
+	client := NewPeerClient(superPeers, *localPort, *webPort, *sharedDir, *downloadDir)
+	if err := client.LoadIdentity(*keyFile); err != nil {
+		log.Fatalf("Failed to load peer key: %v", err)
+	}
+	if *showID {
+		fmt.Println(client.ID)
+		return
+	}
+	if *tlsCert != "" {
+		if err := client.EnableTLS(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+	}
+	if _, err := LoadACL(*aclFile); err != nil {
+		log.Fatalf("Failed to load access control list: %v", err)
+	}
+	client.ACLFile = *aclFile
+	client.BlameBadPeers = *blame
+	client.ScanWorkers = *hashWorkers
+	client.MaxDownloads = *maxDownloads
+	client.QueueFile = *queueFile
+	client.DHTBootstrap = splitList(*dhtBootstrap)
+	if *dht {
+		client.EnableDHT()
+	}
+	if *hashCache != "" {
+		client.EnableHashCache(*hashCache, *rehash)
+	}
+	if *watch {
+		client.EnableWatch()
+	}
+	if *lan {
+		if err := client.EnableLAN(*lanGroup); err != nil {
+			log.Fatalf("Invalid LAN discovery group: %v", err)
+		}
+	}
 	client.Start()
 }
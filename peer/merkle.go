@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Domain separation prefixes so a leaf can never be mistaken for an inner node
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProof proves that a piece hash belongs to a file's Merkle root
+type MerkleProof struct {
+	Root     string       `json:"root"`
+	Index    int          `json:"index"`
+	Leaf     string       `json:"leaf"`
+	Siblings []MerkleNode `json:"siblings"`
+}
+
+// MerkleNode is a sibling hash on the path from a leaf to the root
+type MerkleNode struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // Whether the sibling is the left child
+}
+
+// merkleLeaf hashes the contents of a single piece
+func merkleLeaf(piece []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(piece)
+	return h.Sum(nil)
+}
+
+// merkleParent hashes two child nodes into their parent
+func merkleParent(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleLevels builds every level of the tree, from the leaves up to the root.
+// A node without a sibling is promoted to the next level unchanged.
+func merkleLevels(leaves [][]byte) [][][]byte {
+	if len(leaves) == 0 {
+		leaves = [][]byte{merkleLeaf(nil)}
+	}
+
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleParent(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// merkleRoot returns the hex encoded root of the tree over the given piece hashes
+func merkleRoot(leaves [][]byte) string {
+	levels := merkleLevels(leaves)
+	return hex.EncodeToString(levels[len(levels)-1][0])
+}
+
+// merkleProof builds the proof for the piece at index
+func merkleProof(leaves [][]byte, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("piece %d out of range", index)
+	}
+
+	levels := merkleLevels(leaves)
+	proof := &MerkleProof{
+		Root:  hex.EncodeToString(levels[len(levels)-1][0]),
+		Index: index,
+		Leaf:  hex.EncodeToString(leaves[index]),
+	}
+
+	pos := index
+	for _, level := range levels[:len(levels)-1] {
+		sibling := pos ^ 1
+		if sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, MerkleNode{
+				Hash: hex.EncodeToString(level[sibling]),
+				Left: sibling < pos,
+			})
+		}
+		pos /= 2
+	}
+	return proof, nil
+}
+
+// verify checks that the proof links the given contents of piece index, out of
+// numLeaves pieces, to root. The sibling positions must match the piece's place in
+// the tree so a valid proof for one piece cannot be replayed for another.
+func (p *MerkleProof) verify(piece []byte, index, numLeaves int, root string) bool {
+	node := merkleLeaf(piece)
+	if hex.EncodeToString(node) != p.Leaf {
+		return false
+	}
+
+	siblings := p.Siblings
+	for pos, width := index, numLeaves; width > 1; pos, width = pos/2, (width+1)/2 {
+		sibling := pos ^ 1
+		if sibling >= width {
+			continue
+		}
+		if len(siblings) == 0 || siblings[0].Left != (sibling < pos) {
+			return false
+		}
+
+		hash, err := hex.DecodeString(siblings[0].Hash)
+		if err != nil {
+			return false
+		}
+		if siblings[0].Left {
+			node = merkleParent(hash, node)
+		} else {
+			node = merkleParent(node, hash)
+		}
+		siblings = siblings[1:]
+	}
+	return len(siblings) == 0 && hex.EncodeToString(node) == root
+}
+
+// calculateFileHashes computes the SHA-256 of a file and the Merkle leaves of its pieces in one pass.
+// progress, if not nil, is told the size of every piece read, and hashing stops once ctx is done.
+func (pc *PeerClient) calculateFileHashes(ctx context.Context, filePath string, progress func(int64)) (string, [][]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	leaves := [][]byte{}
+	buf := make([]byte, pieceSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			leaves = append(leaves, merkleLeaf(buf[:n]))
+			if progress != nil {
+				progress(int64(n))
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), leaves, nil
+}
+
+// handleProof serves the Merkle proof for one piece of a shared file
+func (pc *PeerClient) handleProof(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileHash := r.URL.Query().Get("hash")
+	index, err := strconv.Atoi(r.URL.Query().Get("piece"))
+	if fileHash == "" || err != nil {
+		http.Error(w, "Missing file hash or piece index", http.StatusBadRequest)
+		return
+	}
+
+	pc.mutex.RLock()
+	leaves, exists := pc.pieceHashes[fileHash]
+	pc.mutex.RUnlock()
+	if !exists {
+		http.Error(w, "Unknown file hash", http.StatusNotFound)
+		return
+	}
+	if !pc.mayAccessHash(fileHash, pc.requesterID(r)) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	proof, err := merkleProof(leaves, index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proof)
+}
+
+// fetchProof asks a peer for the Merkle proof of a piece, giving up once ctx is done
+func (pc *PeerClient) fetchProof(ctx context.Context, peer *Peer, fileHash string, index int) (*MerkleProof, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pc.peerURL(peer, fmt.Sprintf("/proof?hash=%s&piece=%d", fileHash, index)), nil)
+	if err != nil {
+		return nil, err
+	}
+	pc.signRequest(req, nil)
+
+	resp, err := pc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := pc.checkResponder(resp, peer.ID, rolePeer); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("proof request failed: %s", bytes.TrimSpace(body))
+	}
+
+	var proof MerkleProof
+	if err := json.NewDecoder(resp.Body).Decode(&proof); err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
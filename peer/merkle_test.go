@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testPieces returns n distinct pieces and their Merkle leaves
+func testPieces(n int) ([][]byte, [][]byte) {
+	pieces := make([][]byte, n)
+	leaves := make([][]byte, n)
+	for i := range pieces {
+		pieces[i] = []byte(fmt.Sprintf("piece %d", i))
+		leaves[i] = merkleLeaf(pieces[i])
+	}
+	return pieces, leaves
+}
+
+func TestMerkleProofVerify(t *testing.T) {
+	for _, numLeaves := range []int{1, 2, 3, 5, 8} {
+		pieces, leaves := testPieces(numLeaves)
+		root := merkleRoot(leaves)
+		for index := range pieces {
+			t.Run(fmt.Sprintf("%d of %d", index, numLeaves), func(t *testing.T) {
+				proof, err := merkleProof(leaves, index)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if proof.Root != root {
+					t.Errorf("proof root %s, want %s", proof.Root, root)
+				}
+				if !proof.verify(pieces[index], index, numLeaves, root) {
+					t.Error("valid proof rejected")
+				}
+			})
+		}
+	}
+}
+
+func TestMerkleProofRejects(t *testing.T) {
+	const numLeaves = 5
+	pieces, leaves := testPieces(numLeaves)
+	root := merkleRoot(leaves)
+	proof := func(index int) *MerkleProof {
+		p, err := merkleProof(leaves, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name      string
+		proof     *MerkleProof
+		piece     []byte
+		index     int
+		numLeaves int
+		root      string
+	}{
+		{"corrupt piece", proof(1), []byte("corrupt"), 1, numLeaves, root},
+		{"other root", proof(1), pieces[1], 1, numLeaves, merkleRoot(leaves[:4])},
+		{"other piece count", proof(4), pieces[4], 4, 8, root},
+		// A proof and piece that are valid together, presented for the wrong index
+		{"moved to sibling index", proof(0), pieces[0], 1, numLeaves, root},
+		{"moved to other subtree", proof(1), pieces[1], 3, numLeaves, root},
+		{"moved to promoted last piece", proof(0), pieces[0], 4, numLeaves, root},
+		{"last piece moved into the tree", proof(4), pieces[4], 0, numLeaves, root},
+		{"missing sibling", func() *MerkleProof {
+			p := proof(2)
+			p.Siblings = p.Siblings[:len(p.Siblings)-1]
+			return p
+		}(), pieces[2], 2, numLeaves, root},
+		{"extra sibling", func() *MerkleProof {
+			p := proof(2)
+			p.Siblings = append(p.Siblings, p.Siblings[0])
+			return p
+		}(), pieces[2], 2, numLeaves, root},
+		{"flipped sibling side", func() *MerkleProof {
+			p := proof(2)
+			p.Siblings[0].Left = !p.Siblings[0].Left
+			return p
+		}(), pieces[2], 2, numLeaves, root},
+		{"invalid sibling hash", func() *MerkleProof {
+			p := proof(2)
+			p.Siblings[0].Hash = "not hex"
+			return p
+		}(), pieces[2], 2, numLeaves, root},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.proof.verify(tt.piece, tt.index, tt.numLeaves, tt.root) {
+				t.Error("invalid proof accepted")
+			}
+		})
+	}
+}
+
+func TestMerkleProofOutOfRange(t *testing.T) {
+	_, leaves := testPieces(3)
+	for _, index := range []int{-1, 3} {
+		if _, err := merkleProof(leaves, index); err == nil {
+			t.Errorf("proof for piece %d of 3 built", index)
+		}
+	}
+}
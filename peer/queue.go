@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// States of a queued download
+const (
+	queueWaiting = "queued"
+	queueActive  = "active"
+	queuePaused  = "paused"
+	queueFailed  = "failed"
+)
+
+// Priorities offered by the web UI, any integer is accepted
+const (
+	priorityLow    = -1
+	priorityNormal = 0
+	priorityHigh   = 1
+)
+
+// errNotQueued is returned for actions on a file hash that is not in the queue
+var errNotQueued = errors.New("file is not in the download queue")
+
+// QueuedDownload is a file waiting in the download queue or being downloaded from it
+type QueuedDownload struct {
+	File     File      `json:"file"`
+	Peers    []*Peer   `json:"peers"`    // Sources found when the file was queued
+	Priority int       `json:"priority"` // Higher priorities start first
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"` // Why the last attempt failed
+	Added    time.Time `json:"added"`
+
+	cancel    context.CancelFunc // Stops the transfer while it is active
+	cancelled bool               // Removed while active, the partial file goes once the transfer stops
+}
+
+// DownloadQueue starts queued downloads by priority, at most MaxDownloads of the peer at
+// once, and keeps the queue in QueueFile so it survives a restart
+type DownloadQueue struct {
+	pc       *PeerClient
+	items    []*QueuedDownload          // Sorted by priority, earlier items start first within a priority
+	draining map[string]*QueuedDownload // Cancelled downloads whose transfers are still stopping, by file hash
+	mutex    sync.Mutex
+
+	download func(ctx context.Context, file File, peers []*Peer) error // Transfers a file, the peer's DownloadFile
+}
+
+// NewDownloadQueue creates an empty download queue
+func NewDownloadQueue(pc *PeerClient) *DownloadQueue {
+	return &DownloadQueue{
+		pc:       pc,
+		items:    []*QueuedDownload{},
+		draining: make(map[string]*QueuedDownload),
+		download: pc.DownloadFile,
+	}
+}
+
+// load restores the queue from QueueFile. Transfers that were active when the peer
+// stopped wait again and resume from their partial files.
+func (q *DownloadQueue) load() error {
+	if q.pc.QueueFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(q.pc.QueueFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	items := []*QueuedDownload{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.State == queueActive {
+			item.State = queueWaiting
+		}
+	}
+
+	q.mutex.Lock()
+	q.items = items
+	q.mutex.Unlock()
+	log.Printf("Loaded %d downloads from the download queue", len(items))
+	return nil
+}
+
+// saveLocked atomically writes the queue to QueueFile
+func (q *DownloadQueue) saveLocked() {
+	if q.pc.QueueFile == "" {
+		return
+	}
+	data, err := json.Marshal(q.items)
+	if err == nil {
+		tmp := q.pc.QueueFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, q.pc.QueueFile)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save download queue: %v", err)
+	}
+}
+
+// findLocked returns the position of the queued file with the given hash, or -1
+func (q *DownloadQueue) findLocked(fileHash string) int {
+	for i, item := range q.items {
+		if item.File.Hash == fileHash {
+			return i
+		}
+	}
+	return -1
+}
+
+// nameTakenLocked reports whether a different file with the same destination name is
+// queued or still stopping, as both would be downloaded into the same partial file
+func (q *DownloadQueue) nameTakenLocked(file File) bool {
+	name := filepath.Base(file.Name)
+	for _, item := range q.items {
+		if item.File.Hash != file.Hash && filepath.Base(item.File.Name) == name {
+			return true
+		}
+	}
+	for _, item := range q.draining {
+		if item.File.Hash != file.Hash && filepath.Base(item.File.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// insertLocked adds an item after every item of the same or a higher priority
+func (q *DownloadQueue) insertLocked(item *QueuedDownload) {
+	pos := len(q.items)
+	for i, other := range q.items {
+		if other.Priority < item.Priority {
+			pos = i
+			break
+		}
+	}
+	q.items = append(q.items, nil)
+	copy(q.items[pos+1:], q.items[pos:])
+	q.items[pos] = item
+}
+
+// removeLocked drops the item at pos from the queue
+func (q *DownloadQueue) removeLocked(pos int) *QueuedDownload {
+	item := q.items[pos]
+	q.items = append(q.items[:pos], q.items[pos+1:]...)
+	return item
+}
+
+// sourcePeer copies a peer with only its entry for the given file, which is all a
+// download needs from it
+func sourcePeer(peer *Peer, fileHash string) *Peer {
+	source := *peer
+	source.Files = nil
+	for _, file := range peer.Files {
+		if file.Hash == fileHash {
+			source.Files = append(source.Files, file)
+		}
+	}
+	return &source
+}
+
+// Add queues a file for download from the given peers
+func (q *DownloadQueue) Add(file File, peers []*Peer, priority int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.findLocked(file.Hash) >= 0 {
+		return fmt.Errorf("%s is already in the download queue", file.Name)
+	}
+	if _, stopping := q.draining[file.Hash]; stopping {
+		return fmt.Errorf("%s is still being cancelled, try again in a moment", file.Name)
+	}
+	if q.nameTakenLocked(file) {
+		return fmt.Errorf("another file named %s is already in the download queue", filepath.Base(file.Name))
+	}
+	sources := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		sources = append(sources, sourcePeer(peer, file.Hash))
+	}
+	q.insertLocked(&QueuedDownload{
+		File:     file,
+		Peers:    sources,
+		Priority: priority,
+		State:    queueWaiting,
+		Added:    time.Now(),
+	})
+	q.saveLocked()
+	q.dispatchLocked()
+	return nil
+}
+
+// Start begins the downloads waiting in the queue
+func (q *DownloadQueue) Start() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.dispatchLocked()
+}
+
+// dispatchLocked starts waiting downloads in queue order until MaxDownloads transfers
+// run, counting cancelled ones until they have stopped
+func (q *DownloadQueue) dispatchLocked() {
+	running := len(q.draining)
+	for _, item := range q.items {
+		if item.cancel != nil {
+			running++
+		}
+	}
+	for _, item := range q.items {
+		if running >= q.pc.MaxDownloads {
+			return
+		}
+		// A download resumed before its paused transfer stopped starts once it has
+		if item.State != queueWaiting || item.cancel != nil {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		item.State = queueActive
+		item.Error = ""
+		item.cancel = cancel
+		running++
+		go q.transfer(ctx, item)
+	}
+}
+
+// transfer downloads a queued file and records the outcome
+func (q *DownloadQueue) transfer(ctx context.Context, item *QueuedDownload) {
+	err := q.download(ctx, item.File, item.Peers)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	item.cancel = nil
+
+	switch {
+	case item.cancelled:
+		delete(q.draining, item.File.Hash)
+		q.pc.removePartialDownload(item.File)
+		log.Printf("Cancelled download of %s", item.File.Name)
+	case err == nil:
+		if pos := q.findLocked(item.File.Hash); pos >= 0 {
+			q.removeLocked(pos)
+		}
+		q.pc.setStatus(fmt.Sprintf("Download complete: %s", item.File.Name))
+	case ctx.Err() != nil:
+		log.Printf("Paused download of %s", item.File.Name)
+	default:
+		item.State = queueFailed
+		item.Error = err.Error()
+		q.pc.setStatus(fmt.Sprintf("Download failed: %v", err))
+		log.Printf("Download of %s failed: %v", item.File.Name, err)
+	}
+	q.saveLocked()
+	q.dispatchLocked()
+}
+
+// Pause stops a download, keeping its pieces, until it is resumed
+func (q *DownloadQueue) Pause(fileHash string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pos := q.findLocked(fileHash)
+	if pos < 0 {
+		return errNotQueued
+	}
+	item := q.items[pos]
+	if item.cancel != nil {
+		item.cancel()
+	}
+	item.State = queuePaused
+	q.saveLocked()
+	q.dispatchLocked()
+	return nil
+}
+
+// Resume puts a paused or failed download back in the queue
+func (q *DownloadQueue) Resume(fileHash string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pos := q.findLocked(fileHash)
+	if pos < 0 {
+		return errNotQueued
+	}
+	item := q.items[pos]
+	if item.State == queuePaused || item.State == queueFailed {
+		item.State = queueWaiting
+		item.Error = ""
+	}
+	q.saveLocked()
+	q.dispatchLocked()
+	return nil
+}
+
+// Cancel removes a download from the queue and deletes what was downloaded of it
+func (q *DownloadQueue) Cancel(fileHash string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pos := q.findLocked(fileHash)
+	if pos < 0 {
+		return errNotQueued
+	}
+	item := q.removeLocked(pos)
+	if item.cancel != nil {
+		// The transfer still has the partial file open, it removes it once it stops and
+		// keeps its slot until then
+		item.cancelled = true
+		item.cancel()
+		q.draining[item.File.Hash] = item
+	} else {
+		q.pc.removePartialDownload(item.File)
+	}
+	q.saveLocked()
+	q.dispatchLocked()
+	return nil
+}
+
+// Move swaps a download with its neighbour in the queue, up for a negative offset and
+// down for a positive one. Passing a download of another priority takes that priority.
+func (q *DownloadQueue) Move(fileHash string, offset int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pos := q.findLocked(fileHash)
+	if pos < 0 {
+		return errNotQueued
+	}
+	other := pos + 1
+	if offset < 0 {
+		other = pos - 1
+	}
+	if other < 0 || other >= len(q.items) {
+		return nil
+	}
+	q.items[pos].Priority = q.items[other].Priority
+	q.items[pos], q.items[other] = q.items[other], q.items[pos]
+	q.saveLocked()
+	q.dispatchLocked()
+	return nil
+}
+
+// SetPriority changes the priority of a download, moving it behind the downloads of
+// the same priority
+func (q *DownloadQueue) SetPriority(fileHash string, priority int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pos := q.findLocked(fileHash)
+	if pos < 0 {
+		return errNotQueued
+	}
+	item := q.removeLocked(pos)
+	item.Priority = priority
+	q.insertLocked(item)
+	q.saveLocked()
+	q.dispatchLocked()
+	return nil
+}
+
+// Contains reports whether a file is in the download queue
+func (q *DownloadQueue) Contains(fileHash string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.findLocked(fileHash) >= 0
+}
+
+// Items returns a copy of the queue in order
+func (q *DownloadQueue) Items() []QueuedDownload {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items := make([]QueuedDownload, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, QueuedDownload{
+			File:     item.File,
+			Priority: item.Priority,
+			State:    item.State,
+			Error:    item.Error,
+			Added:    item.Added,
+		})
+	}
+	return items
+}
+
+// priorityName names the priorities offered by the web UI
+func priorityName(priority int) string {
+	switch {
+	case priority >= priorityHigh:
+		return "High"
+	case priority <= priorityLow:
+		return "Low"
+	default:
+		return "Normal"
+	}
+}
+
+// removePartialDownload deletes the partial file and state of a download
+func (pc *PeerClient) removePartialDownload(file File) {
+	destPath := filepath.Join(pc.DownloadDir, filepath.Base(file.Name))
+	for _, path := range []string{destPath + partialSuffix, destPath + stateSuffix} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove %s: %v", path, err)
+		}
+	}
+}
+
+// queueAction returns a web UI handler applying action to the queued file named by the
+// posted hash and redirecting back to the main page. Only POST is accepted, so another
+// page cannot change the queue by linking to it.
+func (pc *PeerClient) queueAction(action func(fileHash string, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := action(r.PostFormValue("hash"), r); err != nil {
+			pc.setStatus(fmt.Sprintf("Download queue: %v", err))
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// registerQueueHandlers registers the web UI actions on the download queue
+func (pc *PeerClient) registerQueueHandlers() {
+	http.HandleFunc("/queue/pause", pc.queueAction(func(fileHash string, r *http.Request) error {
+		return pc.queue.Pause(fileHash)
+	}))
+	http.HandleFunc("/queue/resume", pc.queueAction(func(fileHash string, r *http.Request) error {
+		return pc.queue.Resume(fileHash)
+	}))
+	http.HandleFunc("/queue/cancel", pc.queueAction(func(fileHash string, r *http.Request) error {
+		return pc.queue.Cancel(fileHash)
+	}))
+	http.HandleFunc("/queue/up", pc.queueAction(func(fileHash string, r *http.Request) error {
+		return pc.queue.Move(fileHash, -1)
+	}))
+	http.HandleFunc("/queue/down", pc.queueAction(func(fileHash string, r *http.Request) error {
+		return pc.queue.Move(fileHash, 1)
+	}))
+	http.HandleFunc("/queue/priority", pc.queueAction(func(fileHash string, r *http.Request) error {
+		priority, err := strconv.Atoi(r.PostFormValue("priority"))
+		if err != nil {
+			return fmt.Errorf("invalid priority %q", r.PostFormValue("priority"))
+		}
+		return pc.queue.SetPriority(fileHash, priority)
+	}))
+
+	// API endpoint for the download queue
+	http.HandleFunc("/api/queue", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pc.queue.Items())
+	})
+}
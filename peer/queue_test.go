@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransfers stands in for DownloadFile. Every transfer runs until the test finishes
+// it, so a cancelled transfer keeps running until then like one still shutting down.
+type fakeTransfers struct {
+	mutex   sync.Mutex
+	started []string
+	done    map[string]chan error
+}
+
+func (f *fakeTransfers) download(ctx context.Context, file File, peers []*Peer) error {
+	done := make(chan error, 1)
+	f.mutex.Lock()
+	f.started = append(f.started, file.Name)
+	f.done[file.Hash] = done
+	f.mutex.Unlock()
+
+	err := <-done
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// finish ends the transfer of a file with err
+func (f *fakeTransfers) finish(t *testing.T, fileHash string, err error) {
+	t.Helper()
+	waitUntil(t, "transfer of "+fileHash, func() bool {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		return f.done[fileHash] != nil
+	})
+	f.mutex.Lock()
+	done := f.done[fileHash]
+	delete(f.done, fileHash)
+	f.mutex.Unlock()
+	done <- err
+}
+
+func (f *fakeTransfers) startedNames() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.started...)
+}
+
+// newTestQueue returns a queue transferring through fake with the given slots
+func newTestQueue(t *testing.T, maxDownloads int) (*DownloadQueue, *fakeTransfers) {
+	pc := &PeerClient{MaxDownloads: maxDownloads, DownloadDir: t.TempDir()}
+	fake := &fakeTransfers{done: make(map[string]chan error)}
+	q := NewDownloadQueue(pc)
+	q.download = fake.download
+	return q, fake
+}
+
+// waitUntil polls cond until it holds or a timeout expires
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// queueState returns the state of a queued file, or "" when it is not queued
+func queueState(q *DownloadQueue, fileHash string) string {
+	for _, item := range q.Items() {
+		if item.File.Hash == fileHash {
+			return item.State
+		}
+	}
+	return ""
+}
+
+func testFile(name string) File {
+	return File{Name: name, Hash: "hash-" + name, Size: 1}
+}
+
+func TestDownloadQueueOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities map[string]int
+		added      []string
+		want       []string
+	}{
+		{"same priority keeps order", map[string]int{}, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"higher priorities first", map[string]int{"a": priorityLow, "c": priorityHigh}, []string{"a", "b", "c"}, []string{"c", "b", "a"}},
+		{"later high after earlier high", map[string]int{"b": priorityHigh, "d": priorityHigh}, []string{"a", "b", "c", "d"}, []string{"b", "d", "a", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, fake := newTestQueue(t, 0)
+			for _, name := range tt.added {
+				if err := q.Add(testFile(name), nil, tt.priorities[name]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// One slot transfers the files one after another in queue order
+			q.pc.MaxDownloads = 1
+			q.Start()
+			for _, name := range tt.want {
+				fake.finish(t, "hash-"+name, nil)
+			}
+			waitUntil(t, "queue to drain", func() bool { return len(q.Items()) == 0 })
+
+			got := fake.startedNames()
+			for i := range tt.want {
+				if i >= len(got) || got[i] != tt.want[i] {
+					t.Fatalf("started %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadQueuePause(t *testing.T) {
+	q, fake := newTestQueue(t, 1)
+	q.Add(testFile("a"), nil, priorityNormal)
+	q.Add(testFile("b"), nil, priorityNormal)
+	waitUntil(t, "a to start", func() bool { return len(fake.startedNames()) == 1 })
+
+	// Pausing a frees its slot for b once its transfer stops
+	if err := q.Pause("hash-a"); err != nil {
+		t.Fatal(err)
+	}
+	fake.finish(t, "hash-a", nil)
+	waitUntil(t, "b to start", func() bool { return queueState(q, "hash-b") == queueActive })
+	if state := queueState(q, "hash-a"); state != queuePaused {
+		t.Errorf("a is %s, want %s", state, queuePaused)
+	}
+
+	// A resumed download waits for the slot
+	if err := q.Resume("hash-a"); err != nil {
+		t.Fatal(err)
+	}
+	if state := queueState(q, "hash-a"); state != queueWaiting {
+		t.Errorf("a is %s, want %s", state, queueWaiting)
+	}
+	fake.finish(t, "hash-b", nil)
+	waitUntil(t, "a to restart", func() bool { return queueState(q, "hash-a") == queueActive })
+	fake.finish(t, "hash-a", nil)
+	waitUntil(t, "queue to drain", func() bool { return len(q.Items()) == 0 })
+
+	if err := q.Pause("hash-a"); err != errNotQueued {
+		t.Errorf("pausing a finished download: %v, want %v", err, errNotQueued)
+	}
+}
+
+func TestDownloadQueueCancel(t *testing.T) {
+	q, fake := newTestQueue(t, 1)
+	partPath := filepath.Join(q.pc.DownloadDir, "a"+partialSuffix)
+	if err := os.WriteFile(partPath, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Add(testFile("a"), nil, priorityNormal)
+	q.Add(testFile("b"), nil, priorityNormal)
+	waitUntil(t, "a to start", func() bool { return queueState(q, "hash-a") == queueActive })
+
+	if err := q.Cancel("hash-a"); err != nil {
+		t.Fatal(err)
+	}
+	if state := queueState(q, "hash-a"); state != "" {
+		t.Errorf("cancelled download is still queued as %s", state)
+	}
+
+	// The cancelled transfer keeps its slot and its hash until it has stopped
+	time.Sleep(20 * time.Millisecond)
+	if state := queueState(q, "hash-b"); state != queueWaiting {
+		t.Errorf("b is %s while a is stopping, want %s", state, queueWaiting)
+	}
+	if err := q.Add(testFile("a"), nil, priorityNormal); err == nil {
+		t.Error("re-adding a while its transfer is stopping succeeded")
+	}
+
+	fake.finish(t, "hash-a", nil)
+	waitUntil(t, "b to start", func() bool { return queueState(q, "hash-b") == queueActive })
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Errorf("partial file of the cancelled download was kept: %v", err)
+	}
+	if err := q.Add(testFile("a"), nil, priorityNormal); err != nil {
+		t.Errorf("re-adding a after its transfer stopped: %v", err)
+	}
+
+	// Cancelling a waiting download removes it right away
+	if err := q.Cancel("hash-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Cancel("hash-a"); err != errNotQueued {
+		t.Errorf("cancelling twice: %v, want %v", err, errNotQueued)
+	}
+	fake.finish(t, "hash-b", nil)
+}
+
+func TestDownloadQueueRejectsSameName(t *testing.T) {
+	q, _ := newTestQueue(t, 0)
+
+	if err := q.Add(File{Name: "report.pdf", Hash: "aa"}, nil, priorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		file    File
+		wantErr bool
+	}{
+		{"same content", File{Name: "report.pdf", Hash: "aa"}, true},
+		{"other content under the same name", File{Name: "report.pdf", Hash: "bb"}, true},
+		{"other content in another directory", File{Name: "old/report.pdf", Hash: "cc"}, true},
+		{"other name", File{Name: "report-2.pdf", Hash: "dd"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := q.Add(tt.file, nil, priorityNormal); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueueActionRequiresPost(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		wantStatus int
+		wantState  string
+	}{
+		{"GET ignored", http.MethodGet, http.StatusMethodNotAllowed, "queued"},
+		{"POST applied", http.MethodPost, http.StatusSeeOther, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _ := newTestQueue(t, 0)
+			q.pc.queue = q
+			if err := q.Add(testFile("a"), nil, priorityNormal); err != nil {
+				t.Fatal(err)
+			}
+			handler := q.pc.queueAction(func(fileHash string, r *http.Request) error {
+				return q.Cancel(fileHash)
+			})
+
+			var r *http.Request
+			if tt.method == http.MethodPost {
+				r = httptest.NewRequest(tt.method, "/queue/cancel", strings.NewReader("hash=hash-a"))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				r = httptest.NewRequest(tt.method, "/queue/cancel?hash=hash-a", nil)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if state := queueState(q, "hash-a"); state != tt.wantState {
+				t.Errorf("state = %q, want %q", state, tt.wantState)
+			}
+		})
+	}
+}
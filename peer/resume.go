@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+const (
+	// partialSuffix is appended to the destination path while a download is in progress
+	partialSuffix = ".part"
+
+	// stateSuffix names the sidecar file recording which pieces of a partial download are complete
+	stateSuffix = ".part.json"
+)
+
+// downloadState is the on-disk record of a partial download, used to resume it later
+type downloadState struct {
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	Size      int64  `json:"size"`
+	PieceSize int64  `json:"pieceSize"`
+	Pieces    []bool `json:"pieces"` // Pieces written and synced to the partial file
+	path      string
+}
+
+// loadDownloadState reads the sidecar state for a partial download, starting afresh
+// if there is none or it describes different content
+func loadDownloadState(path string, file File) *downloadState {
+	fresh := &downloadState{
+		Name:      file.Name,
+		Hash:      file.Hash,
+		Size:      file.Size,
+		PieceSize: pieceSize,
+		Pieces:    make([]bool, numPieces(file.Size)),
+		path:      path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fresh
+	}
+
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fresh
+	}
+	if state.Hash != file.Hash || state.Size != file.Size || state.PieceSize != pieceSize || len(state.Pieces) != len(fresh.Pieces) {
+		return fresh
+	}
+
+	state.path = path
+	return &state
+}
+
+// save atomically writes the state to its sidecar file
+func (ds *downloadState) save() error {
+	data, err := json.Marshal(ds)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := ds.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, ds.path)
+}
+
+// remove deletes the sidecar file once the download has finished
+func (ds *downloadState) remove() {
+	os.Remove(ds.path)
+}
+
+// pending returns the indices of the pieces that still have to be fetched
+func (ds *downloadState) pending() []int {
+	pieces := []int{}
+	for i, done := range ds.Pieces {
+		if !done {
+			pieces = append(pieces, i)
+		}
+	}
+	return pieces
+}
+
+// completedBytes returns the number of bytes already written to the partial file
+func (ds *downloadState) completedBytes() int64 {
+	var total int64
+	for i, done := range ds.Pieces {
+		if done {
+			_, length := pieceBounds(i, ds.Size)
+			total += length
+		}
+	}
+	return total
+}
+
+// verifiedOffset returns the length of the contiguous completed prefix of the file
+func (ds *downloadState) verifiedOffset() int64 {
+	var offset int64
+	for i, done := range ds.Pieces {
+		if !done {
+			break
+		}
+		_, length := pieceBounds(i, ds.Size)
+		offset += length
+	}
+	return offset
+}
+
+// isPartialDownload reports whether a path belongs to an unfinished download
+func isPartialDownload(path string) bool {
+	return strings.HasSuffix(path, partialSuffix) || strings.HasSuffix(path, stateSuffix) || strings.HasSuffix(path, stateSuffix+".tmp")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"p2p-file-sharing/internal/identity"
+)
+
+func TestFileServerIfRange(t *testing.T) {
+	sharedDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sharedDir, "a.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		files      []File // Shared files the server knows the hash of
+		ifRange    string
+		wantStatus int
+		wantBody   string
+	}{
+		{"same content", []File{{Name: "a.txt", Hash: "abc"}}, strconv.Quote("abc"), http.StatusPartialContent, "2345"},
+		{"changed content", []File{{Name: "a.txt", Hash: "def"}}, strconv.Quote("abc"), http.StatusOK, "0123456789"},
+		{"not hashed yet", nil, strconv.Quote("abc"), http.StatusPartialContent, "2345"},
+		{"without If-Range", nil, "", http.StatusPartialContent, "2345"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := &PeerClient{ID: "owner", SharedDir: sharedDir, Files: tt.files, signatures: identity.NewVerifier()}
+			req := httptest.NewRequest(http.MethodGet, "http://owner:8081/file?name=a.txt", nil)
+			req.Header.Set("Range", "bytes=2-5")
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+			rec := httptest.NewRecorder()
+			pc.handleFile(rec, req)
+
+			if rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ScanProgress is how far the running or last scan of the shared directory got
+type ScanProgress struct {
+	Running    bool   `json:"running"`
+	FilesDone  int64  `json:"filesDone"`
+	FilesTotal int64  `json:"filesTotal"`
+	BytesDone  int64  `json:"bytesDone"`
+	BytesTotal int64  `json:"bytesTotal"`
+	Cancelled  bool   `json:"cancelled,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Percent returns how much of the shared bytes the scan has hashed
+func (p ScanProgress) Percent() int {
+	if p.BytesTotal == 0 {
+		if p.Running {
+			return 0
+		}
+		return 100
+	}
+	return int(p.BytesDone * 100 / p.BytesTotal)
+}
+
+// scanJob scans the shared directory in the background. Files are hashed by a pool of
+// workers and the new file list replaces the shared files only once every file is done.
+type scanJob struct {
+	pc         *PeerClient
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{} // Closed once the job finished, was cancelled or failed
+	err        error         // Why the job did not finish, set before done is closed
+	filesTotal atomic.Int64
+	filesDone  atomic.Int64
+	bytesTotal atomic.Int64
+	bytesDone  atomic.Int64
+}
+
+// scanEntry is a shared file found by the walk, and its hashes once a worker is done
+type scanEntry struct {
+	path    string
+	relPath string
+	info    os.FileInfo
+	hash    string
+	leaves  [][]byte
+	ok      bool // Whether the file could be hashed
+}
+
+// StartScan scans the shared directory in the background, cancelling a scan that is
+// still running
+func (pc *PeerClient) StartScan() *scanJob {
+	pc.scanMutex.Lock()
+	defer pc.scanMutex.Unlock()
+
+	previous := pc.scan
+	if previous != nil {
+		previous.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &scanJob{pc: pc, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	pc.scan = job
+	go job.run(previous)
+	return job
+}
+
+// CancelScan stops the running scan, keeping the shared files as they were. It reports
+// whether a scan was running.
+func (pc *PeerClient) CancelScan() bool {
+	pc.scanMutex.Lock()
+	job := pc.scan
+	pc.scanMutex.Unlock()
+
+	if job == nil || job.finished() {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+// ScanProgress returns the progress of the running or last scan
+func (pc *PeerClient) ScanProgress() ScanProgress {
+	pc.scanMutex.Lock()
+	job := pc.scan
+	pc.scanMutex.Unlock()
+
+	if job == nil {
+		return ScanProgress{}
+	}
+	return job.progress()
+}
+
+// ScanSharedDirectory scans the shared directory for files and waits for the scan to finish
+func (pc *PeerClient) ScanSharedDirectory() {
+	pc.StartScan().Wait()
+}
+
+// Wait blocks until the job is over and returns why it did not finish, if it did not
+func (j *scanJob) Wait() error {
+	<-j.done
+	return j.err
+}
+
+// finished reports whether the job is over
+func (j *scanJob) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// progress returns the counters of the job
+func (j *scanJob) progress() ScanProgress {
+	p := ScanProgress{
+		Running:    !j.finished(),
+		FilesDone:  j.filesDone.Load(),
+		FilesTotal: j.filesTotal.Load(),
+		BytesDone:  j.bytesDone.Load(),
+		BytesTotal: j.bytesTotal.Load(),
+	}
+	if !p.Running && j.err != nil {
+		p.Cancelled = errors.Is(j.err, context.Canceled)
+		if !p.Cancelled {
+			p.Error = j.err.Error()
+		}
+	}
+	return p
+}
+
+// run scans once the scan it replaced is over, so an older file list is never
+// published after a newer one
+func (j *scanJob) run(previous *scanJob) {
+	defer close(j.done)
+	if previous != nil {
+		<-previous.done
+	}
+
+	j.err = j.scan()
+	if errors.Is(j.err, context.Canceled) {
+		log.Printf("Scan of the shared directory cancelled after %d of %d files", j.filesDone.Load(), j.filesTotal.Load())
+	} else if j.err != nil {
+		log.Printf("Error scanning shared directory: %v", j.err)
+	}
+}
+
+// scan lists the shared files, hashes them with the worker pool and publishes the result
+func (j *scanJob) scan() error {
+	pc := j.pc
+
+	// Pick up changes to the access control list along with the files
+	pc.mutex.RLock()
+	acl := pc.acl
+	pc.mutex.RUnlock()
+	if loaded, err := LoadACL(pc.ACLFile); err != nil {
+		log.Printf("Keeping the previous access control list: %v", err)
+	} else {
+		acl = loaded
+	}
+
+	// Watcher changes from here on may not be reflected by the walk
+	pc.mutex.RLock()
+	generation := pc.filesGeneration
+	pc.mutex.RUnlock()
+
+	entries := []*scanEntry{}
+	walkErr := filepath.Walk(pc.SharedDir, func(path string, info os.FileInfo, err error) error {
+		if err := j.ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(pc.SharedDir, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &scanEntry{path: path, relPath: relPath, info: info})
+		j.filesTotal.Add(1)
+		j.bytesTotal.Add(info.Size())
+		return nil
+	})
+	if err := j.ctx.Err(); err != nil {
+		return err
+	}
+	if walkErr != nil {
+		// Publish what was found, the files that were not reached stay unknown
+		log.Printf("Error scanning shared directory: %v", walkErr)
+	}
+
+	j.hashAll(entries)
+	if err := j.ctx.Err(); err != nil {
+		return err
+	}
+
+	// Entries keep the order of the walk, so the file list stays sorted by name
+	files := []File{}
+	pieceHashes := make(map[string][][]byte)
+	scanned := make(map[string]bool)
+	for _, entry := range entries {
+		scanned[cacheKey(entry.path)] = true
+		if !entry.ok {
+			continue
+		}
+		files = append(files, File{
+			Name:       entry.relPath,
+			Hash:       entry.hash,
+			Size:       entry.info.Size(),
+			MerkleRoot: merkleRoot(entry.leaves),
+			PeerIDs:    []string{pc.ID},
+			ACL:        acl.allowed(entry.relPath, pc.ID),
+		})
+		pieceHashes[entry.hash] = entry.leaves
+	}
+
+	pc.mutex.Lock()
+	files = pc.reapplyRescansLocked(files, pieceHashes, generation, acl)
+	pc.Files = files
+	pc.pieceHashes = pieceHashes
+	pc.acl = acl
+	pc.mutex.Unlock()
+
+	log.Printf("Found %d files in shared directory", len(files))
+
+	// Files that were not found can leave the cache, unless the walk failed midway
+	if walkErr == nil {
+		pc.hashCache.retain(scanned)
+	}
+	if err := pc.hashCache.Save(); err != nil {
+		log.Printf("Failed to save hash cache: %v", err)
+	}
+	pc.rehash.Store(false)
+
+	if pc.dht != nil {
+		pc.dht.filesChanged()
+	}
+	return nil
+}
+
+// reapplyRescansLocked replaces the scanned files under the paths the watcher rescanned
+// after generation with the rescanned ones, which are newer than what the walk found.
+// The caller must hold the write lock.
+func (pc *PeerClient) reapplyRescansLocked(files []File, pieceHashes map[string][][]byte, generation uint64, acl *ACL) []File {
+	newer := []string{}
+	for path, changed := range pc.rescanned {
+		if changed > generation {
+			newer = append(newer, path)
+		}
+	}
+	// Every later rescan is applied on top of the files published now
+	pc.rescanned = nil
+	if len(newer) == 0 {
+		return files
+	}
+
+	underNewer := func(name string) bool {
+		for _, path := range newer {
+			if isUnder(name, path) {
+				return true
+			}
+		}
+		return false
+	}
+	merged := []File{}
+	for _, file := range files {
+		if !underNewer(file.Name) {
+			merged = append(merged, file)
+		}
+	}
+	for _, file := range pc.Files {
+		if underNewer(file.Name) {
+			file.ACL = acl.allowed(file.Name, pc.ID)
+			merged = append(merged, file)
+			pieceHashes[file.Hash] = pc.pieceHashes[file.Hash]
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name < merged[j].Name })
+
+	log.Printf("Kept the watcher's changes to %d paths made during the scan", len(newer))
+	return merged
+}
+
+// hashAll hashes the entries with ScanWorkers workers, stopping early when the job is cancelled
+func (j *scanJob) hashAll(entries []*scanEntry) {
+	workers := j.pc.ScanWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan *scanEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range queue {
+				hash, leaves, err := j.pc.hashFile(j.ctx, entry.path, entry.info, func(n int64) {
+					j.bytesDone.Add(n)
+				})
+				if j.ctx.Err() != nil {
+					continue
+				}
+				j.filesDone.Add(1)
+				if err != nil {
+					log.Printf("Failed to calculate hash for %s: %v", entry.path, err)
+					continue
+				}
+				entry.hash, entry.leaves, entry.ok = hash, leaves, true
+			}
+		}()
+	}
+
+	for _, entry := range entries {
+		select {
+		case queue <- entry:
+		case <-j.ctx.Done():
+		}
+		if j.ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
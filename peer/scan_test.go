@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReapplyRescans(t *testing.T) {
+	scanned := []File{{Name: "a.txt", Hash: "a-old"}, {Name: filepath.Join("dir", "b.txt"), Hash: "b-old"}, {Name: "c.txt", Hash: "c"}}
+
+	tests := []struct {
+		name      string
+		rescanned map[string]uint64
+		want      map[string]string // Hash of each published file by name
+	}{
+		{"no rescans", nil, map[string]string{"a.txt": "a-old", filepath.Join("dir", "b.txt"): "b-old", "c.txt": "c"}},
+		{"rescan before the walk", map[string]uint64{"a.txt": 1}, map[string]string{"a.txt": "a-old", filepath.Join("dir", "b.txt"): "b-old", "c.txt": "c"}},
+		{"modified file", map[string]uint64{"a.txt": 2}, map[string]string{"a.txt": "a-new", filepath.Join("dir", "b.txt"): "b-old", "c.txt": "c"}},
+		{"directory", map[string]uint64{"dir": 2}, map[string]string{"a.txt": "a-old", filepath.Join("dir", "b.txt"): "b-new", "c.txt": "c"}},
+		{"removed file", map[string]uint64{"c.txt": 2}, map[string]string{"a.txt": "a-old", filepath.Join("dir", "b.txt"): "b-old"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The watcher already published its rescans, c.txt is gone
+			pc := &PeerClient{
+				ID:        "peer1",
+				Files:     []File{{Name: "a.txt", Hash: "a-new"}, {Name: filepath.Join("dir", "b.txt"), Hash: "b-new"}},
+				rescanned: tt.rescanned,
+				pieceHashes: map[string][][]byte{
+					"a-new": {[]byte("a")},
+					"b-new": {[]byte("b")},
+				},
+			}
+			pieceHashes := make(map[string][][]byte)
+
+			files := pc.reapplyRescansLocked(append([]File{}, scanned...), pieceHashes, 1, nil)
+			if len(files) != len(tt.want) {
+				t.Fatalf("published %v, want %v", files, tt.want)
+			}
+			for _, file := range files {
+				if tt.want[file.Name] != file.Hash {
+					t.Errorf("%s has hash %q, want %q", file.Name, file.Hash, tt.want[file.Name])
+				}
+				if strings.HasSuffix(file.Hash, "-new") && pieceHashes[file.Hash] == nil {
+					t.Errorf("pieces of rescanned %s were not kept", file.Name)
+				}
+			}
+			if pc.rescanned != nil {
+				t.Error("rescans were not cleared once published")
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// superPeerRetryMin is how long a super peer is avoided after its first failure
+	superPeerRetryMin = time.Second
+
+	// superPeerRetryMax caps the backoff after repeated failures
+	superPeerRetryMax = 2 * time.Minute
+
+	// heartbeatInterval is how often a connected peer sends heartbeats
+	heartbeatInterval = time.Minute
+)
+
+// errNoSuperPeer is returned while every known super peer is backing off
+var errNoSuperPeer = errors.New("no super peer reachable")
+
+// superPeerHealth tracks the failures of one super peer
+type superPeerHealth struct {
+	failures  int       // Consecutive failed requests
+	retryAt   time.Time // Requests are not sent before this time
+	lastError error
+}
+
+// superPeerHealthOf returns the health record of a super peer, the caller must hold the write lock
+func (pc *PeerClient) superPeerHealthOf(superPeerURL string) *superPeerHealth {
+	health, exists := pc.superPeerHealth[superPeerURL]
+	if !exists {
+		health = &superPeerHealth{}
+		pc.superPeerHealth[superPeerURL] = health
+	}
+	return health
+}
+
+// markSuperPeerFailed backs off from a super peer, doubling the delay on every consecutive failure
+func (pc *PeerClient) markSuperPeerFailed(superPeerURL string, err error) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	health := pc.superPeerHealthOf(superPeerURL)
+	health.failures++
+	health.lastError = err
+
+	backoff := superPeerRetryMax
+	if shift := health.failures - 1; shift < 8 {
+		backoff = min(superPeerRetryMin<<shift, superPeerRetryMax)
+	}
+	health.retryAt = time.Now().Add(backoff)
+	log.Printf("Super peer %s failed (%v), retrying in %s", superPeerURL, err, backoff)
+}
+
+// markSuperPeerHealthy resets the backoff of a super peer that answered, directly or by
+// redirecting to answered, and makes answered the current super peer
+func (pc *PeerClient) markSuperPeerHealthy(superPeerURL, answered string) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	*pc.superPeerHealthOf(superPeerURL) = superPeerHealth{}
+	*pc.superPeerHealthOf(answered) = superPeerHealth{}
+	if !pc.online {
+		log.Printf("Connected to super peer %s", answered)
+	} else if answered != pc.SuperPeerURL {
+		log.Printf("Switched to super peer %s", answered)
+	}
+	pc.SuperPeerURL = answered
+	pc.online = true
+}
+
+// superPeerCandidates returns the super peers to try in order, the current one first,
+// skipping those still backing off. It also returns the time the next one becomes available.
+func (pc *PeerClient) superPeerCandidates() ([]string, time.Time) {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+
+	now := time.Now()
+	candidates := []string{}
+	var nextRetry time.Time
+	for _, superPeerURL := range append([]string{pc.SuperPeerURL}, pc.SuperPeerURLs...) {
+		if contains(candidates, superPeerURL) {
+			continue
+		}
+		if health, exists := pc.superPeerHealth[superPeerURL]; exists && health.retryAt.After(now) {
+			if nextRetry.IsZero() || health.retryAt.Before(nextRetry) {
+				nextRetry = health.retryAt
+			}
+			continue
+		}
+		candidates = append(candidates, superPeerURL)
+	}
+	return candidates, nextRetry
+}
+
+// postSuperPeer sends a signed request to the current super peer, failing over to the
+// other known super peers while it is unreachable or its cluster has no leader. Redirects
+// to the cluster leader are followed and the leader is used for later requests.
+func (pc *PeerClient) postSuperPeer(path string, jsonData []byte) (*http.Response, error) {
+	if len(pc.SuperPeerURLs) == 0 {
+		return nil, fmt.Errorf("%w, none configured", errNoSuperPeer)
+	}
+
+	candidates, nextRetry := pc.superPeerCandidates()
+	if len(candidates) == 0 {
+		pc.setOffline()
+		return nil, fmt.Errorf("%w, next retry in %s", errNoSuperPeer, time.Until(nextRetry).Round(time.Second))
+	}
+
+	pc.mutex.RLock()
+	previous := pc.SuperPeerURL
+	wasOnline := pc.online
+	pc.mutex.RUnlock()
+
+	var lastErr error
+	for _, superPeerURL := range candidates {
+		req, err := http.NewRequest(http.MethodPost, superPeerURL+path, bytes.NewReader(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		pc.signRequest(req, jsonData)
+
+		resp, err := pc.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			pc.markSuperPeerFailed(superPeerURL, err)
+			continue
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s unavailable: %s", superPeerURL, bytes.TrimSpace(body))
+			pc.markSuperPeerFailed(superPeerURL, lastErr)
+			continue
+		}
+		if err := pc.checkResponder(resp, "", roleSuperPeer); err != nil {
+			resp.Body.Close()
+			lastErr = err
+			pc.markSuperPeerFailed(superPeerURL, err)
+			continue
+		}
+
+		// Remember whichever super peer answered, following redirects to the leader
+		answered := (&url.URL{Scheme: resp.Request.URL.Scheme, Host: resp.Request.URL.Host}).String()
+		pc.markSuperPeerHealthy(superPeerURL, answered)
+
+		// A super peer we switched to may not know this peer yet
+		if path != "/register" && (answered != previous || !wasOnline) {
+			go func() {
+				if err := pc.Register(); err != nil {
+					log.Printf("Failed to register with super peer %s: %v", answered, err)
+				}
+			}()
+		}
+		return resp, nil
+	}
+
+	pc.setOffline()
+	return nil, lastErr
+}
+
+// setOffline records that no super peer could be reached
+func (pc *PeerClient) setOffline() {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if pc.online {
+		log.Printf("Lost connection to every super peer, running offline")
+	}
+	pc.online = false
+}
+
+// nextSuperPeerContact returns how long to wait before the next heartbeat, or before
+// the next registration attempt while offline
+func (pc *PeerClient) nextSuperPeerContact() time.Duration {
+	if pc.isOnline() {
+		return heartbeatInterval
+	}
+
+	candidates, nextRetry := pc.superPeerCandidates()
+	if len(candidates) > 0 {
+		return superPeerRetryMin
+	}
+	return max(time.Until(nextRetry), superPeerRetryMin)
+}
+
+// isOnline reports whether the last request reached a super peer
+func (pc *PeerClient) isOnline() bool {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+
+	return pc.online
+}
+
+// superPeerStatus describes the super peer connection for the web UI
+func (pc *PeerClient) superPeerStatus() string {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+
+	if len(pc.SuperPeerURLs) == 0 {
+		return "No super peer configured, searching peers on the local network directly"
+	}
+	if !pc.online {
+		return "Offline: no super peer reachable, retrying in the background"
+	}
+	return "Connected to super peer " + pc.SuperPeerURL
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// pieceSize is the size of the pieces a file is split into for swarm downloads
+	pieceSize = 1 << 20
+
+	// maxPeerFailures is how many pieces a peer may fail before it is dropped
+	maxPeerFailures = 3
+
+	// pieceTimeout bounds the time a peer may take to deliver a single piece
+	pieceTimeout = 30 * time.Second
+)
+
+// errCorruptPiece is returned when a piece fails Merkle verification
+var errCorruptPiece = errors.New("piece failed Merkle verification")
+
+// swarmDownload fetches the pieces of a single file from several peers in parallel
+type swarmDownload struct {
+	pc         *PeerClient
+	ctx        context.Context // Cancelled when the download is paused or cancelled
+	file       File
+	dest       *os.File
+	state      *downloadState
+	numPieces  int
+	pieces     chan int      // Pieces waiting to be fetched
+	completed  chan struct{} // Closed once every piece has been written
+	mutex      sync.Mutex
+	piecesDone int
+	bytesDone  int64
+	sources    map[string]bool // Peers that supplied at least one piece
+}
+
+// peerURL builds the URL of an endpoint on another peer's file server
+func (pc *PeerClient) peerURL(peer *Peer, path string) string {
+	return fmt.Sprintf("%s://%s:%d%s", pc.scheme(), peer.Address, peer.Port, path)
+}
+
+// peersWithHash returns the peers from a search response that hold the given file hash
+func (pc *PeerClient) peersWithHash(fileHash string, peers map[string]*Peer) []*Peer {
+	sources := []*Peer{}
+	for _, peer := range peers {
+		if peer.ID == pc.ID || pc.isBlamed(peer.ID) {
+			continue
+		}
+		for _, file := range peer.Files {
+			if file.Hash == fileHash {
+				sources = append(sources, peer)
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// downloadSources returns the peers a download can fetch pieces from: each peer once,
+// without this peer, peers blamed for corrupt content or peers without an address
+func (pc *PeerClient) downloadSources(peers []*Peer) []*Peer {
+	sources := []*Peer{}
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		if peer == nil || seen[peer.ID] || peer.ID == pc.ID || pc.isBlamed(peer.ID) {
+			continue
+		}
+		if peer.Address == "" || peer.Port == 0 {
+			continue
+		}
+		seen[peer.ID] = true
+		sources = append(sources, peer)
+	}
+	return sources
+}
+
+// numPieces returns the number of pieces a file of the given size is split into
+func numPieces(size int64) int {
+	return int((size + pieceSize - 1) / pieceSize)
+}
+
+// pieceBounds returns the byte offset and length of a piece
+func pieceBounds(index int, size int64) (int64, int64) {
+	offset := int64(index) * pieceSize
+	length := int64(pieceSize)
+	if offset+length > size {
+		length = size - offset
+	}
+	return offset, length
+}
+
+// downloadPieces downloads the pieces of a file that state marks as missing into dest,
+// spreading them over all given peers. It returns the IDs of the peers that supplied pieces.
+// Once ctx is done it stops, the pieces written so far stay recorded in state.
+func (pc *PeerClient) downloadPieces(ctx context.Context, file File, peers []*Peer, dest *os.File, state *downloadState) ([]string, error) {
+	if err := dest.Truncate(file.Size); err != nil {
+		return nil, err
+	}
+
+	pending := state.pending()
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers available for %s", file.Name)
+	}
+
+	sd := &swarmDownload{
+		pc:         pc,
+		ctx:        ctx,
+		file:       file,
+		dest:       dest,
+		state:      state,
+		numPieces:  len(state.Pieces),
+		piecesDone: len(state.Pieces) - len(pending),
+		bytesDone:  state.completedBytes(),
+		completed:  make(chan struct{}),
+		sources:    make(map[string]bool),
+	}
+	sd.pieces = make(chan int, len(pending))
+	for _, index := range pending {
+		sd.pieces <- index
+	}
+	pc.setDownloadProgress(file.Hash, sd.bytesDone, file.Size)
+
+	// Start one worker per source peer
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer *Peer) {
+			defer wg.Done()
+			sd.worker(peer)
+		}(peer)
+	}
+
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-sd.completed:
+		<-workersDone
+		return sd.sourceIDs(), nil
+	case <-workersDone:
+		// Every worker gave up, check whether the last piece made it anyway
+		select {
+		case <-sd.completed:
+			return sd.sourceIDs(), nil
+		default:
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("all peers failed, %d of %d pieces downloaded", sd.piecesDone, sd.numPieces)
+	}
+}
+
+// sourceIDs returns the IDs of the peers that supplied pieces
+func (sd *swarmDownload) sourceIDs() []string {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	ids := make([]string, 0, len(sd.sources))
+	for id := range sd.sources {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// worker fetches pieces from a single peer until the download completes or the peer fails too often
+func (sd *swarmDownload) worker(peer *Peer) {
+	failures := 0
+	for {
+		var index int
+		select {
+		case <-sd.completed:
+			return
+		case <-sd.ctx.Done():
+			return
+		case index = <-sd.pieces:
+		}
+
+		err := sd.fetchPiece(peer, index)
+		if err != nil {
+			// Put the piece back for another peer to pick up
+			sd.pieces <- index
+			if sd.ctx.Err() != nil {
+				return
+			}
+			failures++
+			log.Printf("Piece %d of %s from peer %s failed: %v", index, sd.file.Name, peer.ID, err)
+
+			// A peer serving corrupt data is dropped right away
+			if errors.Is(err, errCorruptPiece) {
+				sd.pc.blamePeers([]string{peer.ID})
+				log.Printf("Dropping peer %s from download of %s", peer.ID, sd.file.Name)
+				return
+			}
+			if failures >= maxPeerFailures {
+				log.Printf("Dropping peer %s from download of %s", peer.ID, sd.file.Name)
+				return
+			}
+			continue
+		}
+
+		sd.pieceDone(index, peer.ID)
+	}
+}
+
+// fetchPiece downloads a single piece from a peer and writes it to the destination file
+func (sd *swarmDownload) fetchPiece(peer *Peer, index int) error {
+	offset, length := pieceBounds(index, sd.file.Size)
+
+	ctx, cancel := context.WithTimeout(sd.ctx, pieceTimeout)
+	defer cancel()
+
+	fileURL := sd.pc.peerURL(peer, "/file?name="+url.QueryEscape(sd.file.Name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	req.Header.Set("If-Range", strconv.Quote(sd.file.Hash))
+	sd.pc.signRequest(req, nil)
+
+	resp, err := sd.pc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := sd.pc.checkResponder(resp, peer.ID, rolePeer); err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset == 0 && length == sd.file.Size:
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	// The peer tags the content with its hash, a mismatch means its copy has changed
+	if etag := resp.Header.Get("ETag"); etag != "" && etag != strconv.Quote(sd.file.Hash) {
+		return fmt.Errorf("peer content changed (ETag %s)", etag)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return err
+	}
+
+	// Check the piece against the Merkle root published with the file
+	if sd.file.MerkleRoot != "" {
+		proof, err := sd.pc.fetchProof(ctx, peer, sd.file.Hash, index)
+		if err != nil {
+			return err
+		}
+		if !proof.verify(buf, index, sd.numPieces, sd.file.MerkleRoot) {
+			return errCorruptPiece
+		}
+	}
+
+	if _, err := sd.dest.WriteAt(buf, offset); err != nil {
+		return err
+	}
+
+	// Make sure the piece is on disk before the state file claims it is
+	return sd.dest.Sync()
+}
+
+// pieceDone records a finished piece and updates the download progress
+func (sd *swarmDownload) pieceDone(index int, peerID string) {
+	_, length := pieceBounds(index, sd.file.Size)
+
+	sd.mutex.Lock()
+	sd.state.Pieces[index] = true
+	if err := sd.state.save(); err != nil {
+		log.Printf("Failed to save download state for %s: %v", sd.file.Name, err)
+	}
+	sd.sources[peerID] = true
+	sd.piecesDone++
+	sd.bytesDone += length
+	bytesDone := sd.bytesDone
+	if sd.piecesDone == sd.numPieces {
+		close(sd.completed)
+	}
+	sd.mutex.Unlock()
+
+	sd.pc.setDownloadProgress(sd.file.Hash, bytesDone, sd.file.Size)
+}
+
+// setDownloadProgress updates the progress of an active download
+func (pc *PeerClient) setDownloadProgress(fileHash string, done, total int64) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	download, exists := pc.ActiveDownloads[fileHash]
+	if !exists {
+		return
+	}
+	download.Total = total
+	if total > 0 {
+		download.Progress = int(float64(done) / float64(total) * 100)
+	}
+	pc.ActiveDownloads[fileHash] = download
+}
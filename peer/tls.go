@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"p2p-file-sharing/internal/identity"
+)
+
+// Certificate roles, as issued by the super peer's ca command
+const (
+	rolePeer      = "peer"
+	roleSuperPeer = "super-peer"
+)
+
+// EnableTLS serves the file server over mutual TLS with a certificate issued by the
+// cluster CA for the peer's ID, and presents it to super peers and other peers
+func (pc *PeerClient) EnableTLS(certFile, keyFile, caFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+	if role := identity.CertRole(cert.Leaf); role != rolePeer {
+		return fmt.Errorf("%s has role %q, not %q", certFile, role, rolePeer)
+	}
+	if name := cert.Leaf.Subject.CommonName; name != pc.ID {
+		return fmt.Errorf("%s is issued to %q, not to this peer's ID %s", certFile, name, pc.ID)
+	}
+
+	pc.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// Peers are reached on whatever address they registered from, so the chain is
+	// checked against the CA but not against the host name
+	pc.transport.TLSClientConfig = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return identity.VerifyChain(cs.PeerCertificates, pool, x509.ExtKeyUsageServerAuth)
+		},
+	}
+	return nil
+}
+
+// connectionIdentity returns the name and role in the certificate the other side of a
+// connection presented, both empty without TLS
+func connectionIdentity(cs *tls.ConnectionState) (string, string) {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return "", ""
+	}
+	return cs.PeerCertificates[0].Subject.CommonName, identity.CertRole(cs.PeerCertificates[0])
+}
+
+// checkSender makes sure a request to the file server claiming to come from peerID
+// carries that peer's certificate. It writes an error and returns false otherwise.
+func (pc *PeerClient) checkSender(w http.ResponseWriter, r *http.Request, peerID string) bool {
+	if pc.tlsConfig == nil {
+		return true
+	}
+	if name, role := connectionIdentity(r.TLS); role != rolePeer || name != peerID {
+		http.Error(w, fmt.Sprintf("certificate %q may not act for peer %q", name, peerID), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkResponder makes sure a response came from the peer or super peer expected
+func (pc *PeerClient) checkResponder(resp *http.Response, name, role string) error {
+	if pc.tlsConfig == nil {
+		return nil
+	}
+	gotName, gotRole := connectionIdentity(resp.TLS)
+	if gotRole != role || (name != "" && gotName != name) {
+		return fmt.Errorf("expected %s %q, connected to %s %q", role, name, gotRole, gotName)
+	}
+	return nil
+}
+
+// scheme returns the URL scheme of the file server and web UI
+func (pc *PeerClient) scheme() string {
+	if pc.tlsConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// listenAndServe serves handler on addr, over TLS when it is enabled. Only the file
+// server requires a client certificate, the web UI is for the local user.
+func (pc *PeerClient) listenAndServe(addr string, handler http.Handler, requireClientCert bool) error {
+	if pc.tlsConfig == nil {
+		return http.ListenAndServe(addr, handler)
+	}
+	config := pc.tlsConfig.Clone()
+	if !requireClientCert {
+		config.ClientAuth = tls.NoClientCert
+	}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: config}
+	return server.ListenAndServeTLS("", "")
+}
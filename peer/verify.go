@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// quarantineDirName is the directory under DownloadDir holding downloads that failed verification
+	quarantineDirName = ".quarantine"
+
+	// blameThreshold is the number of corrupt downloads a peer may contribute to before it is avoided
+	blameThreshold = 2
+)
+
+// verifyDownload checks a finished partial download against the advertised SHA-256 hash.
+// On a mismatch the file is quarantined and the peers that supplied it are blamed.
+func (pc *PeerClient) verifyDownload(file File, partPath string, sources []string) error {
+	hash, err := pc.calculateFileHash(partPath)
+	if err != nil {
+		return err
+	}
+	if hash == file.Hash {
+		return nil
+	}
+
+	quarantinePath, err := pc.quarantine(partPath, file)
+	if err != nil {
+		log.Printf("Failed to quarantine %s: %v", partPath, err)
+		os.Remove(partPath)
+	} else {
+		log.Printf("Quarantined corrupt download of %s at %s", file.Name, quarantinePath)
+	}
+
+	pc.blamePeers(sources)
+
+	return fmt.Errorf("hash mismatch for %s: expected %s, got %s", file.Name, file.Hash, hash)
+}
+
+// quarantine moves a corrupt download out of the way so it is neither shared nor listed
+func (pc *PeerClient) quarantine(path string, file File) (string, error) {
+	dir := filepath.Join(pc.DownloadDir, quarantineDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s.%s.%d", filepath.Base(file.Name), file.Hash[:min(12, len(file.Hash))], time.Now().Unix())
+	dest := filepath.Join(dir, name)
+	return dest, os.Rename(path, dest)
+}
+
+// blamePeers records that the given peers supplied content that failed verification
+func (pc *PeerClient) blamePeers(peerIDs []string) {
+	if !pc.BlameBadPeers {
+		return
+	}
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	for _, peerID := range peerIDs {
+		pc.blame[peerID]++
+		log.Printf("Blamed peer %s for corrupt content (%d strikes)", peerID, pc.blame[peerID])
+	}
+}
+
+// isBlamed reports whether a peer has supplied corrupt content too often to be used again
+func (pc *PeerClient) isBlamed(peerID string) bool {
+	pc.mutex.RLock()
+	defer pc.mutex.RUnlock()
+
+	return pc.BlameBadPeers && pc.blame[peerID] >= blameThreshold
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// watchDebounce is how long the shared directory must stay quiet before a burst of
+	// changes is re-hashed and sent to the super peer
+	watchDebounce = 2 * time.Second
+
+	// watchMaxDelay is how long changes wait at most while the shared directory keeps
+	// changing, such as a file being written for a long time
+	watchMaxDelay = 30 * time.Second
+
+	// watchPollInterval is how often the shared directory is checked for changes where
+	// inotify is not available
+	watchPollInterval = 10 * time.Second
+)
+
+// Watcher notices changes to the shared directory and updates the shared files and the
+// super peer's index without a manual scan
+type Watcher struct {
+	pc      *PeerClient
+	changes chan string // Changed paths relative to the shared directory
+}
+
+// EnableWatch makes the peer watch its shared directory once it starts
+func (pc *PeerClient) EnableWatch() {
+	pc.watcher = &Watcher{pc: pc, changes: make(chan string, 1024)}
+}
+
+// Start watches the shared directory with inotify where available, or by polling
+func (w *Watcher) Start() {
+	if err := w.watchInotify(); err != nil {
+		log.Printf("Polling the shared directory every %s: %v", watchPollInterval, err)
+		go w.poll()
+	}
+	go w.run()
+}
+
+// run collects changed paths until the directory is quiet for watchDebounce, or at most
+// watchMaxDelay after the first of them, then re-hashes them
+func (w *Watcher) run() {
+	pending := make(map[string]bool)
+	var since time.Time // When the first pending path changed
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	for {
+		select {
+		case path := <-w.changes:
+			if len(pending) == 0 {
+				since = time.Now()
+			}
+			pending[path] = true
+			timer.Reset(min(watchDebounce, max(watchMaxDelay-time.Since(since), 0)))
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			pending = make(map[string]bool)
+			w.pc.rescanPaths(paths)
+		}
+	}
+}
+
+// fileStat is what polling compares to notice a changed file
+type fileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+// statSharedFiles returns the size and modification time of every shared file
+func (w *Watcher) statSharedFiles() map[string]fileStat {
+	stats := make(map[string]fileStat)
+	filepath.Walk(w.pc.SharedDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if relPath, err := filepath.Rel(w.pc.SharedDir, path); err == nil {
+			stats[relPath] = fileStat{size: info.Size(), modTime: info.ModTime()}
+		}
+		return nil
+	})
+	return stats
+}
+
+// poll reports the files added, removed or modified since the last check
+func (w *Watcher) poll() {
+	previous := w.statSharedFiles()
+	for {
+		time.Sleep(watchPollInterval)
+		current := w.statSharedFiles()
+		for path, stat := range current {
+			if old, existed := previous[path]; !existed || old != stat {
+				w.changes <- path
+			}
+		}
+		for path := range previous {
+			if _, exists := current[path]; !exists {
+				w.changes <- path
+			}
+		}
+		previous = current
+	}
+}
+
+// isUnder reports whether a shared file's name is path or lies in the directory at path
+func isUnder(name, path string) bool {
+	return path == "." || name == path || strings.HasPrefix(name, path+string(filepath.Separator))
+}
+
+// rescanPaths re-hashes the shared files at or under the given paths, relative to the
+// shared directory, and drops the ones that no longer exist. Other files keep their
+// hashes. The changes are then sent to the super peer.
+func (pc *PeerClient) rescanPaths(paths []string) {
+	type hashedFile struct {
+		file   File
+		leaves [][]byte
+	}
+
+	// Hash without holding the lock, files keep being served meanwhile
+	found := []hashedFile{}
+	for _, changed := range paths {
+		filepath.Walk(filepath.Join(pc.SharedDir, changed), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			relPath, err := filepath.Rel(pc.SharedDir, path)
+			if err != nil {
+				return nil
+			}
+			hash, leaves, err := pc.hashFile(context.Background(), path, info, nil)
+			if err != nil {
+				log.Printf("Failed to calculate hash for %s: %v", path, err)
+				return nil
+			}
+			found = append(found, hashedFile{
+				file: File{
+					Name:       relPath,
+					Hash:       hash,
+					Size:       info.Size(),
+					MerkleRoot: merkleRoot(leaves),
+					PeerIDs:    []string{pc.ID},
+				},
+				leaves: leaves,
+			})
+			return nil
+		})
+	}
+
+	pc.mutex.Lock()
+	files := []File{}
+	for _, file := range pc.Files {
+		changed := false
+		for _, path := range paths {
+			if isUnder(file.Name, path) {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			files = append(files, file)
+		}
+	}
+	added := make(map[string]bool)
+	for _, hashed := range found {
+		// Overlapping paths find the same file more than once
+		if added[hashed.file.Name] {
+			continue
+		}
+		added[hashed.file.Name] = true
+		hashed.file.ACL = pc.acl.allowed(hashed.file.Name, pc.ID)
+		files = append(files, hashed.file)
+		pc.pieceHashes[hashed.file.Hash] = hashed.leaves
+	}
+
+	// Forget the pieces of content no longer shared under any name
+	shared := make(map[string]bool)
+	for _, file := range files {
+		shared[file.Hash] = true
+	}
+	for hash := range pc.pieceHashes {
+		if !shared[hash] {
+			delete(pc.pieceHashes, hash)
+		}
+	}
+	pc.Files = files
+
+	// A full scan walking the directory meanwhile found these paths as they were before
+	pc.filesGeneration++
+	if pc.rescanned == nil {
+		pc.rescanned = make(map[string]uint64)
+	}
+	for _, path := range paths {
+		pc.rescanned[path] = pc.filesGeneration
+	}
+	pc.mutex.Unlock()
+
+	log.Printf("Rescanned %d changed files in the shared directory, sharing %d files", len(found), len(files))
+	if err := pc.hashCache.Save(); err != nil {
+		log.Printf("Failed to save hash cache: %v", err)
+	}
+
+	if pc.dht != nil {
+		pc.dht.filesChanged()
+	}
+	if len(pc.SuperPeerURLs) > 0 {
+		if err := pc.UpdateRegistration(); err != nil {
+			log.Printf("Failed to send file changes to super peer: %v", err)
+		}
+	}
+}
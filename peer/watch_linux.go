@@ -0,0 +1,123 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// inotifyMask selects the events that change the shared files. Modifications keep
+// postponing the re-hash until a file is no longer being written.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// inotifyWatch reports changes to every directory of the shared tree
+type inotifyWatch struct {
+	w    *Watcher
+	fd   int
+	dirs map[int32]string // Watched directories relative to the shared directory, by watch descriptor
+}
+
+// watchInotify starts watching the shared tree with inotify
+func (w *Watcher) watchInotify() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	iw := &inotifyWatch{w: w, fd: fd, dirs: make(map[int32]string)}
+	if err := iw.addTree("."); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	log.Printf("Watching %d directories under %s for changes", len(iw.dirs), w.pc.SharedDir)
+	go iw.read()
+	return nil
+}
+
+// addTree watches a directory and every directory under it
+func (iw *inotifyWatch) addTree(dir string) error {
+	root := filepath.Join(iw.w.pc.SharedDir, dir)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Directories may disappear while they are walked
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(iw.fd, path, inotifyMask)
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(iw.w.pc.SharedDir, path)
+		if err != nil {
+			return err
+		}
+		iw.dirs[int32(wd)] = relPath
+		return nil
+	})
+}
+
+// read turns inotify events into changed paths until the descriptor fails, then falls
+// back to polling
+func (iw *inotifyWatch) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(iw.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			log.Printf("Stopped watching the shared directory, polling it instead: %v", err)
+			syscall.Close(iw.fd)
+			go iw.w.poll()
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+nameLen]), "\x00")
+			offset = nameStart + nameLen
+
+			iw.handle(wd, mask, name)
+		}
+	}
+}
+
+// handle reports the path an event is about, watching directories created in or moved
+// into the tree
+func (iw *inotifyWatch) handle(wd int32, mask uint32, name string) {
+	switch {
+	case mask&syscall.IN_Q_OVERFLOW != 0:
+		// Events were lost, everything has to be checked
+		iw.w.changes <- "."
+		return
+	case mask&syscall.IN_IGNORED != 0:
+		// The directory was removed, its parent reports that
+		delete(iw.dirs, wd)
+		return
+	}
+
+	dir, known := iw.dirs[wd]
+	if !known || name == "" {
+		return
+	}
+	path := filepath.Join(dir, name)
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		if err := iw.addTree(path); err != nil {
+			log.Printf("Failed to watch %s: %v", path, err)
+		}
+	}
+	iw.w.changes <- path
+}
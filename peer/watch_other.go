@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// watchInotify is only available on Linux, other systems poll the shared directory
+func (w *Watcher) watchInotify() error {
+	return errors.New("inotify is only available on Linux")
+}
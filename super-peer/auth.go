@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User roles for the admin UI and APIs, each allowed everything the roles before it are.
+// roleAdmin is shared with admin certificates.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+)
+
+const (
+	// pbkdf2Iterations is the PBKDF2-SHA256 work factor for new password hashes
+	pbkdf2Iterations = 600000
+
+	// sessionTTL is how long a login lasts
+	sessionTTL = 12 * time.Hour
+
+	// sessionCookieName is the cookie holding the session ID
+	sessionCookieName = "superpeer_session"
+
+	// defaultUsersFile is where the admin users are kept unless -users says otherwise
+	defaultUsersFile = "./superpeer-users.json"
+
+	// loginFreeAttempts is the number of failed logins for a user or from an address
+	// before further attempts have to wait
+	loginFreeAttempts = 3
+
+	// loginBackoff is the wait after the first failed login past loginFreeAttempts,
+	// doubling with every further failure up to loginMaxBackoff
+	loginBackoff    = time.Second
+	loginMaxBackoff = 15 * time.Minute
+
+	// maxConcurrentLogins bounds the passwords checked at once, each check is slow on purpose
+	maxConcurrentLogins = 4
+)
+
+var (
+	errInvalidLogin = errors.New("invalid user name or password")
+	errLoginBusy    = errors.New("too many logins at once")
+)
+
+// loginThrottledError is returned for logins attempted before the backoff after failed ones is over
+type loginThrottledError struct {
+	retryAfter time.Duration
+}
+
+func (e *loginThrottledError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again in %s", e.retryAfter.Round(time.Second))
+}
+
+// roleRank orders the user roles from least to most privileged
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+// apiToken is a bearer token for scripts, only its hash is stored
+type apiToken struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"` // Hex SHA-256 of the token
+	Created time.Time `json:"created"`
+}
+
+// User is an account for the admin UI and APIs
+type User struct {
+	Name         string     `json:"name"`
+	Role         string     `json:"role"`
+	PasswordHash string     `json:"passwordHash"` // pbkdf2-sha256$iterations$salt$key
+	Tokens       []apiToken `json:"tokens,omitempty"`
+}
+
+// session is a logged in browser
+type session struct {
+	user    string
+	expires time.Time
+}
+
+// UserStore holds the admin users from a JSON file and the sessions of those logged in.
+// The file is read again whenever it changes, so users added from the command line
+// take effect without a restart.
+type UserStore struct {
+	path     string
+	users    map[string]*User
+	modTime  time.Time
+	sessions map[string]*session      // By session ID
+	failures map[string]*loginFailure // Recent failed logins by "user " + name and "addr " + client address
+	checking chan struct{}            // Holds a slot for every password being checked
+	mutex    sync.Mutex
+}
+
+// loginFailure counts the failed logins for a user or from an address
+type loginFailure struct {
+	count int
+	last  time.Time
+	until time.Time // No attempts are checked before then
+}
+
+// OpenUserStore loads the users from path, a missing file holds no users
+func OpenUserStore(path string) (*UserStore, error) {
+	s := &UserStore{
+		path:     path,
+		users:    make(map[string]*User),
+		sessions: make(map[string]*session),
+		failures: make(map[string]*loginFailure),
+		checking: make(chan struct{}, maxConcurrentLogins),
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the users file if it changed since it was last read, the caller must
+// hold the lock unless the store is not shared yet
+func (s *UserStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.users = make(map[string]*User)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("invalid users file %s: %v", s.path, err)
+	}
+	s.users = make(map[string]*User)
+	for _, user := range users {
+		s.users[user.Name] = user
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the users file atomically, readable by the owner only
+func (s *UserStore) save() error {
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// AddUser creates a user or replaces the password and role of an existing one
+func (s *UserStore) AddUser(name, role, password string) error {
+	if name == "" || password == "" {
+		return errors.New("a user name and password are required")
+	}
+	if roleRank[role] == 0 {
+		return fmt.Errorf("unknown role %q, expected viewer, operator or admin", role)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	user, exists := s.users[name]
+	if !exists {
+		user = &User{Name: name}
+		s.users[name] = user
+	}
+	user.Role = role
+	user.PasswordHash = hash
+	return s.save()
+}
+
+// AddToken creates an API token for a user and returns it, it cannot be shown again
+func (s *UserStore) AddToken(userName, tokenName string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return "", err
+	}
+	user, exists := s.users[userName]
+	if !exists {
+		return "", fmt.Errorf("no user %q", userName)
+	}
+
+	token := randomToken()
+	sum := sha256.Sum256([]byte(token))
+	user.Tokens = append(user.Tokens, apiToken{Name: tokenName, Hash: hex.EncodeToString(sum[:]), Created: time.Now()})
+	return token, s.save()
+}
+
+// Login checks a password and starts a session, returning its ID. The password is
+// checked without holding the lock so other requests are not held up meanwhile, and
+// failed logins for the user or from addr make further attempts wait.
+func (s *UserStore) Login(name, password, addr string) (string, error) {
+	keys := []string{"user " + name, "addr " + addr}
+
+	s.mutex.Lock()
+	if err := s.reload(); err != nil {
+		log.Printf("Failed to read users: %v", err)
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if failure := s.failures[key]; failure != nil && now.Before(failure.until) {
+			s.mutex.Unlock()
+			return "", &loginThrottledError{retryAfter: failure.until.Sub(now)}
+		}
+	}
+	user, exists := s.users[name]
+	var passwordHash string
+	if exists {
+		passwordHash = user.PasswordHash
+	}
+	s.mutex.Unlock()
+
+	ok := false
+	if exists {
+		select {
+		case s.checking <- struct{}{}:
+		default:
+			return "", errLoginBusy
+		}
+		ok = checkPassword(passwordHash, password)
+		<-s.checking
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now = time.Now()
+	if !ok {
+		s.recordFailureLocked(keys, now)
+		return "", errInvalidLogin
+	}
+	for _, key := range keys {
+		delete(s.failures, key)
+	}
+
+	// The password may have changed while it was checked
+	if user, exists := s.users[name]; !exists || user.PasswordHash != passwordHash {
+		return "", errInvalidLogin
+	}
+
+	for id, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	id := randomToken()
+	s.sessions[id] = &session{user: name, expires: now.Add(sessionTTL)}
+	return id, nil
+}
+
+// recordFailureLocked counts a failed login against every key and sets how long the
+// next attempt has to wait. Failures older than loginMaxBackoff are forgotten.
+// The caller must hold the lock.
+func (s *UserStore) recordFailureLocked(keys []string, now time.Time) {
+	for key, failure := range s.failures {
+		if now.Sub(failure.last) > loginMaxBackoff && now.After(failure.until) {
+			delete(s.failures, key)
+		}
+	}
+
+	for _, key := range keys {
+		failure := s.failures[key]
+		if failure == nil {
+			failure = &loginFailure{}
+			s.failures[key] = failure
+		}
+		failure.count++
+		failure.last = now
+		if extra := failure.count - loginFreeAttempts; extra > 0 {
+			failure.until = now.Add(min(loginBackoff<<min(extra-1, 20), loginMaxBackoff))
+		}
+	}
+}
+
+// Logout ends a session
+func (s *UserStore) Logout(sessionID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, sessionID)
+}
+
+// Authenticate returns the user a request comes from, by its bearer token or session
+// cookie, or nil
+func (s *UserStore) Authenticate(r *http.Request) *User {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		log.Printf("Failed to read users: %v", err)
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		hash := hex.EncodeToString(sum[:])
+		for _, user := range s.users {
+			for _, t := range user.Tokens {
+				if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+					return user
+				}
+			}
+		}
+		return nil
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	sess, exists := s.sessions[cookie.Value]
+	if !exists || time.Now().After(sess.expires) {
+		delete(s.sessions, cookie.Value)
+		return nil
+	}
+	// A user removed from the file loses their sessions
+	return s.users[sess.user]
+}
+
+// hashPassword hashes a password with PBKDF2-SHA256 and a random salt
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash from hashPassword
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// randomToken returns a random URL safe token for sessions and API tokens
+func randomToken() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// requireUser only passes requests from users with at least the given role on to next.
+// Browsers without a session are sent to the login page, API clients get 401.
+func (sp *SuperPeer) requireUser(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := sp.users.Authenticate(r)
+		switch {
+		case user == nil && strings.HasPrefix(r.URL.Path, "/admin/api/"):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="super peer"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+		case user == nil:
+			http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		case roleRank[user.Role] < roleRank[role]:
+			http.Error(w, fmt.Sprintf("the %s role is required", role), http.StatusForbidden)
+		default:
+			next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+		}
+	}
+}
+
+// userContextKey is the request context key of the authenticated user
+type userContextKey struct{}
+
+// userFrom returns the user requireUser authenticated a request as
+func userFrom(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey{}).(*User)
+	return user
+}
+
+// loginTemplate is the admin login page
+var loginTemplate = template.Must(template.New("login").Parse(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>P2P Super Peer Login</title>
+    <link rel="stylesheet" href="/admin/static/styles.css">
+    <link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/font-awesome/6.0.0-beta3/css/all.min.css">
+</head>
+<body>
+    <div class="container">
+        <div class="card login-card">
+            <div class="header">
+                <h1><i class="fas fa-lock"></i> Super Peer Login</h1>
+            </div>
+            {{if .Error}}<p class="login-error">{{.Error}}</p>{{end}}
+            <form class="login-form" action="/admin/login" method="post">
+                <input type="hidden" name="next" value="{{.Next}}">
+                <input type="text" name="name" placeholder="User name" autocomplete="username" required autofocus>
+                <input type="password" name="password" placeholder="Password" autocomplete="current-password" required>
+                <button type="submit"><i class="fas fa-sign-in-alt"></i> Log in</button>
+            </form>
+        </div>
+    </div>
+</body>
+</html>
+`))
+
+// handleLogin shows the login page and starts a session for valid credentials
+func (sp *SuperPeer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/admin") {
+		next = "/admin"
+	}
+	data := struct{ Next, Error string }{Next: next}
+
+	if r.Method == http.MethodPost {
+		addr, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			addr = r.RemoteAddr
+		}
+		sessionID, err := sp.users.Login(r.FormValue("name"), r.FormValue("password"), addr)
+		if err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookieName,
+				Value:    sessionID,
+				Path:     "/admin",
+				MaxAge:   int(sessionTTL.Seconds()),
+				HttpOnly: true,
+				Secure:   sp.tlsConfig != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("Failed admin login for %q from %s: %v", r.FormValue("name"), r.RemoteAddr, err)
+		var throttled *loginThrottledError
+		switch {
+		case errors.As(err, &throttled):
+			w.Header().Set("Retry-After", strconv.Itoa(int(throttled.retryAfter.Seconds())+1))
+			w.WriteHeader(http.StatusTooManyRequests)
+			data.Error = "Too many failed logins, try again later"
+		case errors.Is(err, errLoginBusy):
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			data.Error = "Too many logins at once, try again in a moment"
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			data.Error = "Invalid user name or password"
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := loginTemplate.Execute(w, data); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to render template: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// handleLogout ends the session of the request
+func (sp *SuperPeer) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		sp.users.Logout(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/admin", MaxAge: -1})
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// runUser runs the user subcommand, which manages the admin users file
+func runUser(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: super-peer user add|token [flags]")
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("user add", flag.ExitOnError)
+		usersFile := fs.String("users", defaultUsersFile, "Users file of the super peer")
+		name := fs.String("name", "", "Name of the user")
+		role := fs.String("role", roleViewer, "Role of the user: viewer, operator or admin")
+		password := fs.String("password", "", "Password of the user, read from standard input when empty")
+		fs.Parse(args[1:])
+
+		if *password == "" {
+			fmt.Fprint(os.Stderr, "Password: ")
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return err
+			}
+			*password = strings.TrimRight(line, "\r\n")
+		}
+		store, err := OpenUserStore(*usersFile)
+		if err != nil {
+			return err
+		}
+		if err := store.AddUser(*name, *role, *password); err != nil {
+			return err
+		}
+		fmt.Printf("Saved %s user %q in %s\n", *role, *name, *usersFile)
+		return nil
+	case "token":
+		fs := flag.NewFlagSet("user token", flag.ExitOnError)
+		usersFile := fs.String("users", defaultUsersFile, "Users file of the super peer")
+		name := fs.String("name", "", "Name of the user the token acts as")
+		tokenName := fs.String("token-name", "api", "Label of the token")
+		fs.Parse(args[1:])
+
+		store, err := OpenUserStore(*usersFile)
+		if err != nil {
+			return err
+		}
+		token, err := store.AddToken(*name, *tokenName)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	default:
+		return fmt.Errorf("unknown user command %q, expected add or token", args[0])
+	}
+}
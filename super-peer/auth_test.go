@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// cheapPasswordHash hashes a password like hashPassword with a single iteration
+func cheapPasswordHash(t *testing.T, password string) string {
+	t.Helper()
+	salt := []byte("0123456789abcdef")
+	key, err := pbkdf2.Key(sha256.New, password, salt, 1, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "pbkdf2-sha256$1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+}
+
+func TestLoginBackoff(t *testing.T) {
+	type attempt struct {
+		user, password, addr string
+		wantErr              error // nil for a session
+	}
+	var throttled *loginThrottledError
+	errThrottled := errors.New("throttled")
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{"valid login", []attempt{{"alice", "secret", "10.0.0.1", nil}}},
+		{"failures below the limit", []attempt{
+			{"alice", "wrong", "10.0.0.1", errInvalidLogin},
+			{"alice", "wrong", "10.0.0.1", errInvalidLogin},
+			{"alice", "secret", "10.0.0.1", nil},
+		}},
+		{"user locked out from every address", []attempt{
+			{"alice", "wrong", "10.0.0.1", errInvalidLogin},
+			{"alice", "wrong", "10.0.0.2", errInvalidLogin},
+			{"alice", "wrong", "10.0.0.3", errInvalidLogin},
+			{"alice", "wrong", "10.0.0.4", errInvalidLogin},
+			{"alice", "secret", "10.0.0.5", errThrottled},
+			{"bob", "hunter2", "10.0.0.5", nil},
+		}},
+		{"address locked out for every user", []attempt{
+			{"mallory", "guess", "10.0.0.9", errInvalidLogin},
+			{"eve", "guess", "10.0.0.9", errInvalidLogin},
+			{"trent", "guess", "10.0.0.9", errInvalidLogin},
+			{"oscar", "guess", "10.0.0.9", errInvalidLogin},
+			{"bob", "hunter2", "10.0.0.9", errThrottled},
+			{"bob", "hunter2", "10.0.0.1", nil},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := OpenUserStore(filepath.Join(t.TempDir(), "users.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.users["alice"] = &User{Name: "alice", Role: roleAdmin, PasswordHash: cheapPasswordHash(t, "secret")}
+			store.users["bob"] = &User{Name: "bob", Role: roleViewer, PasswordHash: cheapPasswordHash(t, "hunter2")}
+			if err := store.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, a := range tt.attempts {
+				sessionID, err := store.Login(a.user, a.password, a.addr)
+				switch {
+				case a.wantErr == nil:
+					if err != nil || sessionID == "" {
+						t.Errorf("attempt %d: login failed: %v", i, err)
+					}
+				case a.wantErr == errThrottled:
+					if !errors.As(err, &throttled) {
+						t.Errorf("attempt %d: err = %v, want a throttled login", i, err)
+					}
+				case !errors.Is(err, a.wantErr):
+					t.Errorf("attempt %d: err = %v, want %v", i, err, a.wantErr)
+				}
+			}
+		})
+	}
+}
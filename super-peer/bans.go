@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of ban an operator can add
+const (
+	banPeer = "peer" // A peer ID may not register
+	banCIDR = "cidr" // Peers connecting from an IP range may not register
+	banHash = "hash" // A file hash is hidden from search results
+)
+
+// errPeerNotFound is returned when acting on a peer that is not registered
+var errPeerNotFound = errors.New("peer not found")
+
+// Ban keeps a peer ID or IP range from registering, or hides a file hash from searches
+type Ban struct {
+	Kind    string    `json:"kind"`
+	Value   string    `json:"value"`
+	Reason  string    `json:"reason,omitempty"`
+	By      string    `json:"by,omitempty"` // Admin user who added the ban
+	Created time.Time `json:"created"`
+}
+
+// key identifies a ban in the index
+func (b *Ban) key() string {
+	return b.Kind + " " + b.Value
+}
+
+// newBan validates a ban and puts its value in canonical form. A single IP address is
+// banned as a range holding only that address.
+func newBan(kind, value, reason, by string) (*Ban, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case banPeer:
+		if value == "" {
+			return nil, errors.New("a peer ID is required")
+		}
+	case banCIDR:
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			value = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q", value)
+		}
+		value = ipNet.String()
+	case banHash:
+		value = strings.ToLower(value)
+		if data, err := hex.DecodeString(value); err != nil || len(data) != 32 {
+			return nil, fmt.Errorf("invalid SHA-256 file hash %q", value)
+		}
+	default:
+		return nil, fmt.Errorf("unknown ban kind %q, expected peer, cidr or hash", kind)
+	}
+	return &Ban{Kind: kind, Value: value, Reason: reason, By: by, Created: time.Now()}, nil
+}
+
+// addBan records a ban, the caller must hold the write lock
+func (idx *Index) addBan(ban *Ban) {
+	idx.bans[ban.key()] = ban
+}
+
+// Bans returns every ban, oldest first
+func (idx *Index) Bans() []*Ban {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	bans := make([]*Ban, 0, len(idx.bans))
+	for _, ban := range idx.bans {
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+	return bans
+}
+
+// registrationBan returns the ban keeping a peer with the given ID and address from
+// registering, or nil if it may register
+func (idx *Index) registrationBan(peerID, address string) *Ban {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	return idx.registrationBanLocked(peerID, address)
+}
+
+// registrationBanLocked is registrationBan for callers holding the read lock
+func (idx *Index) registrationBanLocked(peerID, address string) *Ban {
+	if ban, exists := idx.bans[banPeer+" "+peerID]; exists {
+		return ban
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	for _, ban := range idx.bans {
+		if ban.Kind != banCIDR {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(ban.Value); err == nil && ipNet.Contains(ip) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// isHidden reports whether a file hash is hidden from searches, the caller must hold the read lock
+func (idx *Index) isHidden(hash string) bool {
+	_, hidden := idx.bans[banHash+" "+strings.ToLower(hash)]
+	return hidden
+}
+
+// withoutHidden returns the files not hidden from searches, such as those returned by
+// other super peers. The given slice is left as it is.
+func (idx *Index) withoutHidden(files []File) []File {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	visible := make([]File, 0, len(files))
+	for _, file := range files {
+		if !idx.isHidden(file.Hash) {
+			visible = append(visible, file)
+		}
+	}
+	return visible
+}
+
+// Evict removes a registered peer from the index. It may register again unless banned.
+func (sp *SuperPeer) Evict(peerID string) error {
+	sp.index.mutex.RLock()
+	_, exists := sp.index.Peers[peerID]
+	sp.index.mutex.RUnlock()
+	if !exists {
+		return errPeerNotFound
+	}
+	return sp.commit(walRecord{Op: opUnregister, PeerID: peerID})
+}
+
+// Ban adds a ban and evicts the registered peers it covers
+func (sp *SuperPeer) Ban(ban *Ban) error {
+	if err := sp.commit(walRecord{Op: opBan, Ban: ban}); err != nil {
+		return err
+	}
+	if ban.Kind == banHash {
+		return nil
+	}
+
+	sp.index.mutex.RLock()
+	banned := []string{}
+	for id, peer := range sp.index.Peers {
+		if sp.index.registrationBanLocked(id, peer.Address) != nil {
+			banned = append(banned, id)
+		}
+	}
+	sp.index.mutex.RUnlock()
+
+	for _, peerID := range banned {
+		if err := sp.commit(walRecord{Op: opUnregister, PeerID: peerID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unban lifts a ban
+func (sp *SuperPeer) Unban(kind, value string) error {
+	ban, err := newBan(kind, value, "", "")
+	if err != nil {
+		return err
+	}
+
+	sp.index.mutex.RLock()
+	_, exists := sp.index.bans[ban.key()]
+	sp.index.mutex.RUnlock()
+	if !exists {
+		return fmt.Errorf("no %s ban on %s", ban.Kind, ban.Value)
+	}
+	return sp.commit(walRecord{Op: opUnban, Ban: ban})
+}
+
+// actionStatus returns the HTTP status for the error of an admin action
+func actionStatus(err error) int {
+	switch {
+	case errors.Is(err, errPeerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNotLeader):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errIndexLog):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// handleAdminAction serves an operator action at /admin/api/<name> for API clients, and
+// at /admin/<name> for dashboard forms, which are sent back to the dashboard afterwards.
+// The action reads its parameters as form values.
+func (sp *SuperPeer) handleAdminAction(name string, action func(user *User, r *http.Request) error) {
+	run := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return false
+		}
+		if err := action(userFrom(r), r); err != nil {
+			http.Error(w, err.Error(), actionStatus(err))
+			return false
+		}
+		return true
+	}
+
+	sp.webMux.HandleFunc("/admin/api/"+name, sp.requireUser(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		if run(w, r) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		}
+	}))
+	sp.webMux.HandleFunc("/admin/"+name, sp.requireUser(roleOperator, func(w http.ResponseWriter, r *http.Request) {
+		if run(w, r) {
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		}
+	}))
+}
+
+// registerBanHandlers serves the ban list and the evict, ban and unban actions
+func (sp *SuperPeer) registerBanHandlers() {
+	sp.webMux.HandleFunc("/admin/api/bans", sp.requireUser(roleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sp.index.Bans())
+	}))
+
+	sp.handleAdminAction("evict", func(user *User, r *http.Request) error {
+		peerID := r.FormValue("peerId")
+		if err := sp.Evict(peerID); err != nil {
+			return err
+		}
+		log.Printf("%s evicted peer %s", user.Name, peerID)
+		return nil
+	})
+
+	sp.handleAdminAction("ban", func(user *User, r *http.Request) error {
+		ban, err := newBan(r.FormValue("kind"), r.FormValue("value"), r.FormValue("reason"), user.Name)
+		if err != nil {
+			return err
+		}
+		if err := sp.Ban(ban); err != nil {
+			return err
+		}
+		log.Printf("%s banned %s %s", user.Name, ban.Kind, ban.Value)
+		return nil
+	})
+
+	sp.handleAdminAction("unban", func(user *User, r *http.Request) error {
+		kind, value := r.FormValue("kind"), r.FormValue("value")
+		if err := sp.Unban(kind, value); err != nil {
+			return err
+		}
+		log.Printf("%s lifted the %s ban on %s", user.Name, kind, value)
+		return nil
+	})
+}
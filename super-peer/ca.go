@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// caCertFileName and caKeyFileName are the files of the cluster CA in its directory
+	caCertFileName = "ca.pem"
+	caKeyFileName  = "ca-key.pem"
+)
+
+// runCA runs the ca subcommand, which creates the cluster CA and issues certificates
+// for peers, super peers and admins signed by it
+func runCA(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: super-peer ca init|issue [flags]")
+	}
+
+	switch args[0] {
+	case "init":
+		fs := flag.NewFlagSet("ca init", flag.ExitOnError)
+		dir := fs.String("dir", "./ca", "Directory to create the CA in")
+		name := fs.String("name", "P2P File Sharing CA", "Name of the CA")
+		days := fs.Int("days", 3650, "Days the CA certificate is valid for")
+		fs.Parse(args[1:])
+		return initCA(*dir, *name, *days)
+	case "issue":
+		fs := flag.NewFlagSet("ca issue", flag.ExitOnError)
+		dir := fs.String("dir", "./ca", "Directory of the CA")
+		name := fs.String("name", "", "Name the certificate is issued to, the peer ID for peers")
+		role := fs.String("role", rolePeer, "Role of the certificate: peer, super-peer or admin")
+		hosts := fs.String("hosts", "localhost,127.0.0.1", "Comma separated host names and IPs the certificate is valid for")
+		days := fs.Int("days", 365, "Days the certificate is valid for")
+		out := fs.String("out", ".", "Directory to write the certificate and key to")
+		fs.Parse(args[1:])
+		return issueCertificate(*dir, *name, *role, splitList(*hosts), *days, *out)
+	default:
+		return fmt.Errorf("unknown ca command %q, expected init or issue", args[0])
+	}
+}
+
+// initCA creates a self-signed CA certificate and key in dir
+func initCA(dir, name string, days int) error {
+	certPath := filepath.Join(dir, caCertFileName)
+	if _, err := os.Stat(certPath); err == nil {
+		return fmt.Errorf("%s already exists", certPath)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certificateTemplate(name, days)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(certPath, filepath.Join(dir, caKeyFileName), der, key); err != nil {
+		return err
+	}
+	fmt.Printf("Created CA %q in %s\n", name, dir)
+	return nil
+}
+
+// issueCertificate signs a certificate for name with the given role using the CA in
+// caDir and writes it to out as <name>.pem and <name>-key.pem
+func issueCertificate(caDir, name, role string, hosts []string, days int, out string) error {
+	if name == "" {
+		return errors.New("a certificate name is required")
+	}
+	if role != rolePeer && role != roleSuperPeer && role != roleAdmin {
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	caCert, caKey, err := loadCA(caDir)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certificateTemplate(name, days)
+	if err != nil {
+		return err
+	}
+	template.Subject.OrganizationalUnit = []string{role}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	// Peers and super peers both serve and connect with the same certificate
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	certPath := filepath.Join(out, name+".pem")
+	keyPath := filepath.Join(out, name+"-key.pem")
+	if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+		return err
+	}
+	fmt.Printf("Issued %s certificate for %q: %s, %s\n", role, name, certPath, keyPath)
+	return nil
+}
+
+// certificateTemplate returns a template for a certificate with a random serial number
+func certificateTemplate(name string, days int) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, days),
+	}, nil
+}
+
+// loadCA reads the CA certificate and key from dir
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, caCertFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, caKeyFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("invalid CA files in %s", dir)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("CA key in %s cannot sign", dir)
+	}
+	return cert, signer, nil
+}
+
+// writeKeyPair writes a DER certificate and its private key as PEM files, the key
+// readable by the owner only
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
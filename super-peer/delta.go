@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// FileDelta is an incremental change to the files a peer shares, made to the file list
+// the super peer holds at BaseVersion
+type FileDelta struct {
+	PeerID      string   `json:"peerId"`
+	BaseVersion int64    `json:"baseVersion"`        // FilesVersion the change applies to
+	Version     int64    `json:"version"`            // FilesVersion after the change
+	Added       []File   `json:"added,omitempty"`    // Files not shared before
+	Modified    []File   `json:"modified,omitempty"` // New content or access control list under an existing name
+	Removed     []string `json:"removed,omitempty"`  // Names of files no longer shared
+}
+
+var (
+	errUnknownPeer     = errors.New("unknown peer")
+	errVersionConflict = errors.New("files are at another version")
+)
+
+// applyDelta changes the files of a registered peer. A delta based on another version of
+// its files is rejected with errVersionConflict, the peer then registers again in full.
+// The caller must hold the write lock.
+func (idx *Index) applyDelta(delta *FileDelta, at time.Time) error {
+	peer, exists := idx.Peers[delta.PeerID]
+	if !exists {
+		return errUnknownPeer
+	}
+	if peer.FilesVersion != delta.BaseVersion {
+		return fmt.Errorf("%w: %d, not %d", errVersionConflict, peer.FilesVersion, delta.BaseVersion)
+	}
+
+	replaced := make(map[string]bool)
+	for _, name := range delta.Removed {
+		replaced[name] = true
+	}
+	changed := append(append([]File{}, delta.Added...), delta.Modified...)
+	for _, file := range changed {
+		replaced[file.Name] = true
+	}
+
+	updated := *peer
+	updated.Files = []File{}
+	for _, file := range peer.Files {
+		if !replaced[file.Name] {
+			updated.Files = append(updated.Files, file)
+		}
+	}
+	updated.Files = append(updated.Files, changed...)
+	updated.FilesVersion = delta.Version
+	updated.LastSeen = at
+	idx.addPeer(&updated)
+	return nil
+}
+
+// handleUpdate applies a delta a peer sends instead of registering its whole file list
+// again. It answers 409 Conflict when the peer's files here are at another version.
+func (sp *SuperPeer) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if sp.redirectToLeader(w, r) {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var delta FileDelta
+	if err := json.Unmarshal(body, &delta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the peer itself may change its files
+	if _, ok := sp.authenticatePeer(w, r, body, delta.PeerID); !ok {
+		return
+	}
+
+	// The version is checked where the delta is applied, so a delta racing another
+	// change to the peer's files is refused rather than lost
+	if err := sp.commit(walRecord{Op: opUpdate, Delta: &delta}); err != nil {
+		http.Error(w, err.Error(), commitStatus(err))
+		return
+	}
+	log.Printf("Updated files of peer %s: %d added, %d modified, %d removed\n",
+		delta.PeerID, len(delta.Added), len(delta.Modified), len(delta.Removed))
+	w.WriteHeader(http.StatusOK)
+}
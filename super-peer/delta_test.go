@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestApplyDelta(t *testing.T) {
+	tests := []struct {
+		name        string
+		delta       FileDelta
+		wantErr     error
+		wantVersion int64
+		wantFiles   []string
+	}{
+		{
+			name:        "current version",
+			delta:       FileDelta{PeerID: "peer1", BaseVersion: 2, Version: 3, Added: []File{{Name: "c.txt", Hash: "c"}}, Removed: []string{"a.txt"}},
+			wantVersion: 3,
+			wantFiles:   []string{"b.txt", "c.txt"},
+		},
+		{
+			name:        "modified file",
+			delta:       FileDelta{PeerID: "peer1", BaseVersion: 2, Version: 3, Modified: []File{{Name: "a.txt", Hash: "a2"}}},
+			wantVersion: 3,
+			wantFiles:   []string{"a.txt", "b.txt"},
+		},
+		{
+			name:        "older base version",
+			delta:       FileDelta{PeerID: "peer1", BaseVersion: 1, Version: 3, Removed: []string{"a.txt"}},
+			wantErr:     errVersionConflict,
+			wantVersion: 2,
+			wantFiles:   []string{"a.txt", "b.txt"},
+		},
+		{
+			name:        "newer base version",
+			delta:       FileDelta{PeerID: "peer1", BaseVersion: 3, Version: 4, Removed: []string{"a.txt"}},
+			wantErr:     errVersionConflict,
+			wantVersion: 2,
+			wantFiles:   []string{"a.txt", "b.txt"},
+		},
+		{
+			name:    "unknown peer",
+			delta:   FileDelta{PeerID: "peer2", BaseVersion: 2, Version: 3},
+			wantErr: errUnknownPeer,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := NewIndex()
+			idx.addPeer(&Peer{
+				ID:           "peer1",
+				FilesVersion: 2,
+				Files:        []File{{Name: "a.txt", Hash: "a"}, {Name: "b.txt", Hash: "b"}},
+			})
+
+			err := idx.apply(walRecord{Op: opUpdate, Time: time.Now(), Delta: &tt.delta})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("apply = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantFiles == nil {
+				if _, exists := idx.Peers[tt.delta.PeerID]; exists {
+					t.Errorf("delta registered unknown peer %s", tt.delta.PeerID)
+				}
+				return
+			}
+
+			peer := idx.Peers["peer1"]
+			if peer.FilesVersion != tt.wantVersion {
+				t.Errorf("files version = %d, want %d", peer.FilesVersion, tt.wantVersion)
+			}
+			var names []string
+			for _, file := range peer.Files {
+				names = append(names, file.Name)
+			}
+			sort.Strings(names)
+			if len(names) != len(tt.wantFiles) {
+				t.Fatalf("files = %v, want %v", names, tt.wantFiles)
+			}
+			for i := range names {
+				if names[i] != tt.wantFiles[i] {
+					t.Errorf("files = %v, want %v", names, tt.wantFiles)
+					break
+				}
+			}
+		})
+	}
+}
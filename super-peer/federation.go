@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// federationTTL is the number of super-peer hops a search is forwarded over
+	federationTTL = 3
+
+	// federationTimeout bounds how long a super peer waits for its neighbours' results
+	federationTimeout = 3 * time.Second
+
+	// seenQueryTTL is how long a query ID is remembered to drop duplicates arriving over other paths
+	seenQueryTTL = time.Minute
+
+	// forwardedCacheTTL is how long the neighbours' results are kept for the later pages of a search
+	forwardedCacheTTL = 30 * time.Second
+)
+
+// Federation forwards searches to neighbouring super peers and merges their results
+type Federation struct {
+	neighbours []string                    // Base URLs of the neighbouring super peers
+	seen       map[string]time.Time        // Query IDs already handled, with the time they were first seen
+	forwarded  map[string]forwardedResults // Neighbours' results by the search they answered, without its query ID
+	httpClient *http.Client
+	mutex      sync.Mutex
+}
+
+// forwardedResults are the responses of the neighbours to a search
+type forwardedResults struct {
+	responses []SearchResponse
+	at        time.Time
+}
+
+// NewFederation creates a federation with the given neighbour URLs, connecting through transport
+func NewFederation(neighbours []string, transport http.RoundTripper) *Federation {
+	return &Federation{
+		neighbours: neighbours,
+		seen:       make(map[string]time.Time),
+		forwarded:  make(map[string]forwardedResults),
+		httpClient: &http.Client{Timeout: federationTimeout, Transport: transport},
+	}
+}
+
+// newQueryID returns a random ID identifying a search across the federation
+func newQueryID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// markSeen records a query ID and reports whether it had been seen before
+func (f *Federation) markSeen(queryID string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	for id, seenAt := range f.seen {
+		if now.Sub(seenAt) > seenQueryTTL {
+			delete(f.seen, id)
+		}
+	}
+
+	if _, exists := f.seen[queryID]; exists {
+		return true
+	}
+	f.seen[queryID] = now
+	return false
+}
+
+// forward sends a search to every neighbour and collects the responses that arrive in time
+func (f *Federation) forward(req SearchRequest) []SearchResponse {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+
+	responses := make(chan SearchResponse, len(f.neighbours))
+	var wg sync.WaitGroup
+	for _, neighbour := range f.neighbours {
+		wg.Add(1)
+		go func(neighbour string) {
+			defer wg.Done()
+			resp, err := f.query(neighbour, jsonData)
+			if err != nil {
+				log.Printf("Federated search on %s failed: %v", neighbour, err)
+				return
+			}
+			responses <- *resp
+		}(neighbour)
+	}
+	wg.Wait()
+	close(responses)
+
+	results := []SearchResponse{}
+	for resp := range responses {
+		results = append(results, resp)
+	}
+	return results
+}
+
+// forwardCached returns the neighbours' results to a search. The first page always asks
+// them, later pages reuse those results while they are fresh so paging stays consistent
+// and does not flood the federation again.
+func (f *Federation) forwardCached(req SearchRequest, firstPage bool) []SearchResponse {
+	keyed := req
+	keyed.QueryID = ""
+	key, err := json.Marshal(keyed)
+	if err != nil {
+		return nil
+	}
+
+	f.mutex.Lock()
+	now := time.Now()
+	for k, cached := range f.forwarded {
+		if now.Sub(cached.at) > forwardedCacheTTL {
+			delete(f.forwarded, k)
+		}
+	}
+	cached, exists := f.forwarded[string(key)]
+	f.mutex.Unlock()
+	if exists && !firstPage {
+		return cached.responses
+	}
+
+	responses := f.forward(req)
+	f.mutex.Lock()
+	f.forwarded[string(key)] = forwardedResults{responses: responses, at: time.Now()}
+	f.mutex.Unlock()
+	return responses
+}
+
+// query sends an encoded search request to a single neighbour
+func (f *Federation) query(neighbour string, jsonData []byte) (*SearchResponse, error) {
+	resp, err := f.httpClient.Post(neighbour+"/search", "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var searchResp SearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
+		return nil, err
+	}
+	return &searchResp, nil
+}
+
+// search answers a search from the local index merged with the results of the
+// neighbouring super peers, then returns the requested page
+func (sp *SuperPeer) search(req SearchRequest) (SearchResponse, error) {
+	if sp.federation == nil {
+		return sp.index.Search(req)
+	}
+
+	// Searches from peers start a new federated query, forwarded ones carry their ID
+	if req.QueryID == "" {
+		req.QueryID = newQueryID()
+		req.TTL = federationTTL
+	}
+	if sp.federation.markSeen(req.QueryID) {
+		// Already answered over another path
+		return SearchResponse{Files: []File{}, Peers: map[string]*Peer{}}, nil
+	}
+
+	files, peers := sp.index.SearchAll(req)
+
+	if req.TTL > 0 {
+		forwarded := req
+		forwarded.TTL--
+		forwarded.Limit = 0
+		forwarded.Cursor = ""
+		for _, resp := range sp.federation.forwardCached(forwarded, req.Cursor == "") {
+			files = mergeFiles(files, sp.index.withoutHidden(resp.Files))
+			for id, peer := range resp.Peers {
+				if _, exists := peers[id]; !exists {
+					peers[id] = peer
+				}
+			}
+		}
+		sortFiles(files)
+	}
+
+	resp, err := paginate(files, req.Cursor, req.Limit)
+	if err != nil {
+		return resp, err
+	}
+
+	// Only return the peers sharing files on this page
+	resp.Peers = make(map[string]*Peer)
+	for _, file := range resp.Files {
+		for _, peerID := range file.PeerIDs {
+			if peer, exists := peers[peerID]; exists {
+				resp.Peers[peerID] = peer
+			}
+		}
+	}
+	return resp, nil
+}
+
+// mergeFiles adds remote results to local ones, combining the peers of identical content under the same name
+func mergeFiles(files, remote []File) []File {
+	type variant struct{ name, hash string }
+	positions := make(map[variant]int, len(files))
+	for i, file := range files {
+		positions[variant{file.Name, file.Hash}] = i
+	}
+
+	for _, file := range remote {
+		key := variant{file.Name, file.Hash}
+		i, exists := positions[key]
+		if !exists {
+			positions[key] = len(files)
+			files = append(files, file)
+			continue
+		}
+
+		merged := append([]string{}, files[i].PeerIDs...)
+		for _, peerID := range file.PeerIDs {
+			if !contains(merged, peerID) {
+				merged = append(merged, peerID)
+			}
+		}
+		sort.Strings(merged)
+		files[i].PeerIDs = merged
+		files[i].Score = max(files[i].Score, file.Score)
+	}
+	return files
+}
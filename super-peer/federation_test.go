@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFederatedPagesForwardOnce(t *testing.T) {
+	var forwarded atomic.Int32
+	neighbour := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		json.NewEncoder(w).Encode(SearchResponse{Files: testFiles(5), Peers: map[string]*Peer{"peer1": {ID: "peer1"}}})
+	}))
+	defer neighbour.Close()
+
+	sp := NewSuperPeer(0, 0)
+	sp.federation = NewFederation([]string{neighbour.URL}, http.DefaultTransport)
+
+	tests := []struct {
+		name          string
+		newSearch     bool
+		wantFiles     []string
+		wantForwarded int32
+	}{
+		{"first page", true, []string{"file00.txt", "file01.txt"}, 1},
+		{"second page", false, []string{"file02.txt", "file03.txt"}, 1},
+		{"last page", false, []string{"file04.txt"}, 1},
+		{"search again", true, []string{"file00.txt", "file01.txt"}, 2},
+	}
+
+	cursor := ""
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.newSearch {
+				cursor = ""
+			}
+			resp, err := sp.search(SearchRequest{Query: "file", Limit: 2, Cursor: cursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cursor = resp.NextCursor
+
+			if len(resp.Files) != len(tt.wantFiles) {
+				t.Fatalf("got %d files, want %v", len(resp.Files), tt.wantFiles)
+			}
+			for i, file := range resp.Files {
+				if file.Name != tt.wantFiles[i] {
+					t.Errorf("file %d = %s, want %s", i, file.Name, tt.wantFiles[i])
+				}
+			}
+			if got := forwarded.Load(); got != tt.wantForwarded {
+				t.Errorf("forwarded %d times, want %d", got, tt.wantForwarded)
+			}
+		})
+	}
+}
+
+func TestWithoutHiddenKeepsInput(t *testing.T) {
+	idx := NewIndex()
+	idx.addBan(&Ban{Kind: banHash, Value: testFiles(2)[0].Hash})
+
+	files := testFiles(2)
+	visible := idx.withoutHidden(files)
+	if len(visible) != 1 || visible[0].Name != "file01.txt" {
+		t.Errorf("visible files = %v, want file01.txt", visible)
+	}
+	if files[0].Name != "file00.txt" || files[1].Name != "file01.txt" {
+		t.Errorf("input changed to %v", files)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"p2p-file-sharing/internal/identity"
+)
+
+// verifySignature checks that a request about peerID was signed by the key that ID is
+// derived from and has not been seen before, and returns that key in base64
+func (sp *SuperPeer) verifySignature(r *http.Request, body []byte, peerID string) (string, error) {
+	publicKey, err := sp.signatures.Verify(r, body)
+	if err != nil {
+		return "", err
+	}
+	if id := identity.PeerID(publicKey); id != peerID {
+		return "", fmt.Errorf("key belongs to %s, not %s", id, peerID)
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+// authenticatePeer makes sure a request about peerID was signed by that peer, and sent
+// with its certificate when TLS is enabled. It writes an error and returns false otherwise.
+func (sp *SuperPeer) authenticatePeer(w http.ResponseWriter, r *http.Request, body []byte, peerID string) (string, bool) {
+	if !sp.checkPeerIdentity(w, r, peerID) {
+		return "", false
+	}
+	publicKey, err := sp.verifySignature(r, body, peerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+	return publicKey, true
+}
+
+// searchRequester returns the peer a search is for: the one named in its certificate
+// or proven by its signature, or the requester a neighbouring super peer forwarding
+// the search verified. Searches from anyone else are anonymous and only see public files.
+func (sp *SuperPeer) searchRequester(r *http.Request, body []byte, forwardedFor string) (string, error) {
+	name, role := certIdentity(r)
+	switch {
+	case role == roleSuperPeer:
+		return forwardedFor, nil
+	case role == rolePeer:
+		return name, nil
+	case r.Header.Get(identity.HeaderKey) == "":
+		return "", nil
+	}
+
+	publicKey, err := sp.signatures.Verify(r, body)
+	if err != nil {
+		return "", err
+	}
+	return identity.PeerID(publicKey), nil
+}
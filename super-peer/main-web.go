@@ -1,53 +1,79 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
+
+	"p2p-file-sharing/internal/identity"
+	"p2p-file-sharing/internal/search"
 )
 
 // Peer represents a node in the P2P network
 type Peer struct {
-	ID       string    `json:"id"`
-	Address  string    `json:"address"`
-	Port     int       `json:"port"`
-	LastSeen time.Time `json:"lastSeen"`
-	Files    []File    `json:"files"`
+	ID           string    `json:"id"`
+	Address      string    `json:"address"`
+	Port         int       `json:"port"`
+	LastSeen     time.Time `json:"lastSeen"`
+	Files        []File    `json:"files"`
+	PublicKey    string    `json:"publicKey,omitempty"`    // Base64 Ed25519 key the ID is derived from, verified at registration
+	FilesVersion int64     `json:"filesVersion,omitempty"` // Version of Files, deltas from the peer must be based on it
 }
 
 // File represents a file in the P2P network
 type File struct {
-	Name    string   `json:"name"`
-	Hash    string   `json:"hash"`
-	Size    int64    `json:"size"`
-	PeerIDs []string `json:"peerIds"`
+	Name       string   `json:"name"`
+	Hash       string   `json:"hash"`
+	Size       int64    `json:"size"`
+	MerkleRoot string   `json:"merkleRoot,omitempty"` // Root of the Merkle tree over the file's pieces
+	PeerIDs    []string `json:"peerIds"`
+	Score      float64  `json:"score,omitempty"` // Relevance to the search query
+	ACL        []string `json:"acl,omitempty"`   // Peers allowed to see and download the file, empty when public
 }
 
-// SearchRequest represents a search query from a peer
+// SearchRequest represents a search query from a peer. All given filters must match.
 type SearchRequest struct {
 	Query    string `json:"query"`
 	Limit    int    `json:"limit"`
+	Cursor   string `json:"cursor,omitempty"` // NextCursor of the previous page
 	FromPeer string `json:"fromPeer"`
+	search.Filters
+	PeerIDs   []string `json:"peerIds,omitempty"`   // Only files shared by these peers
+	QueryID   string   `json:"queryId,omitempty"`   // Set when forwarded between super peers
+	TTL       int      `json:"ttl,omitempty"`       // Remaining super-peer hops for a forwarded search
+	Requester string   `json:"requester,omitempty"` // Peer the results are for, verified by the super peer it asked
+
+	unrestricted bool // Ignore access control lists, for the admin UI
 }
 
 // SearchResponse represents the response to a search query
 type SearchResponse struct {
-	Files []File           `json:"files"`
-	Peers map[string]*Peer `json:"peers"`
+	Files      []File           `json:"files"`
+	Peers      map[string]*Peer `json:"peers"`
+	Total      int              `json:"total"`                // Number of matching files over all pages
+	NextCursor string           `json:"nextCursor,omitempty"` // Cursor of the next page, empty on the last one
 }
 
 // Index is the central repository of peer and file information
 type Index struct {
-	Peers       map[string]*Peer    // Map of peer ID to peer info
-	FilesByName map[string][]string // Map of filename to peer IDs
-	FilesByHash map[string][]string // Map of file hash to peer IDs
-	mutex       sync.RWMutex        // For thread safety
+	Peers       map[string]*Peer           // Map of peer ID to peer info
+	FilesByName map[string][]string        // Map of filename to peer IDs
+	FilesByHash map[string][]string        // Map of file hash to peer IDs
+	tokens      map[string]map[string]bool // Map of name token to the filenames containing it
+	bans        map[string]*Ban            // Map of ban key to the ban
+	mutex       sync.RWMutex               // For thread safety
 }
 
 // NewIndex creates a new empty index
@@ -56,6 +82,8 @@ func NewIndex() *Index {
 		Peers:       make(map[string]*Peer),
 		FilesByName: make(map[string][]string),
 		FilesByHash: make(map[string][]string),
+		tokens:      make(map[string]map[string]bool),
+		bans:        make(map[string]*Ban),
 	}
 }
 
@@ -64,42 +92,90 @@ func (idx *Index) RegisterPeer(peer *Peer) {
 	idx.mutex.Lock()
 	defer idx.mutex.Unlock()
 
-	// Update or add the peer
 	peer.LastSeen = time.Now()
+	idx.addPeer(peer)
+}
+
+// addPeer adds or updates a peer and its files, dropping the files it no longer
+// shares, the caller must hold the write lock
+func (idx *Index) addPeer(peer *Peer) {
+	if previous, exists := idx.Peers[peer.ID]; exists {
+		idx.removeStaleRefs(peer.ID, previous.Files, peer.Files)
+	}
+
+	// Update or add the peer
 	idx.Peers[peer.ID] = peer
 
 	// Update file indices
 	for _, file := range peer.Files {
-		// Update FilesByName
-		if _, exists := idx.FilesByName[file.Name]; !exists {
-			idx.FilesByName[file.Name] = []string{}
-		}
-		// Check if peer ID is already in the list
-		found := false
-		for _, id := range idx.FilesByName[file.Name] {
-			if id == peer.ID {
-				found = true
-				break
-			}
-		}
-		if !found {
-			idx.FilesByName[file.Name] = append(idx.FilesByName[file.Name], peer.ID)
+		idx.addFileRef(peer.ID, file)
+	}
+}
+
+// addFileRef records that a peer shares a file, the caller must hold the write lock
+func (idx *Index) addFileRef(peerID string, file File) {
+	// Update FilesByName
+	if _, exists := idx.FilesByName[file.Name]; !exists {
+		idx.FilesByName[file.Name] = []string{}
+		idx.indexName(file.Name)
+	}
+	if !contains(idx.FilesByName[file.Name], peerID) {
+		idx.FilesByName[file.Name] = append(idx.FilesByName[file.Name], peerID)
+	}
+
+	// Update FilesByHash
+	if !contains(idx.FilesByHash[file.Hash], peerID) {
+		idx.FilesByHash[file.Hash] = append(idx.FilesByHash[file.Hash], peerID)
+	}
+}
+
+// removeFileRef records that a peer no longer shares a file, the caller must hold the write lock
+func (idx *Index) removeFileRef(peerID string, file File) {
+	idx.removeNameRef(peerID, file.Name)
+	idx.removeHashRef(peerID, file.Hash)
+}
+
+// removeNameRef removes a peer from FilesByName, the caller must hold the write lock
+func (idx *Index) removeNameRef(peerID, name string) {
+	if peerIDs, exists := idx.FilesByName[name]; exists {
+		newPeerIDs := removeString(peerIDs, peerID)
+		if len(newPeerIDs) > 0 {
+			idx.FilesByName[name] = newPeerIDs
+		} else {
+			delete(idx.FilesByName, name)
+			idx.unindexName(name)
 		}
+	}
+}
 
-		// Update FilesByHash
-		if _, exists := idx.FilesByHash[file.Hash]; !exists {
-			idx.FilesByHash[file.Hash] = []string{}
+// removeHashRef removes a peer from FilesByHash, the caller must hold the write lock
+func (idx *Index) removeHashRef(peerID, hash string) {
+	if peerIDs, exists := idx.FilesByHash[hash]; exists {
+		newPeerIDs := removeString(peerIDs, peerID)
+		if len(newPeerIDs) > 0 {
+			idx.FilesByHash[hash] = newPeerIDs
+		} else {
+			delete(idx.FilesByHash, hash)
 		}
-		// Check if peer ID is already in the list
-		found = false
-		for _, id := range idx.FilesByHash[file.Hash] {
-			if id == peer.ID {
-				found = true
-				break
-			}
+	}
+}
+
+// removeStaleRefs removes the names and hashes of a peer's previous files that its
+// current files no longer have. Content still shared under another name keeps its
+// hash entry. The caller must hold the write lock.
+func (idx *Index) removeStaleRefs(peerID string, previous, current []File) {
+	names := make(map[string]bool)
+	hashes := make(map[string]bool)
+	for _, file := range current {
+		names[file.Name] = true
+		hashes[file.Hash] = true
+	}
+	for _, file := range previous {
+		if !names[file.Name] {
+			idx.removeNameRef(peerID, file.Name)
 		}
-		if !found {
-			idx.FilesByHash[file.Hash] = append(idx.FilesByHash[file.Hash], peer.ID)
+		if !hashes[file.Hash] {
+			idx.removeHashRef(peerID, file.Hash)
 		}
 	}
 }
@@ -109,6 +185,11 @@ func (idx *Index) UnregisterPeer(peerID string) {
 	idx.mutex.Lock()
 	defer idx.mutex.Unlock()
 
+	idx.removePeer(peerID)
+}
+
+// removePeer removes a peer and its files, the caller must hold the write lock
+func (idx *Index) removePeer(peerID string) {
 	// Get the peer
 	peer, exists := idx.Peers[peerID]
 	if !exists {
@@ -117,153 +198,66 @@ func (idx *Index) UnregisterPeer(peerID string) {
 
 	// Remove peer from file indices
 	for _, file := range peer.Files {
-		// Remove from FilesByName
-		if peerIDs, exists := idx.FilesByName[file.Name]; exists {
-			newPeerIDs := []string{}
-			for _, id := range peerIDs {
-				if id != peerID {
-					newPeerIDs = append(newPeerIDs, id)
-				}
-			}
-			if len(newPeerIDs) > 0 {
-				idx.FilesByName[file.Name] = newPeerIDs
-			} else {
-				delete(idx.FilesByName, file.Name)
-			}
-		}
-
-		// Remove from FilesByHash
-		if peerIDs, exists := idx.FilesByHash[file.Hash]; exists {
-			newPeerIDs := []string{}
-			for _, id := range peerIDs {
-				if id != peerID {
-					newPeerIDs = append(newPeerIDs, id)
-				}
-			}
-			if len(newPeerIDs) > 0 {
-				idx.FilesByHash[file.Hash] = newPeerIDs
-			} else {
-				delete(idx.FilesByHash, file.Hash)
-			}
-		}
+		idx.removeFileRef(peerID, file)
 	}
 
 	// Remove the peer
 	delete(idx.Peers, peerID)
 }
 
-// SearchByName searches for files by name
-func (idx *Index) SearchByName(query string, limit int) ([]File, map[string]*Peer) {
-	idx.mutex.RLock()
-	defer idx.mutex.RUnlock()
-
-	files := []File{}
-	peers := make(map[string]*Peer)
-
-	// Simple substring search for now
-	for name, peerIDs := range idx.FilesByName {
-		if len(files) >= limit && limit > 0 {
-			break
-		}
-
-		if containsSubstring(name, query) {
-			file := File{
-				Name:    name,
-				PeerIDs: peerIDs,
-			}
-
-			// Get hash and size from first peer that has this file
-			if len(peerIDs) > 0 {
-				firstPeerID := peerIDs[0]
-				if peer, exists := idx.Peers[firstPeerID]; exists {
-					for _, peerFile := range peer.Files {
-						if peerFile.Name == name {
-							file.Hash = peerFile.Hash
-							file.Size = peerFile.Size
-							break
-						}
-					}
-				}
-			}
-
-			files = append(files, file)
-
-			// Add peers to the result
-			for _, peerID := range peerIDs {
-				if peer, exists := idx.Peers[peerID]; exists {
-					peers[peerID] = peer
-				}
-			}
-		}
-	}
-
-	return files, peers
+// SearchByName searches for files by name. The query may combine several terms,
+// each a substring, a glob such as *.csv or a misspelled word; all terms must match.
+// Only files the requesting peer may access are returned.
+func (idx *Index) SearchByName(query string, limit int, requester string) ([]File, map[string]*Peer) {
+	resp, _ := idx.Search(SearchRequest{Query: query, Limit: limit, Requester: requester})
+	return resp.Files, resp.Peers
 }
 
-// Helper function to check if a string contains a substring (case insensitive)
-func containsSubstring(s, substr string) bool {
-	s, substr = toLowerCase(s), toLowerCase(substr)
-	return len(s) >= len(substr) && s[:len(substr)] == substr
-}
+// CleanupDeadPeers removes peers that haven't been seen for a while and returns their IDs
+func (idx *Index) CleanupDeadPeers(timeout time.Duration) []string {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
 
-// Helper function to convert a string to lowercase
-func toLowerCase(s string) string {
-	result := ""
-	for _, c := range s {
-		if c >= 'A' && c <= 'Z' {
-			result += string(c + 32)
-		} else {
-			result += string(c)
+	removed := []string{}
+	now := time.Now()
+	for id, peer := range idx.Peers {
+		if now.Sub(peer.LastSeen) > timeout {
+			idx.removePeer(id)
+			removed = append(removed, id)
 		}
 	}
-	return result
+	return removed
 }
 
-// CleanupDeadPeers removes peers that haven't been seen for a while
-func (idx *Index) CleanupDeadPeers(timeout time.Duration) {
-	idx.mutex.Lock()
-	defer idx.mutex.Unlock()
+// DeadPeers returns the IDs of peers that haven't been seen for a while, leaving them in the index
+func (idx *Index) DeadPeers(timeout time.Duration) []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
 
+	dead := []string{}
 	now := time.Now()
 	for id, peer := range idx.Peers {
 		if now.Sub(peer.LastSeen) > timeout {
-			// Remove peer from file indices
-			for _, file := range peer.Files {
-				// Remove from FilesByName
-				if peerIDs, exists := idx.FilesByName[file.Name]; exists {
-					newPeerIDs := []string{}
-					for _, pid := range peerIDs {
-						if pid != id {
-							newPeerIDs = append(newPeerIDs, pid)
-						}
-					}
-					if len(newPeerIDs) > 0 {
-						idx.FilesByName[file.Name] = newPeerIDs
-					} else {
-						delete(idx.FilesByName, file.Name)
-					}
-				}
+			dead = append(dead, id)
+		}
+	}
+	return dead
+}
 
-				// Remove from FilesByHash
-				if peerIDs, exists := idx.FilesByHash[file.Hash]; exists {
-					newPeerIDs := []string{}
-					for _, pid := range peerIDs {
-						if pid != id {
-							newPeerIDs = append(newPeerIDs, pid)
-						}
-					}
-					if len(newPeerIDs) > 0 {
-						idx.FilesByHash[file.Hash] = newPeerIDs
-					} else {
-						delete(idx.FilesByHash, file.Hash)
-					}
-				}
-			}
+// LivePeers returns up to n peers seen within peerTimeout other than exclude, picked
+// at random and without their file lists
+func (idx *Index) LivePeers(exclude string, n int) []Peer {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
 
-			// Remove the peer
-			delete(idx.Peers, id)
+	peers := []Peer{}
+	for id, peer := range idx.Peers {
+		if id != exclude && time.Since(peer.LastSeen) < peerTimeout {
+			peers = append(peers, Peer{ID: peer.ID, Address: peer.Address, Port: peer.Port, LastSeen: peer.LastSeen})
 		}
 	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	return peers[:min(len(peers), n)]
 }
 
 // GetStats returns statistics about the index
@@ -284,33 +278,72 @@ func (idx *Index) GetStats() map[string]interface{} {
 	}
 }
 
+// adminPageSize is the number of files shown per page of the admin dashboard
+const adminPageSize = 50
+
+// bootstrapPeerCount is the number of peers handed out to a peer joining the DHT
+const bootstrapPeerCount = 20
+
+// peerTimeout is how long a peer may go without a heartbeat before it is dropped
+const peerTimeout = 5 * time.Minute
+
 // SuperPeer is the main server that coordinates the P2P network
 type SuperPeer struct {
-	index            *Index
-	registrationChan chan *Peer
-	searchChan       chan SearchRequest
-	unregisterChan   chan string
-	statsChan        chan chan map[string]interface{}
-	webPort          int
+	index      *Index
+	store      *Store      // Persistent copy of the index, nil when running in memory only
+	federation *Federation // Neighbouring super peers, nil when running standalone
+	raft       *RaftNode   // Replication across the super peer cluster, nil when running standalone
+	searchChan chan SearchRequest
+	statsChan  chan chan map[string]interface{}
+	apiPort    int
+	webPort    int
+	apiMux     *http.ServeMux  // Handlers for peers and other super peers
+	webMux     *http.ServeMux  // Handlers for the admin web UI
+	tlsConfig  *tls.Config     // Mutual TLS for every listener, nil when serving plain HTTP
+	transport  *http.Transport // Shared by the clients connecting to other super peers
+	users      *UserStore      // Accounts allowed into the admin UI and APIs
+	signatures *identity.Verifier
+	applyMutex sync.Mutex // Keeps the index log in the order changes are applied
 }
 
 // NewSuperPeer creates a new super peer
-func NewSuperPeer(webPort int) *SuperPeer {
+func NewSuperPeer(apiPort, webPort int) *SuperPeer {
 	return &SuperPeer{
-		index:            NewIndex(),
-		registrationChan: make(chan *Peer, 100),
-		searchChan:       make(chan SearchRequest, 100),
-		unregisterChan:   make(chan string, 100),
-		statsChan:        make(chan chan map[string]interface{}, 10),
-		webPort:          webPort,
+		index:      NewIndex(),
+		signatures: identity.NewVerifier(),
+		searchChan: make(chan SearchRequest, 100),
+		statsChan:  make(chan chan map[string]interface{}, 10),
+		apiPort:    apiPort,
+		webPort:    webPort,
+		apiMux:     http.NewServeMux(),
+		webMux:     http.NewServeMux(),
+		transport:  http.DefaultTransport.(*http.Transport).Clone(),
 	}
 }
 
-// Start starts the super peer services
-func (sp *SuperPeer) Start() {
-	// Start the registration service
-	go sp.registrationService()
+// LoadStore loads the index from dir and keeps it persisted there. The log is compacted
+// every snapshotInterval, or sooner once checkInterval finds it has grown enough.
+func (sp *SuperPeer) LoadStore(dir string, snapshotInterval, checkInterval time.Duration) error {
+	store, err := OpenStore(dir)
+	if err != nil {
+		return err
+	}
+	if err := store.Load(sp.index); err != nil {
+		return err
+	}
+
+	// Compact whatever was replayed right away
+	if err := store.Snapshot(sp.index); err != nil {
+		return err
+	}
+
+	sp.store = store
+	go sp.snapshotService(snapshotInterval, checkInterval)
+	return nil
+}
 
+// Start starts the super peer services and returns once they are running
+func (sp *SuperPeer) Start() {
 	// Start the heartbeat service
 	go sp.heartbeatService()
 
@@ -320,137 +353,215 @@ func (sp *SuperPeer) Start() {
 	// Start the web UI
 	go sp.startWebUI()
 
+	// Take part in leader elections
+	if sp.raft != nil {
+		sp.raft.Start()
+	}
+
 	// Log that we're starting
 	log.Println("Super peer started")
-
-	// Block forever
-	select {}
-}
-
-// registrationService handles peer registrations
-func (sp *SuperPeer) registrationService() {
-	for {
-		select {
-		case peer := <-sp.registrationChan:
-			sp.index.RegisterPeer(peer)
-			log.Printf("Registered peer %s with %d files\n", peer.ID, len(peer.Files))
-		case peerID := <-sp.unregisterChan:
-			sp.index.UnregisterPeer(peerID)
-			log.Printf("Unregistered peer %s\n", peerID)
-		}
-	}
 }
 
-// heartbeatService periodically cleans up dead peers
+// heartbeatService periodically cleans up dead peers. In a cluster only the leader
+// does so, the removals reach the other super peers through the log.
 func (sp *SuperPeer) heartbeatService() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
+	// Peers that expired while the super peer was down go right away
 	for {
+		sp.removeDeadPeers()
 		<-ticker.C
-		sp.index.CleanupDeadPeers(5 * time.Minute)
-		log.Println("Cleaned up dead peers")
 	}
 }
 
+// removeDeadPeers unregisters the peers not seen within peerTimeout through the log
+func (sp *SuperPeer) removeDeadPeers() {
+	if sp.raft != nil {
+		if _, isLeader := sp.raft.Leader(); !isLeader {
+			return
+		}
+	}
+
+	for _, peerID := range sp.index.DeadPeers(peerTimeout) {
+		if err := sp.commit(walRecord{Op: opUnregister, PeerID: peerID}); err != nil {
+			log.Printf("Failed to remove dead peer %s: %v", peerID, err)
+		}
+	}
+	log.Println("Cleaned up dead peers")
+}
+
 // startHTTPServer starts the HTTP server for peer communication
 func (sp *SuperPeer) startHTTPServer() {
 	// Register handler
-	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+	sp.apiMux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if sp.redirectToLeader(w, r) {
+			return
+		}
 
-		var peer Peer
-		err := json.NewDecoder(r.Body).Decode(&peer)
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		var peer Peer
+		if err := json.Unmarshal(body, &peer); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Only the holder of the key the ID is derived from may register it
+		publicKey, ok := sp.authenticatePeer(w, r, body, peer.ID)
+		if !ok {
+			return
+		}
+		peer.PublicKey = publicKey
 
 		// Get the peer's IP address
 		host, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err == nil {
 			peer.Address = host
 		}
+		if ban := sp.index.registrationBan(peer.ID, peer.Address); ban != nil {
+			http.Error(w, fmt.Sprintf("peer is banned: %s", ban.Reason), http.StatusForbidden)
+			return
+		}
 
-		sp.registrationChan <- &peer
+		// Registrations are only acknowledged once applied, and in a cluster replicated,
+		// so deltas the peer sends next find its files at the registered version
+		if err := sp.commit(walRecord{Op: opRegister, Peer: &peer}); err != nil {
+			http.Error(w, err.Error(), commitStatus(err))
+			return
+		}
+		log.Printf("Registered peer %s with %d files\n", peer.ID, len(peer.Files))
 		w.WriteHeader(http.StatusOK)
 	})
 
 	// Unregister handler
-	http.HandleFunc("/unregister", func(w http.ResponseWriter, r *http.Request) {
+	sp.apiMux.HandleFunc("/unregister", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if sp.redirectToLeader(w, r) {
+			return
+		}
 
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		var data struct {
 			PeerID string `json:"peerId"`
 		}
-		err := json.NewDecoder(r.Body).Decode(&data)
-		if err != nil {
+		if err := json.Unmarshal(body, &data); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if _, ok := sp.authenticatePeer(w, r, body, data.PeerID); !ok {
+			return
+		}
 
-		sp.unregisterChan <- data.PeerID
+		if err := sp.commit(walRecord{Op: opUnregister, PeerID: data.PeerID}); err != nil {
+			http.Error(w, err.Error(), commitStatus(err))
+			return
+		}
+		log.Printf("Unregistered peer %s\n", data.PeerID)
 		w.WriteHeader(http.StatusOK)
 	})
 
 	// Search handler
-	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+	sp.apiMux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if sp.redirectToLeader(w, r) {
+			return
+		}
 
-		var req SearchRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		var req SearchRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Results are limited to the files the requesting peer may access
+		req.Requester, err = sp.searchRequester(r, body, req.Requester)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
 
-		files, peers := sp.index.SearchByName(req.Query, req.Limit)
-		resp := SearchResponse{
-			Files: files,
-			Peers: peers,
+		resp, err := sp.search(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	})
 
+	// Incremental changes to the files a peer shares
+	sp.apiMux.HandleFunc("/update", sp.handleUpdate)
+
 	// Heartbeat handler
-	http.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+	sp.apiMux.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if sp.redirectToLeader(w, r) {
+			return
+		}
 
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		var data struct {
 			PeerID string `json:"peerId"`
 		}
-		err := json.NewDecoder(r.Body).Decode(&data)
-		if err != nil {
+		if err := json.Unmarshal(body, &data); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if _, ok := sp.authenticatePeer(w, r, body, data.PeerID); !ok {
+			return
+		}
+
+		// Tell peers we have forgotten so they register again
+		sp.index.mutex.RLock()
+		_, exists := sp.index.Peers[data.PeerID]
+		sp.index.mutex.RUnlock()
+		if !exists {
+			http.Error(w, "unknown peer", http.StatusNotFound)
+			return
+		}
 
 		// Update the peer's last seen time
-		sp.index.mutex.Lock()
-		if peer, exists := sp.index.Peers[data.PeerID]; exists {
-			peer.LastSeen = time.Now()
+		if err := sp.commit(walRecord{Op: opHeartbeat, PeerID: data.PeerID}); err != nil {
+			http.Error(w, err.Error(), commitStatus(err))
+			return
 		}
-		sp.index.mutex.Unlock()
 
 		w.WriteHeader(http.StatusOK)
 	})
 
 	// Stats handler
-	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+	sp.apiMux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -461,10 +572,40 @@ func (sp *SuperPeer) startHTTPServer() {
 		json.NewEncoder(w).Encode(stats)
 	})
 
+	// Bootstrap handler, hands out live peers for peers joining the DHT
+	sp.apiMux.HandleFunc("/bootstrap", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var data struct {
+			PeerID string `json:"peerId"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sp.index.LivePeers(data.PeerID, bootstrapPeerCount))
+	})
+
+	// Cluster status and replication between super peers
+	if sp.raft != nil {
+		sp.apiMux.HandleFunc("/cluster", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sp.raft.Status())
+		})
+		sp.raft.registerHandlers(sp.apiMux)
+	}
+
 	// Start the server
-	log.Println("Starting HTTP server on :8080")
+	addr := fmt.Sprintf(":%d", sp.apiPort)
+	log.Printf("Starting HTTP server on %s", addr)
 	go func() {
-		err := http.ListenAndServe(":8080", nil)
+		err := sp.listenAndServe(addr, sp.apiHandler())
 		if err != nil {
 			log.Fatalf("Failed to start HTTP server: %v", err)
 		}
@@ -473,7 +614,7 @@ func (sp *SuperPeer) startHTTPServer() {
 
 // Serve static files for the admin UI
 func (sp *SuperPeer) serveStaticFiles() {
-	http.HandleFunc("/admin/static/", func(w http.ResponseWriter, r *http.Request) {
+	sp.webMux.HandleFunc("/admin/static/", func(w http.ResponseWriter, r *http.Request) {
 		// Extract the file path from the URL
 		filePath := r.URL.Path[len("/admin/static/"):]
 
@@ -664,6 +805,89 @@ func (sp *SuperPeer) serveStaticFiles() {
 					font-size: 1rem;
 				}
 				
+				.button {
+					display: inline-block;
+					padding: 8px 14px;
+					background-color: var(--primary-color);
+					color: white;
+					border: none;
+					border-radius: 8px;
+					text-decoration: none;
+					cursor: pointer;
+				}
+				
+				.button.secondary {
+					background-color: var(--secondary-color);
+				}
+				
+				.button.danger {
+					background-color: var(--warning-color);
+				}
+				
+				.button.small {
+					padding: 4px 10px;
+					font-size: 0.85rem;
+				}
+				
+				.inline-form {
+					display: inline;
+				}
+				
+				.ban-form {
+					display: flex;
+					gap: 10px;
+					margin-bottom: 20px;
+				}
+				
+				.ban-form input, .ban-form select {
+					padding: 8px;
+					border: 1px solid var(--border-color);
+					border-radius: 8px;
+				}
+				
+				.ban-form input[name="value"] {
+					flex-grow: 1;
+				}
+				
+				.user-menu {
+					display: flex;
+					align-items: center;
+					gap: 10px;
+				}
+				
+				.login-card {
+					max-width: 420px;
+					margin: 60px auto;
+				}
+				
+				.login-form {
+					display: flex;
+					flex-direction: column;
+					gap: 12px;
+				}
+				
+				.login-form input {
+					padding: 12px;
+					border: 1px solid var(--border-color);
+					border-radius: 8px;
+					font-size: 1rem;
+				}
+				
+				.login-form button {
+					padding: 12px;
+					background-color: var(--primary-color);
+					color: white;
+					border: none;
+					border-radius: 8px;
+					cursor: pointer;
+					font-size: 1rem;
+				}
+				
+				.login-error {
+					color: var(--warning-color);
+					margin-bottom: 12px;
+				}
+				
 				.theme-toggle {
 					background: none;
 					border: none;
@@ -871,14 +1095,14 @@ func (sp *SuperPeer) startWebUI() {
 	sp.serveStaticFiles()
 
 	// API endpoint for stats
-	http.HandleFunc("/admin/api/stats", func(w http.ResponseWriter, r *http.Request) {
+	sp.webMux.HandleFunc("/admin/api/stats", sp.requireUser(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		stats := sp.index.GetStats()
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(stats)
-	})
+	}))
 
 	// API endpoint for peers
-	http.HandleFunc("/admin/api/peers", func(w http.ResponseWriter, r *http.Request) {
+	sp.webMux.HandleFunc("/admin/api/peers", sp.requireUser(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		sp.index.mutex.RLock()
 		peers := make([]*PeerWithStatus, 0, len(sp.index.Peers))
 		for _, peer := range sp.index.Peers {
@@ -894,7 +1118,7 @@ func (sp *SuperPeer) startWebUI() {
 
 			peers = append(peers, &PeerWithStatus{
 				Peer:        *peer,
-				IsOnline:    time.Since(peer.LastSeen) < 5*time.Minute,
+				IsOnline:    time.Since(peer.LastSeen) < peerTimeout,
 				Connections: connections,
 			})
 		}
@@ -902,7 +1126,7 @@ func (sp *SuperPeer) startWebUI() {
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(peers)
-	})
+	}))
 
 	// HTML template for the web UI
 	const htmlTemplate = `
@@ -920,7 +1144,11 @@ func (sp *SuperPeer) startWebUI() {
         <div class="card">
             <div class="header">
                 <h1><i class="fas fa-server"></i> P2P Super Peer Dashboard</h1>
-                <button id="theme-toggle" class="theme-toggle">🌙</button>
+                <div class="user-menu">
+                    {{with .User}}<span><i class="fas fa-user"></i> {{.Name}} ({{.Role}})</span>{{end}}
+                    <a href="/admin/logout" class="button secondary"><i class="fas fa-sign-out-alt"></i> Log out</a>
+                    <button id="theme-toggle" class="theme-toggle">🌙</button>
+                </div>
             </div>
             
             <div class="stats">
@@ -958,6 +1186,7 @@ func (sp *SuperPeer) startWebUI() {
                             <th>Files</th>
                             <th>Last Seen</th>
                             <th>Status</th>
+                            {{if $.CanOperate}}<th>Actions</th>{{end}}
                         </tr>
                     </thead>
                     <tbody>
@@ -975,10 +1204,28 @@ func (sp *SuperPeer) startWebUI() {
                                 <span class="badge offline"><i class="fas fa-circle"></i> Offline</span>
                                 {{end}}
                             </td>
+                            {{if $.CanOperate}}
+                            <td>
+                                <form class="inline-form" action="/admin/evict" method="post">
+                                    <input type="hidden" name="peerId" value="{{.ID}}">
+                                    <button type="submit" class="button small secondary" title="Remove from the index until it registers again"><i class="fas fa-user-minus"></i> Evict</button>
+                                </form>
+                                <form class="inline-form" action="/admin/ban" method="post">
+                                    <input type="hidden" name="kind" value="peer">
+                                    <input type="hidden" name="value" value="{{.ID}}">
+                                    <button type="submit" class="button small danger"><i class="fas fa-ban"></i> Ban ID</button>
+                                </form>
+                                <form class="inline-form" action="/admin/ban" method="post">
+                                    <input type="hidden" name="kind" value="cidr">
+                                    <input type="hidden" name="value" value="{{.Address}}">
+                                    <button type="submit" class="button small danger"><i class="fas fa-ban"></i> Ban IP</button>
+                                </form>
+                            </td>
+                            {{end}}
                         </tr>
                         {{else}}
                         <tr>
-                            <td colspan="6" class="empty-state">No peers connected</td>
+                            <td colspan="{{if .CanOperate}}7{{else}}6{{end}}" class="empty-state">No peers connected</td>
                         </tr>
                         {{end}}
                     </tbody>
@@ -1001,6 +1248,7 @@ func (sp *SuperPeer) startWebUI() {
                             <th>Size</th>
                             <th>Hash</th>
                             <th>Available From</th>
+                            {{if $.CanOperate}}<th>Actions</th>{{end}}
                         </tr>
                     </thead>
                     <tbody>
@@ -1012,10 +1260,19 @@ func (sp *SuperPeer) startWebUI() {
                             <td>
                                 <span class="badge">{{len .PeerIDs}} peers</span>
                             </td>
+                            {{if $.CanOperate}}
+                            <td>
+                                <form class="inline-form" action="/admin/ban" method="post">
+                                    <input type="hidden" name="kind" value="hash">
+                                    <input type="hidden" name="value" value="{{.Hash}}">
+                                    <button type="submit" class="button small danger" title="Hide this content from search results"><i class="fas fa-eye-slash"></i> Hide</button>
+                                </form>
+                            </td>
+                            {{end}}
                         </tr>
                         {{else}}
                         <tr>
-                            <td colspan="4" class="empty-state">
+                            <td colspan="{{if .CanOperate}}5{{else}}4{{end}}" class="empty-state">
                                 {{if .SearchQuery}}
                                 No files found matching "{{.SearchQuery}}"
                                 {{else}}
@@ -1026,6 +1283,67 @@ func (sp *SuperPeer) startWebUI() {
                         {{end}}
                     </tbody>
                 </table>
+                <div class="section-header">
+                    <span>Showing {{len .Files}} of {{.TotalMatches}} files</span>
+                    <span>
+                        {{if not .IsFirstPage}}<a href="/admin?query={{.SearchQuery}}" class="button secondary"><i class="fas fa-angle-double-left"></i> First page</a>{{end}}
+                        {{if .NextPage}}<a href="{{.NextPage}}" class="button"><i class="fas fa-angle-right"></i> Next page</a>{{end}}
+                    </span>
+                </div>
+            </div>
+            
+            <div class="section">
+                <div class="section-header">
+                    <h2><i class="fas fa-ban"></i> Bans</h2>
+                </div>
+                {{if .CanOperate}}
+                <form class="ban-form" action="/admin/ban" method="post">
+                    <select name="kind">
+                        <option value="peer">Peer ID</option>
+                        <option value="cidr">IP range</option>
+                        <option value="hash">File hash</option>
+                    </select>
+                    <input type="text" name="value" placeholder="peer-..., 10.0.0.0/8 or SHA-256 hash" required>
+                    <input type="text" name="reason" placeholder="Reason">
+                    <button type="submit" class="button danger"><i class="fas fa-ban"></i> Ban</button>
+                </form>
+                {{end}}
+                <table>
+                    <thead>
+                        <tr>
+                            <th>Kind</th>
+                            <th>Value</th>
+                            <th>Reason</th>
+                            <th>By</th>
+                            <th>Created</th>
+                            {{if .CanOperate}}<th>Actions</th>{{end}}
+                        </tr>
+                    </thead>
+                    <tbody>
+                        {{range .Bans}}
+                        <tr>
+                            <td><span class="badge">{{.Kind}}</span></td>
+                            <td>{{.Value}}</td>
+                            <td>{{.Reason}}</td>
+                            <td>{{.By}}</td>
+                            <td>{{formatTime .Created}}</td>
+                            {{if $.CanOperate}}
+                            <td>
+                                <form class="inline-form" action="/admin/unban" method="post">
+                                    <input type="hidden" name="kind" value="{{.Kind}}">
+                                    <input type="hidden" name="value" value="{{.Value}}">
+                                    <button type="submit" class="button small secondary"><i class="fas fa-undo"></i> Lift</button>
+                                </form>
+                            </td>
+                            {{end}}
+                        </tr>
+                        {{else}}
+                        <tr>
+                            <td colspan="{{if .CanOperate}}6{{else}}5{{end}}" class="empty-state">No bans</td>
+                        </tr>
+                        {{end}}
+                    </tbody>
+                </table>
             </div>
         </div>
     </div>
@@ -1065,7 +1383,7 @@ func (sp *SuperPeer) startWebUI() {
 	}
 
 	// Handler for the main page
-	http.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+	sp.webMux.HandleFunc("/admin", sp.requireUser(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/admin" {
 			http.NotFound(w, r)
 			return
@@ -1080,51 +1398,30 @@ func (sp *SuperPeer) startWebUI() {
 		for _, peer := range sp.index.Peers {
 			peers = append(peers, &PeerWithStatus{
 				Peer:     *peer,
-				IsOnline: time.Since(peer.LastSeen) < 5*time.Minute,
+				IsOnline: time.Since(peer.LastSeen) < peerTimeout,
 			})
 		}
 		sp.index.mutex.RUnlock()
 
 		// Get search query
 		searchQuery := r.URL.Query().Get("query")
+		cursor := r.URL.Query().Get("cursor")
+
+		// Get one page of files, all files when there is no query
+		result, err := sp.index.Search(SearchRequest{
+			Query:        searchQuery,
+			Limit:        adminPageSize,
+			Cursor:       cursor,
+			unrestricted: true,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		// Get files
-		var files []File
-		if searchQuery != "" {
-			fileList, _ := sp.index.SearchByName(searchQuery, 100)
-			files = fileList
-		} else {
-			// Get all files
-			sp.index.mutex.RLock()
-			uniqueFiles := make(map[string]File)
-			for name, peerIDs := range sp.index.FilesByName {
-				file := File{
-					Name:    name,
-					PeerIDs: peerIDs,
-				}
-
-				// Get hash and size from first peer that has this file
-				if len(peerIDs) > 0 {
-					firstPeerID := peerIDs[0]
-					if peer, exists := sp.index.Peers[firstPeerID]; exists {
-						for _, peerFile := range peer.Files {
-							if peerFile.Name == name {
-								file.Hash = peerFile.Hash
-								file.Size = peerFile.Size
-								break
-							}
-						}
-					}
-				}
-
-				uniqueFiles[name] = file
-			}
-			sp.index.mutex.RUnlock()
-
-			files = make([]File, 0, len(uniqueFiles))
-			for _, file := range uniqueFiles {
-				files = append(files, file)
-			}
+		nextPage := ""
+		if result.NextCursor != "" {
+			nextPage = "/admin?" + url.Values{"query": {searchQuery}, "cursor": {result.NextCursor}}.Encode()
 		}
 
 		// Prepare template data
@@ -1135,13 +1432,25 @@ func (sp *SuperPeer) startWebUI() {
 			Peers         []*PeerWithStatus
 			Files         []File
 			SearchQuery   string
+			TotalMatches  int
+			NextPage      string
+			IsFirstPage   bool
+			User          *User
+			CanOperate    bool
+			Bans          []*Ban
 		}{
 			PeerCount:     stats["peerCount"].(int),
 			UniqueFiles:   stats["uniqueFiles"].(int),
 			TotalFileRefs: stats["totalFileRefs"].(int),
 			Peers:         peers,
-			Files:         files,
+			Files:         result.Files,
 			SearchQuery:   searchQuery,
+			TotalMatches:  result.Total,
+			NextPage:      nextPage,
+			IsFirstPage:   cursor == "",
+			User:          userFrom(r),
+			CanOperate:    roleRank[userFrom(r).Role] >= roleRank[roleOperator],
+			Bans:          sp.index.Bans(),
 		}
 
 		// Execute the template
@@ -1150,19 +1459,27 @@ func (sp *SuperPeer) startWebUI() {
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to render template: %v", err), http.StatusInternalServerError)
 		}
-	})
+	}))
 
 	// Handler for searching files
-	http.HandleFunc("/admin/search", func(w http.ResponseWriter, r *http.Request) {
+	sp.webMux.HandleFunc("/admin/search", sp.requireUser(roleViewer, func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query().Get("query")
-		http.Redirect(w, r, fmt.Sprintf("/admin?query=%s", query), http.StatusSeeOther)
-	})
+		http.Redirect(w, r, "/admin?"+url.Values{"query": {query}}.Encode(), http.StatusSeeOther)
+	}))
+
+	// Logging in and out
+	sp.webMux.HandleFunc("/admin/login", sp.handleLogin)
+	sp.webMux.HandleFunc("/admin/logout", sp.handleLogout)
+
+	// Evicting and banning peers and hiding files
+	sp.registerBanHandlers()
 
 	// Start the web server
 	addr := fmt.Sprintf(":%d", sp.webPort)
-	log.Printf("Starting admin web UI on http://localhost:%d/admin", sp.webPort)
+	log.Printf("Starting admin web UI on %s://localhost:%d/admin", sp.scheme(), sp.webPort)
 	go func() {
-		err := http.ListenAndServe(addr, nil)
+		// Over TLS only admin certificates may open the dashboard
+		err := sp.listenAndServe(addr, sp.requireRole(sp.webMux, roleAdmin))
 		if err != nil {
 			log.Fatalf("Failed to start web UI: %v", err)
 		}
@@ -1186,8 +1503,98 @@ func contains(slice []string, str string) bool {
 	return false
 }
 
+// Helper function to split a comma separated list, dropping empty entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, strings.TrimSuffix(item, "/"))
+		}
+	}
+	return items
+}
+
+// Helper function to remove every occurrence of a string from a slice
+func removeString(slice []string, str string) []string {
+	result := []string{}
+	for _, item := range slice {
+		if item != str {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
 func main() {
+	// Certificate and user management run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err := runCA(os.Args[2:]); err != nil {
+			log.Fatalf("ca: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		if err := runUser(os.Args[2:]); err != nil {
+			log.Fatalf("user: %v", err)
+		}
+		return
+	}
+
+	// Parse command line flags
+	apiPort := flag.Int("port", 8080, "Port for the peer API")
+	webPort := flag.Int("webport", 8085, "Port for the admin web UI")
+	federate := flag.String("federate", "", "Comma separated URLs of neighbouring super peers to forward searches to")
+	dataDir := flag.String("data", "./superpeer-data", "Directory for the persistent index (empty keeps it in memory only)")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute, "How often the index log is compacted into a snapshot")
+	snapshotCheck := flag.Duration("snapshot-check", 10*time.Second, "How often the index log is checked for having grown enough to be compacted early")
+	nodeID := flag.String("id", "", "ID of this super peer in the cluster")
+	cluster := flag.String("cluster", "", "Comma separated id=url API addresses of every super peer in the cluster, including this one (requires -tls-cert)")
+	tlsCert := flag.String("tls-cert", "", "Super peer certificate issued with 'ca issue -role super-peer', enables mutual TLS on every listener")
+	tlsKey := flag.String("tls-key", "", "Private key of the TLS certificate")
+	tlsCA := flag.String("tls-ca", "./ca/"+caCertFileName, "CA certificate peers, super peers and admins must present a certificate from")
+	usersFile := flag.String("users", defaultUsersFile, "Users allowed into the admin UI, managed with 'user add' and 'user token'")
+	flag.Parse()
+
 	fmt.Println("Starting P2P Super Peer...")
-	sp := NewSuperPeer(8085)
+	sp := NewSuperPeer(*apiPort, *webPort)
+	users, err := OpenUserStore(*usersFile)
+	if err != nil {
+		log.Fatalf("Failed to load admin users: %v", err)
+	}
+	if len(users.users) == 0 {
+		log.Printf("No admin users in %s, create one with: %s user add -users %s -name NAME -role admin", *usersFile, os.Args[0], *usersFile)
+	}
+	sp.users = users
+	if *tlsCert != "" {
+		if err := sp.EnableTLS(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		log.Printf("Requiring certificates from the CA in %s", *tlsCA)
+	}
+	if *federate != "" {
+		sp.federation = NewFederation(splitList(*federate), sp.transport)
+		log.Printf("Federating searches with %v", sp.federation.neighbours)
+	}
+	if *dataDir != "" {
+		if *snapshotCheck <= 0 {
+			log.Fatalf("-snapshot-check must be positive")
+		}
+		if err := sp.LoadStore(*dataDir, *snapshotInterval, *snapshotCheck); err != nil {
+			log.Fatalf("Failed to open index store: %v", err)
+		}
+	}
+	if *cluster != "" {
+		members, err := parseCluster(*cluster)
+		if err != nil {
+			log.Fatalf("Invalid cluster: %v", err)
+		}
+		if err := sp.JoinCluster(*nodeID, members, *dataDir); err != nil {
+			log.Fatalf("Failed to join cluster: %v", err)
+		}
+		log.Printf("Replicating the index across cluster %v as %s", members, *nodeID)
+	}
 	sp.Start()
+
+	// Block forever
+	select {}
 }
@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// raftHeartbeatInterval is how often the leader contacts every follower
+	raftHeartbeatInterval = 100 * time.Millisecond
+
+	// raftElectionTimeout is the minimum time without a leader before a follower
+	// starts an election, the actual timeout is randomised up to twice this
+	raftElectionTimeout = 500 * time.Millisecond
+
+	// raftRPCTimeout bounds a single request between cluster members
+	raftRPCTimeout = 500 * time.Millisecond
+
+	// raftProposeTimeout bounds how long a change may take to commit
+	raftProposeTimeout = 3 * time.Second
+
+	// raftCompactEvery is the number of applied log entries kept before they are discarded
+	raftCompactEvery = 1000
+)
+
+// errNotLeader is returned when a change is proposed to a node that is not the leader
+var errNotLeader = errors.New("not the cluster leader")
+
+// errClusterNeedsTLS is returned when joining a cluster without mutual TLS
+var errClusterNeedsTLS = errors.New("a cluster requires TLS so only super peers can call the raft RPCs, set -tls-cert and -tls-key")
+
+// raftRole is the role a node currently plays in the cluster
+type raftRole int
+
+const (
+	roleFollower raftRole = iota
+	roleCandidate
+	roleLeader
+)
+
+func (r raftRole) String() string {
+	switch r {
+	case roleLeader:
+		return "leader"
+	case roleCandidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// raftEntry is a replicated change to the index, an entry without an operation is a no-op
+type raftEntry struct {
+	Index   uint64    `json:"index"`
+	Term    uint64    `json:"term"`
+	Command walRecord `json:"command"`
+}
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type voteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+type appendRequest struct {
+	Term         uint64      `json:"term"`
+	LeaderID     string      `json:"leaderId"`
+	PrevLogIndex uint64      `json:"prevLogIndex"`
+	PrevLogTerm  uint64      `json:"prevLogTerm"`
+	Entries      []raftEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leaderCommit"`
+}
+
+type appendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"lastIndex"` // The follower's last log index, used to skip back quickly
+}
+
+type snapshotRequest struct {
+	Term      uint64          `json:"term"`
+	LeaderID  string          `json:"leaderId"`
+	LastIndex uint64          `json:"lastIndex"`
+	LastTerm  uint64          `json:"lastTerm"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type snapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// raftPersistentState is the part of the node state that must survive restarts,
+// the log entries after SnapshotIndex are kept in a separate file
+type raftPersistentState struct {
+	CurrentTerm   uint64 `json:"currentTerm"`
+	VotedFor      string `json:"votedFor"`
+	SnapshotIndex uint64 `json:"snapshotIndex"` // Last entry covered by the persisted index
+	SnapshotTerm  uint64 `json:"snapshotTerm"`
+}
+
+// RaftNode replicates index changes across a cluster of super peers with Raft.
+// Committed changes are handed to apply in log order on every node.
+type RaftNode struct {
+	id         string
+	urls       map[string]string // Client facing base URL of every member, by node ID
+	dataDir    string            // Directory holding the persistent state and log, empty to keep them in memory
+	httpClient *http.Client
+
+	apply    func(walRecord) error   // Applies a committed change to the local index, an error rejects it
+	snapshot func() ([]byte, error)  // Encodes the local index
+	restore  func(data []byte) error // Replaces the local index with a leader's snapshot
+
+	mutex            sync.Mutex
+	role             raftRole
+	currentTerm      uint64
+	votedFor         string
+	leaderID         string
+	entries          []raftEntry // Log entries after snapshotIndex
+	snapshotIndex    uint64      // Last log index covered by the local state rather than entries
+	snapshotTerm     uint64
+	commitIndex      uint64
+	lastApplied      uint64
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+	applied          chan struct{}               // Closed and replaced whenever entries are applied
+	proposals        map[uint64]*proposalOutcome // Outcome of the entries Propose waits for, by log index
+
+	logFile    *os.File // Log entries after snapshotIndex, one per line
+	savedIndex uint64   // Last log index durably written
+	logStale   bool     // Whether the log file holds entries that were dropped and has to be rewritten
+
+	// Leader state, reset on every election won
+	nextIndex    map[string]uint64
+	matchIndex   map[string]uint64
+	inFlight     map[string]bool
+	probed       map[string]bool // Whether the follower answered since this node became leader
+	needSnapshot map[string]bool // Whether the follower has to be sent the full index
+}
+
+// proposalOutcome is how an entry proposed on this node fared once its index was applied
+type proposalOutcome struct {
+	applied bool
+	term    uint64 // Term of the entry applied at the index, another term means it was overwritten
+	err     error  // Returned by apply
+}
+
+// NewRaftNode creates a cluster member. urls must contain every member, including this node.
+// The term, vote and log are kept in dataDir, or in memory only when it is empty. A restarted
+// node resumes after the snapshot index it saved, whose state the caller has already loaded.
+func NewRaftNode(id string, urls map[string]string, dataDir string, apply func(walRecord) error, snapshot func() ([]byte, error), restore func([]byte) error) (*RaftNode, error) {
+	if _, exists := urls[id]; !exists {
+		return nil, fmt.Errorf("node %s is not part of the cluster", id)
+	}
+
+	r := &RaftNode{
+		id:         id,
+		urls:       urls,
+		dataDir:    dataDir,
+		httpClient: &http.Client{Timeout: raftRPCTimeout},
+		apply:      apply,
+		snapshot:   snapshot,
+		restore:    restore,
+		applied:    make(chan struct{}),
+		proposals:  make(map[uint64]*proposalOutcome),
+	}
+
+	if dataDir != "" {
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// load restores the persistent state and log entries from the data directory
+func (r *RaftNode) load() error {
+	data, err := os.ReadFile(filepath.Join(r.dataDir, raftStateFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var state raftPersistentState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("corrupt raft state: %v", err)
+		}
+		r.currentTerm = state.CurrentTerm
+		r.votedFor = state.VotedFor
+		r.snapshotIndex = state.SnapshotIndex
+		r.snapshotTerm = state.SnapshotTerm
+		r.commitIndex = state.SnapshotIndex
+		r.lastApplied = state.SnapshotIndex
+	}
+
+	file, err := os.Open(filepath.Join(r.dataDir, raftLogFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				if len(line) > 0 {
+					log.Printf("Discarding incomplete entry at the end of the raft log")
+				}
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+
+			var entry raftEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				log.Printf("Discarding corrupt entry in the raft log: %v", err)
+				break
+			}
+			// Entries may already be covered by a snapshot saved just before the log was rewritten
+			if entry.Index <= r.snapshotIndex {
+				continue
+			}
+			if entry.Index != r.lastIndex()+1 {
+				log.Printf("Discarding raft log entries from index %d, expected %d", entry.Index, r.lastIndex()+1)
+				break
+			}
+			r.entries = append(r.entries, entry)
+		}
+		file.Close()
+	}
+
+	// Start from a clean file holding exactly the loaded entries
+	r.logStale = true
+	return r.persistLog()
+}
+
+// Start runs the election and replication timers
+func (r *RaftNode) Start() {
+	r.mutex.Lock()
+	r.resetElectionTimer()
+	r.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(raftHeartbeatInterval / 2)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			r.tick()
+		}
+	}()
+}
+
+// tick sends heartbeats as leader or starts an election once the leader has gone quiet
+func (r *RaftNode) tick() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	if r.role == roleLeader {
+		if now.Sub(r.lastBroadcast) >= raftHeartbeatInterval {
+			r.broadcast()
+		}
+		return
+	}
+	if now.After(r.electionDeadline) {
+		r.startElection()
+	}
+}
+
+// Status describes the node for monitoring
+func (r *RaftNode) Status() map[string]interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return map[string]interface{}{
+		"id":          r.id,
+		"role":        r.role.String(),
+		"term":        r.currentTerm,
+		"leader":      r.leaderID,
+		"leaderUrl":   r.urls[r.leaderID],
+		"commitIndex": r.commitIndex,
+		"lastApplied": r.lastApplied,
+	}
+}
+
+// Leader returns the client facing URL of the current leader and whether this node is it
+func (r *RaftNode) Leader() (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.urls[r.leaderID], r.role == roleLeader
+}
+
+// Propose replicates a change and waits until it has been applied on this node.
+// It returns the error apply rejected the change with.
+func (r *RaftNode) Propose(command walRecord) error {
+	r.mutex.Lock()
+	if r.role != roleLeader {
+		r.mutex.Unlock()
+		return errNotLeader
+	}
+
+	term := r.currentTerm
+	index := r.lastIndex() + 1
+	r.entries = append(r.entries, raftEntry{Index: index, Term: term, Command: command})
+	outcome := &proposalOutcome{}
+	r.proposals[index] = outcome
+	defer func() {
+		r.mutex.Lock()
+		delete(r.proposals, index)
+		r.mutex.Unlock()
+	}()
+	if err := r.persistLog(); err != nil {
+		log.Printf("Failed to write raft log: %v", err)
+	}
+	r.advanceCommit()
+	r.broadcast()
+	r.mutex.Unlock()
+
+	deadline := time.After(raftProposeTimeout)
+	for {
+		r.mutex.Lock()
+		if outcome.applied {
+			r.mutex.Unlock()
+			if outcome.term != term {
+				return errNotLeader
+			}
+			return outcome.err
+		}
+		if r.lastApplied >= index {
+			// Replaced by a snapshot, the change may or may not be part of it
+			r.mutex.Unlock()
+			return errNotLeader
+		}
+		if r.currentTerm != term || r.role != roleLeader {
+			r.mutex.Unlock()
+			return errNotLeader
+		}
+		applied := r.applied
+		r.mutex.Unlock()
+
+		select {
+		case <-applied:
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for the cluster to commit")
+		}
+	}
+}
+
+// lastIndex returns the index of the last log entry, the caller must hold the lock
+func (r *RaftNode) lastIndex() uint64 {
+	return r.snapshotIndex + uint64(len(r.entries))
+}
+
+// termAt returns the term of the entry at index, the caller must hold the lock
+func (r *RaftNode) termAt(index uint64) uint64 {
+	if index <= r.snapshotIndex {
+		if index == r.snapshotIndex {
+			return r.snapshotTerm
+		}
+		return 0
+	}
+	if index > r.lastIndex() {
+		return 0
+	}
+	return r.entries[index-r.snapshotIndex-1].Term
+}
+
+// resetElectionTimer picks a new random election deadline, the caller must hold the lock
+func (r *RaftNode) resetElectionTimer() {
+	timeout := raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+// persist saves the current term, vote and snapshot index, the caller must hold the lock
+func (r *RaftNode) persist() {
+	if r.dataDir == "" {
+		return
+	}
+
+	data, _ := json.Marshal(raftPersistentState{
+		CurrentTerm:   r.currentTerm,
+		VotedFor:      r.votedFor,
+		SnapshotIndex: r.snapshotIndex,
+		SnapshotTerm:  r.snapshotTerm,
+	})
+	if err := writeFileSync(filepath.Join(r.dataDir, raftStateFileName), data); err != nil {
+		log.Printf("Failed to save raft state: %v", err)
+	}
+}
+
+// persistLog durably writes the log entries that are not on disk yet, rewriting the
+// file when entries on it were dropped. The caller must hold the lock.
+func (r *RaftNode) persistLog() error {
+	if r.dataDir == "" {
+		r.savedIndex = r.lastIndex()
+		return nil
+	}
+
+	if r.logStale || r.logFile == nil {
+		var buf bytes.Buffer
+		for _, entry := range r.entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			buf.Write(append(data, '\n'))
+		}
+
+		path := filepath.Join(r.dataDir, raftLogFileName)
+		if err := writeFileSync(path, buf.Bytes()); err != nil {
+			return err
+		}
+		if r.logFile != nil {
+			r.logFile.Close()
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			r.logFile = nil
+			return err
+		}
+		r.logFile = file
+		r.logStale = false
+		r.savedIndex = r.lastIndex()
+		return nil
+	}
+
+	if r.savedIndex >= r.lastIndex() {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, entry := range r.entries[r.savedIndex-r.snapshotIndex:] {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	if _, err := r.logFile.Write(buf.Bytes()); err != nil {
+		// A partial write leaves a torn entry, so start over from a clean file
+		r.logStale = true
+		return err
+	}
+	if err := r.logFile.Sync(); err != nil {
+		r.logStale = true
+		return err
+	}
+	r.savedIndex = r.lastIndex()
+	return nil
+}
+
+// truncateLog drops the entries from index on, the caller must hold the lock
+func (r *RaftNode) truncateLog(index uint64) {
+	r.entries = r.entries[:index-r.snapshotIndex-1]
+	if r.savedIndex >= index {
+		r.savedIndex = index - 1
+		r.logStale = true
+	}
+}
+
+// writeFileSync atomically replaces path with data, syncing it to disk first
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// becomeFollower steps down, adopting a newer term if there is one. The caller must hold the lock.
+func (r *RaftNode) becomeFollower(term uint64, leaderID string) {
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		r.persist()
+	}
+	if r.role != roleFollower {
+		log.Printf("Raft node %s is now a follower in term %d", r.id, r.currentTerm)
+	}
+	r.role = roleFollower
+	if leaderID != "" {
+		r.leaderID = leaderID
+	}
+	r.resetElectionTimer()
+}
+
+// startElection asks every other member for its vote, the caller must hold the lock
+func (r *RaftNode) startElection() {
+	r.role = roleCandidate
+	r.currentTerm++
+	r.votedFor = r.id
+	r.leaderID = ""
+	r.persist()
+	r.resetElectionTimer()
+
+	term := r.currentTerm
+	req := voteRequest{
+		Term:         term,
+		CandidateID:  r.id,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.termAt(r.lastIndex()),
+	}
+
+	votes := 1
+	if votes > len(r.urls)/2 {
+		r.becomeLeader()
+		return
+	}
+
+	for id := range r.urls {
+		if id == r.id {
+			continue
+		}
+		go func(id string) {
+			var resp voteResponse
+			if err := r.call(id, "/raft/vote", req, &resp); err != nil {
+				return
+			}
+
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+
+			if resp.Term > r.currentTerm {
+				r.becomeFollower(resp.Term, "")
+				return
+			}
+			if r.role != roleCandidate || r.currentTerm != term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes > len(r.urls)/2 {
+				r.becomeLeader()
+			}
+		}(id)
+	}
+}
+
+// becomeLeader takes over the cluster after winning an election, the caller must hold the lock
+func (r *RaftNode) becomeLeader() {
+	log.Printf("Raft node %s is now the leader in term %d", r.id, r.currentTerm)
+
+	r.role = roleLeader
+	r.leaderID = r.id
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	r.inFlight = make(map[string]bool)
+	r.probed = make(map[string]bool)
+	r.needSnapshot = make(map[string]bool)
+	for id := range r.urls {
+		r.nextIndex[id] = r.lastIndex() + 1
+	}
+
+	// A no-op entry from the new term lets earlier entries commit
+	r.entries = append(r.entries, raftEntry{Index: r.lastIndex() + 1, Term: r.currentTerm})
+	if err := r.persistLog(); err != nil {
+		log.Printf("Failed to write raft log: %v", err)
+	}
+	r.advanceCommit()
+	r.broadcast()
+}
+
+// broadcast replicates the log to every follower without a request outstanding.
+// The caller must hold the lock.
+func (r *RaftNode) broadcast() {
+	r.lastBroadcast = time.Now()
+	for id := range r.urls {
+		if id != r.id && !r.inFlight[id] {
+			r.inFlight[id] = true
+			go r.replicate(id)
+		}
+	}
+}
+
+// replicate sends a follower the entries it is missing, or the whole index if it is too far behind
+func (r *RaftNode) replicate(id string) {
+	r.mutex.Lock()
+	if r.role != roleLeader {
+		r.inFlight[id] = false
+		r.mutex.Unlock()
+		return
+	}
+	term := r.currentTerm
+
+	if r.needSnapshot[id] || r.nextIndex[id] <= r.snapshotIndex {
+		data, err := r.snapshot()
+		if err != nil {
+			r.inFlight[id] = false
+			r.mutex.Unlock()
+			log.Printf("Failed to snapshot index for %s: %v", id, err)
+			return
+		}
+		req := snapshotRequest{
+			Term:      term,
+			LeaderID:  r.id,
+			LastIndex: r.lastApplied,
+			LastTerm:  r.termAt(r.lastApplied),
+			Data:      data,
+		}
+		r.mutex.Unlock()
+
+		var resp snapshotResponse
+		err = r.call(id, "/raft/snapshot", req, &resp)
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.inFlight[id] = false
+		if err != nil || r.role != roleLeader || r.currentTerm != term {
+			return
+		}
+		if resp.Term > r.currentTerm {
+			r.becomeFollower(resp.Term, "")
+			return
+		}
+		r.needSnapshot[id] = false
+		r.probed[id] = true
+		r.matchIndex[id] = max(r.matchIndex[id], req.LastIndex)
+		r.nextIndex[id] = req.LastIndex + 1
+		return
+	}
+
+	prevIndex := r.nextIndex[id] - 1
+	req := appendRequest{
+		Term:         term,
+		LeaderID:     r.id,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  r.termAt(prevIndex),
+		LeaderCommit: r.commitIndex,
+	}
+	// Only probe until the follower has answered once in this term
+	if r.probed[id] {
+		req.Entries = append([]raftEntry{}, r.entries[prevIndex-r.snapshotIndex:]...)
+	}
+	r.mutex.Unlock()
+
+	var resp appendResponse
+	err := r.call(id, "/raft/append", req, &resp)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.inFlight[id] = false
+	if err != nil || r.role != roleLeader || r.currentTerm != term {
+		return
+	}
+	if resp.Term > r.currentTerm {
+		r.becomeFollower(resp.Term, "")
+		return
+	}
+
+	// A follower without any log, such as a new member or one running without a
+	// data directory, may hold an unrelated index and gets the leader's full index first
+	if resp.LastIndex == 0 && (!r.probed[id] || r.lastApplied > 0) {
+		r.needSnapshot[id] = true
+	}
+	r.probed[id] = true
+
+	if resp.Success {
+		match := prevIndex + uint64(len(req.Entries))
+		r.matchIndex[id] = max(r.matchIndex[id], match)
+		r.nextIndex[id] = match + 1
+		r.advanceCommit()
+	} else {
+		r.nextIndex[id] = max(1, min(r.nextIndex[id]-1, resp.LastIndex+1))
+	}
+
+	// Keep going while the follower is behind
+	if r.nextIndex[id] <= r.lastIndex() || r.needSnapshot[id] {
+		r.inFlight[id] = true
+		go r.replicate(id)
+	}
+}
+
+// advanceCommit commits the entries stored on a majority of members, the caller must hold the lock
+func (r *RaftNode) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		// Only entries from the current term are committed by counting replicas
+		if r.termAt(n) != r.currentTerm {
+			break
+		}
+
+		// The leader only counts itself once the entry is on its own disk
+		replicas := 0
+		if r.savedIndex >= n {
+			replicas = 1
+		}
+		for id, match := range r.matchIndex {
+			if id != r.id && match >= n {
+				replicas++
+			}
+		}
+		if replicas > len(r.urls)/2 {
+			r.commitIndex = n
+			break
+		}
+	}
+	r.applyCommitted()
+}
+
+// applyCommitted hands committed entries to the index in order, the caller must hold the lock
+func (r *RaftNode) applyCommitted() {
+	if r.lastApplied >= r.commitIndex {
+		return
+	}
+
+	for r.lastApplied < r.commitIndex {
+		r.lastApplied++
+		entry := r.entries[r.lastApplied-r.snapshotIndex-1]
+		var err error
+		if entry.Command.Op != "" {
+			err = r.apply(entry.Command)
+		}
+		if outcome := r.proposals[r.lastApplied]; outcome != nil {
+			*outcome = proposalOutcome{applied: true, term: entry.Term, err: err}
+		}
+	}
+	close(r.applied)
+	r.applied = make(chan struct{})
+
+	// The applied state stands in for old entries, followers that need them get a snapshot
+	if applied := r.lastApplied - r.snapshotIndex; applied > raftCompactEvery {
+		r.snapshotTerm = r.termAt(r.lastApplied)
+		r.entries = append([]raftEntry{}, r.entries[applied:]...)
+		r.snapshotIndex = r.lastApplied
+		r.persist()
+		r.logStale = true
+		if err := r.persistLog(); err != nil {
+			log.Printf("Failed to write raft log: %v", err)
+		}
+	}
+}
+
+// call sends an RPC to another member
+func (r *RaftNode) call(id, path string, req, resp interface{}) error {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := r.httpClient.Post(r.urls[id]+path, "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", path, httpResp.StatusCode)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// handleVote answers a candidate's request for a vote
+func (r *RaftNode) handleVote(req voteRequest) voteResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if req.Term > r.currentTerm {
+		r.becomeFollower(req.Term, "")
+	}
+	if req.Term < r.currentTerm {
+		return voteResponse{Term: r.currentTerm}
+	}
+
+	// Only vote for candidates whose log is at least as complete as ours
+	lastTerm := r.termAt(r.lastIndex())
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= r.lastIndex())
+	if (r.votedFor == "" || r.votedFor == req.CandidateID) && upToDate {
+		r.votedFor = req.CandidateID
+		r.persist()
+		r.resetElectionTimer()
+		return voteResponse{Term: r.currentTerm, VoteGranted: true}
+	}
+	return voteResponse{Term: r.currentTerm}
+}
+
+// handleAppend stores entries sent by the leader
+func (r *RaftNode) handleAppend(req appendRequest) appendResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if req.Term < r.currentTerm {
+		return appendResponse{Term: r.currentTerm, LastIndex: r.lastIndex()}
+	}
+	r.becomeFollower(req.Term, req.LeaderID)
+
+	// Reject entries that do not follow on from our log
+	if req.PrevLogIndex > r.lastIndex() {
+		return appendResponse{Term: r.currentTerm, LastIndex: r.lastIndex()}
+	}
+	if req.PrevLogIndex > r.snapshotIndex && r.termAt(req.PrevLogIndex) != req.PrevLogTerm {
+		r.truncateLog(req.PrevLogIndex)
+		return appendResponse{Term: r.currentTerm, LastIndex: r.lastIndex()}
+	}
+
+	for _, entry := range req.Entries {
+		if entry.Index <= r.snapshotIndex {
+			continue
+		}
+		if entry.Index <= r.lastIndex() {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			// Drop conflicting entries from an old leader
+			r.truncateLog(entry.Index)
+		}
+		r.entries = append(r.entries, entry)
+	}
+
+	// Entries are only acknowledged once they survive a restart
+	if err := r.persistLog(); err != nil {
+		log.Printf("Failed to write raft log: %v", err)
+		return appendResponse{Term: r.currentTerm, LastIndex: r.savedIndex}
+	}
+
+	// Entries past the ones sent may still be left over from an old leader
+	if lastNew := req.PrevLogIndex + uint64(len(req.Entries)); req.LeaderCommit > r.commitIndex && lastNew > r.commitIndex {
+		r.commitIndex = min(req.LeaderCommit, lastNew)
+		r.applyCommitted()
+	}
+	return appendResponse{Term: r.currentTerm, Success: true, LastIndex: r.lastIndex()}
+}
+
+// handleSnapshot replaces the local index with the leader's
+func (r *RaftNode) handleSnapshot(req snapshotRequest) (snapshotResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if req.Term < r.currentTerm {
+		return snapshotResponse{Term: r.currentTerm}, nil
+	}
+	r.becomeFollower(req.Term, req.LeaderID)
+
+	// A delayed snapshot must not roll back entries already committed here
+	if req.LastIndex <= r.commitIndex {
+		return snapshotResponse{Term: r.currentTerm}, nil
+	}
+
+	if err := r.restore(req.Data); err != nil {
+		return snapshotResponse{}, err
+	}
+	log.Printf("Raft node %s installed the index of leader %s at index %d", r.id, req.LeaderID, req.LastIndex)
+
+	// Entries following the snapshot are kept if they belong to the same log
+	if req.LastIndex < r.lastIndex() && r.termAt(req.LastIndex) == req.LastTerm {
+		r.entries = append([]raftEntry{}, r.entries[req.LastIndex-r.snapshotIndex:]...)
+	} else {
+		r.entries = nil
+	}
+	r.snapshotIndex = req.LastIndex
+	r.snapshotTerm = req.LastTerm
+	r.commitIndex = req.LastIndex
+	r.lastApplied = req.LastIndex
+	r.persist()
+	r.logStale = true
+	if err := r.persistLog(); err != nil {
+		log.Printf("Failed to write raft log: %v", err)
+	}
+	close(r.applied)
+	r.applied = make(chan struct{})
+	return snapshotResponse{Term: r.currentTerm}, nil
+}
+
+// registerHandlers exposes the cluster RPCs on mux
+func (r *RaftNode) registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/raft/vote", func(w http.ResponseWriter, req *http.Request) {
+		var vote voteRequest
+		if err := json.NewDecoder(req.Body).Decode(&vote); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.handleVote(vote))
+	})
+
+	mux.HandleFunc("/raft/append", func(w http.ResponseWriter, req *http.Request) {
+		var appendReq appendRequest
+		if err := json.NewDecoder(req.Body).Decode(&appendReq); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.handleAppend(appendReq))
+	})
+
+	mux.HandleFunc("/raft/snapshot", func(w http.ResponseWriter, req *http.Request) {
+		var snapshot snapshotRequest
+		if err := json.NewDecoder(req.Body).Decode(&snapshot); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := r.handleSnapshot(snapshot)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+const (
+	// raftStateFileName holds the term, vote and snapshot index of a cluster member in its data directory
+	raftStateFileName = "raft.state"
+
+	// raftLogFileName holds the log entries of a cluster member not yet covered by its index snapshot
+	raftLogFileName = "raft.log"
+)
+
+// parseCluster parses a comma separated list of id=url cluster members
+func parseCluster(list string) (map[string]string, error) {
+	members := make(map[string]string)
+	for _, member := range splitList(list) {
+		id, memberURL, ok := strings.Cut(member, "=")
+		if !ok || id == "" || memberURL == "" {
+			return nil, fmt.Errorf("expected id=url, got %q", member)
+		}
+		members[id] = strings.TrimSuffix(memberURL, "/")
+	}
+	return members, nil
+}
+
+// JoinCluster replicates the index across the given super peers, keyed by node ID.
+// The term, vote and log are kept in dataDir, or in memory only when it is empty.
+// It requires mutual TLS, the only thing keeping other hosts out of the cluster RPCs.
+func (sp *SuperPeer) JoinCluster(id string, members map[string]string, dataDir string) error {
+	if sp.tlsConfig == nil {
+		return errClusterNeedsTLS
+	}
+	if dataDir != "" {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	node, err := NewRaftNode(id, members, dataDir, sp.applyRecord, sp.index.encodeSnapshot, sp.installSnapshot)
+	if err != nil {
+		return err
+	}
+	node.httpClient.Transport = sp.transport
+	sp.raft = node
+	return nil
+}
+
+// commit applies a change to the index. In a cluster the change is replicated first
+// and applied on every super peer once a majority has stored it.
+func (sp *SuperPeer) commit(record walRecord) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	if record.Op == opRegister && record.Peer != nil {
+		record.Peer.LastSeen = record.Time
+	}
+
+	if sp.raft == nil {
+		return sp.applyRecord(record)
+	}
+	return sp.raft.Propose(record)
+}
+
+// applyRecord persists a committed change and then applies it to the local index.
+// Standalone, a change that cannot be written is not applied either. In a cluster the
+// raft log already holds it, so it is applied like on every other member.
+// A delta the index rejects is logged as well, replaying it rejects it again.
+func (sp *SuperPeer) applyRecord(record walRecord) error {
+	sp.applyMutex.Lock()
+	defer sp.applyMutex.Unlock()
+
+	if err := sp.logRecord(record); err != nil {
+		if sp.raft == nil {
+			return err
+		}
+		log.Printf("Applying raft entry that is not in the index log: %v", err)
+	}
+	return sp.index.apply(record)
+}
+
+// installSnapshot replaces the local index with the leader's and persists it
+func (sp *SuperPeer) installSnapshot(data []byte) error {
+	if err := sp.index.restoreSnapshot(data); err != nil {
+		return err
+	}
+	if sp.store != nil {
+		return sp.store.Snapshot(sp.index)
+	}
+	return nil
+}
+
+// redirectToLeader sends a request that needs the leader's index to the leader with a
+// temporary redirect, or fails it while no leader is known. It reports whether the
+// request has been answered.
+func (sp *SuperPeer) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if sp.raft == nil {
+		return false
+	}
+
+	leaderURL, isLeader := sp.raft.Leader()
+	if isLeader {
+		return false
+	}
+	if leaderURL == "" {
+		http.Error(w, "no cluster leader elected", http.StatusServiceUnavailable)
+		return true
+	}
+	http.Redirect(w, r, leaderURL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMachine is a state machine recording the peer IDs of the commands applied to it
+type testMachine struct {
+	mutex   sync.Mutex
+	applied []string
+	reject  string // Peer ID whose commands are refused
+}
+
+// errRejected is returned for commands about the rejected peer
+var errRejected = errors.New("rejected")
+
+func (m *testMachine) apply(record walRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if record.PeerID == m.reject {
+		return errRejected
+	}
+	m.applied = append(m.applied, record.PeerID)
+	return nil
+}
+
+func (m *testMachine) snapshot() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return json.Marshal(m.applied)
+}
+
+func (m *testMachine) restore(data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return json.Unmarshal(data, &m.applied)
+}
+
+func (m *testMachine) has(peerIDs ...string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, peerID := range peerIDs {
+		if !contains(m.applied, peerID) {
+			return false
+		}
+	}
+	return true
+}
+
+// testMember is a cluster member that can be stopped and restarted from its data directory
+type testMember struct {
+	id      string
+	dataDir string
+	server  *httptest.Server
+
+	mutex   sync.Mutex
+	node    *RaftNode
+	machine *testMachine
+	running bool
+	stop    chan struct{}
+}
+
+// errMemberDown is returned by the transport of a stopped member
+var errMemberDown = errors.New("member is down")
+
+// memberTransport drops every request a stopped member tries to send
+type memberTransport struct{ member *testMember }
+
+func (t memberTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.member.isRunning() {
+		return nil, errMemberDown
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (m *testMember) isRunning() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.running
+}
+
+func (m *testMember) current() (*RaftNode, *testMachine) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.node, m.machine
+}
+
+// start creates the member's node from its data directory and runs its timers
+func (m *testMember) start(t *testing.T, urls map[string]string) {
+	t.Helper()
+
+	machine := &testMachine{}
+	node, err := NewRaftNode(m.id, urls, m.dataDir, machine.apply, machine.snapshot, machine.restore)
+	if err != nil {
+		t.Fatalf("starting %s: %v", m.id, err)
+	}
+	node.httpClient.Transport = memberTransport{m}
+
+	m.mutex.Lock()
+	m.node, m.machine, m.running = node, machine, true
+	m.stop = make(chan struct{})
+	stop := m.stop
+	m.mutex.Unlock()
+
+	node.mutex.Lock()
+	node.resetElectionTimer()
+	node.mutex.Unlock()
+	go func() {
+		ticker := time.NewTicker(raftHeartbeatInterval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				node.tick()
+			}
+		}
+	}()
+}
+
+// crash stops the member without any chance to save state
+func (m *testMember) crash() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.running = false
+	close(m.stop)
+
+	m.node.mutex.Lock()
+	defer m.node.mutex.Unlock()
+	if m.node.logFile != nil {
+		m.node.logFile.Close()
+	}
+}
+
+// newTestCluster starts n members listening on local test servers
+func newTestCluster(t *testing.T, n int) ([]*testMember, map[string]string) {
+	urls := make(map[string]string)
+	members := make([]*testMember, n)
+	for i := range members {
+		member := &testMember{id: fmt.Sprintf("sp%d", i+1), dataDir: t.TempDir()}
+		member.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !member.isRunning() {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			node, _ := member.current()
+			mux := http.NewServeMux()
+			node.registerHandlers(mux)
+			mux.ServeHTTP(w, r)
+		}))
+		t.Cleanup(member.server.Close)
+		urls[member.id] = member.server.URL
+		members[i] = member
+	}
+
+	for _, member := range members {
+		member.start(t, urls)
+	}
+	t.Cleanup(func() {
+		for _, member := range members {
+			if member.isRunning() {
+				member.crash()
+			}
+		}
+	})
+	return members, urls
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitForLeader returns the running member that won an election
+func waitForLeader(t *testing.T, members []*testMember) *testMember {
+	t.Helper()
+	var leader *testMember
+	waitFor(t, "a leader", func() bool {
+		for _, member := range members {
+			if !member.isRunning() {
+				continue
+			}
+			node, _ := member.current()
+			if _, isLeader := node.Leader(); isLeader {
+				leader = member
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// propose commits a command through the current leader, retrying across elections
+func propose(t *testing.T, members []*testMember, peerID string) {
+	t.Helper()
+	waitFor(t, "commit of "+peerID, func() bool {
+		node, _ := waitForLeader(t, members).current()
+		return node.Propose(walRecord{Op: opUnregister, PeerID: peerID}) == nil
+	})
+}
+
+func TestRaftFailoverAndRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs elections in real time")
+	}
+	members, urls := newTestCluster(t, 3)
+
+	propose(t, members, "a")
+	leader := waitForLeader(t, members)
+
+	// A follower restarted from disk still holds the entries it acknowledged
+	var follower *testMember
+	for _, member := range members {
+		if member != leader {
+			follower = member
+			break
+		}
+	}
+	waitFor(t, "follower to apply a", func() bool {
+		_, machine := follower.current()
+		return machine.has("a")
+	})
+	node, _ := follower.current()
+	node.mutex.Lock()
+	savedIndex := node.lastIndex()
+	node.mutex.Unlock()
+	follower.crash()
+
+	propose(t, members, "b")
+
+	follower.start(t, urls)
+	node, _ = follower.current()
+	node.mutex.Lock()
+	restoredIndex := node.lastIndex()
+	node.mutex.Unlock()
+	if restoredIndex < savedIndex {
+		t.Fatalf("restarted follower has log up to %d, had %d before", restoredIndex, savedIndex)
+	}
+	waitFor(t, "restarted follower to catch up", func() bool {
+		_, machine := follower.current()
+		return machine.has("a", "b")
+	})
+
+	// The remaining members elect a new leader when the leader fails
+	leader.crash()
+	propose(t, members, "c")
+	if newLeader := waitForLeader(t, members); newLeader == leader {
+		t.Fatal("crashed member is still the leader")
+	}
+	for _, member := range members {
+		if member == leader {
+			continue
+		}
+		waitFor(t, member.id+" to apply c", func() bool {
+			_, machine := member.current()
+			return machine.has("a", "b", "c")
+		})
+	}
+
+	// The old leader rejoins as a follower and catches up
+	leader.start(t, urls)
+	waitFor(t, "old leader to catch up", func() bool {
+		_, machine := leader.current()
+		return machine.has("a", "b", "c")
+	})
+}
+
+func TestRaftRestartKeepsAcknowledgedEntries(t *testing.T) {
+	urls := map[string]string{"sp1": "http://sp1", "sp2": "http://sp2", "sp3": "http://sp3"}
+	dataDir := t.TempDir()
+	machine := &testMachine{}
+
+	node, err := NewRaftNode("sp1", urls, dataDir, machine.apply, machine.snapshot, machine.restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := node.handleAppend(appendRequest{
+		Term:     1,
+		LeaderID: "sp2",
+		Entries: []raftEntry{
+			{Index: 1, Term: 1},
+			{Index: 2, Term: 1, Command: walRecord{Op: opUnregister, PeerID: "a"}},
+		},
+	})
+	if !resp.Success || resp.LastIndex != 2 {
+		t.Fatalf("append = %+v, want success up to index 2", resp)
+	}
+	node.logFile.Close()
+
+	restarted, err := NewRaftNode("sp1", urls, dataDir, machine.apply, machine.snapshot, machine.restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.logFile.Close()
+
+	tests := []struct {
+		name string
+		req  voteRequest
+		want bool
+	}{
+		{"candidate missing the entries", voteRequest{Term: 2, CandidateID: "sp3", LastLogIndex: 0, LastLogTerm: 0}, false},
+		{"candidate missing the last entry", voteRequest{Term: 3, CandidateID: "sp3", LastLogIndex: 1, LastLogTerm: 1}, false},
+		{"candidate with the entries", voteRequest{Term: 4, CandidateID: "sp3", LastLogIndex: 2, LastLogTerm: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restarted.handleVote(tt.req); got.VoteGranted != tt.want {
+				t.Errorf("vote granted = %v, want %v", got.VoteGranted, tt.want)
+			}
+		})
+	}
+}
+
+func TestRaftRejectsStaleSnapshot(t *testing.T) {
+	urls := map[string]string{"sp1": "http://sp1", "sp2": "http://sp2", "sp3": "http://sp3"}
+	machine := &testMachine{}
+	node, err := NewRaftNode("sp1", urls, "", machine.apply, machine.snapshot, machine.restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []raftEntry{
+		{Index: 1, Term: 1, Command: walRecord{Op: opUnregister, PeerID: "a"}},
+		{Index: 2, Term: 1, Command: walRecord{Op: opUnregister, PeerID: "b"}},
+		{Index: 3, Term: 1, Command: walRecord{Op: opUnregister, PeerID: "c"}},
+	}
+	node.handleAppend(appendRequest{Term: 1, LeaderID: "sp2", Entries: entries, LeaderCommit: 3})
+
+	stale, _ := json.Marshal([]string{"a"})
+	if _, err := node.handleSnapshot(snapshotRequest{Term: 1, LeaderID: "sp2", LastIndex: 1, LastTerm: 1, Data: stale}); err != nil {
+		t.Fatal(err)
+	}
+
+	node.mutex.Lock()
+	commitIndex, lastIndex := node.commitIndex, node.lastIndex()
+	node.mutex.Unlock()
+	if commitIndex != 3 || lastIndex != 3 {
+		t.Errorf("commit index %d and last index %d after a stale snapshot, want 3 and 3", commitIndex, lastIndex)
+	}
+	if !machine.has("a", "b", "c") {
+		t.Errorf("stale snapshot rolled the state back to %v", machine.applied)
+	}
+}
+
+func TestRaftProposeReturnsApplyError(t *testing.T) {
+	machine := &testMachine{reject: "b"}
+	node, err := NewRaftNode("sp1", map[string]string{"sp1": "http://sp1"}, "", machine.apply, machine.snapshot, machine.restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.mutex.Lock()
+	node.currentTerm = 1
+	node.becomeLeader()
+	node.mutex.Unlock()
+
+	tests := []struct {
+		peerID string
+		want   error
+	}{
+		{"a", nil},
+		{"b", errRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.peerID, func(t *testing.T) {
+			if err := node.Propose(walRecord{Op: opUnregister, PeerID: tt.peerID}); !errors.Is(err, tt.want) {
+				t.Errorf("Propose = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterRequiresTLS(t *testing.T) {
+	sp := NewSuperPeer(0, 0)
+	members := map[string]string{"sp1": "http://sp1", "sp2": "http://sp2", "sp3": "http://sp3"}
+	if err := sp.JoinCluster("sp1", members, ""); !errors.Is(err, errClusterNeedsTLS) {
+		t.Errorf("JoinCluster without TLS = %v, want %v", err, errClusterNeedsTLS)
+	}
+
+	// A super peer that joined nothing still refuses the RPCs
+	for _, path := range []string{"/raft/vote", "/raft/append", "/raft/snapshot"} {
+		rec := httptest.NewRecorder()
+		sp.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s answered %d without TLS, want %d", path, rec.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Relevance of a single query term against a file name, by how well it matched
+const (
+	scoreExact     = 3.0
+	scorePrefix    = 2.0
+	scoreSubstring = 1.0
+	scoreGlob      = 1.0
+	scoreFuzzy     = 0.5
+)
+
+// tokenize splits a file name into lowercase alphanumeric tokens
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// indexName adds a file name to the token index, the caller must hold the write lock
+func (idx *Index) indexName(name string) {
+	for _, token := range tokenize(name) {
+		if idx.tokens[token] == nil {
+			idx.tokens[token] = make(map[string]bool)
+		}
+		idx.tokens[token][name] = true
+	}
+}
+
+// unindexName removes a file name from the token index, the caller must hold the write lock
+func (idx *Index) unindexName(name string) {
+	for _, token := range tokenize(name) {
+		delete(idx.tokens[token], name)
+		if len(idx.tokens[token]) == 0 {
+			delete(idx.tokens, token)
+		}
+	}
+}
+
+// isGlob reports whether a query term uses glob syntax
+func isGlob(term string) bool {
+	return strings.ContainsAny(term, "*?[")
+}
+
+// maxEdits returns the edit distance tolerated for a fuzzy match of term
+func maxEdits(term string) int {
+	switch n := len([]rune(term)); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the edit distance between a and b, counting insertions,
+// deletions, substitutions and transpositions of adjacent characters as one edit each
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(ra)][len(rb)]
+}
+
+// matchToken scores every indexed token against a single query token.
+// The caller must hold the read lock.
+func (idx *Index) matchToken(term string) map[string]float64 {
+	scores := make(map[string]float64)
+	edits := maxEdits(term)
+
+	for token, names := range idx.tokens {
+		score := 0.0
+		switch {
+		case token == term:
+			score = scoreExact
+		case strings.HasPrefix(token, term):
+			score = scorePrefix
+		case strings.Contains(token, term):
+			score = scoreSubstring
+		case edits > 0 && abs(len(token)-len(term)) <= edits && editDistance(token, term) <= edits:
+			score = scoreFuzzy
+		default:
+			continue
+		}
+
+		for name := range names {
+			scores[name] = max(scores[name], score)
+		}
+	}
+	return scores
+}
+
+// matchTerm scores the file names matching one whitespace separated query term.
+// The caller must hold the read lock.
+func (idx *Index) matchTerm(term string) map[string]float64 {
+	if isGlob(term) {
+		// Globs are matched against the whole name and against its base name
+		scores := make(map[string]float64)
+		for name := range idx.FilesByName {
+			lower := strings.ToLower(name)
+			if ok, _ := path.Match(term, lower); ok {
+				scores[name] = scoreGlob
+			} else if ok, _ := path.Match(term, path.Base(lower)); ok {
+				scores[name] = scoreGlob
+			}
+		}
+		return scores
+	}
+
+	tokens := tokenize(term)
+	if len(tokens) == 0 {
+		return map[string]float64{}
+	}
+	if len(tokens) == 1 && tokens[0] == term {
+		return idx.matchToken(term)
+	}
+
+	// A term with punctuation, such as "q3-report", must appear literally in the name
+	scores := idx.matchToken(tokens[0])
+	for name, score := range scores {
+		if strings.Contains(strings.ToLower(name), term) {
+			scores[name] = score + scoreExact
+		} else {
+			delete(scores, name)
+		}
+	}
+	return scores
+}
+
+// matchNames scores the file names matching every term of the query, an empty
+// query matches every name. The caller must hold the read lock.
+func (idx *Index) matchNames(query string) map[string]float64 {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		scores := make(map[string]float64, len(idx.FilesByName))
+		for name := range idx.FilesByName {
+			scores[name] = 0
+		}
+		return scores
+	}
+
+	scores := idx.matchTerm(terms[0])
+	for _, term := range terms[1:] {
+		termScores := idx.matchTerm(term)
+
+		// All terms have to match
+		for name, score := range scores {
+			if termScore, ok := termScores[name]; ok {
+				scores[name] = score + termScore
+			} else {
+				delete(scores, name)
+			}
+		}
+	}
+	return scores
+}
+
+// namesWithHash looks up the names a file is shared under by its content hash.
+// The caller must hold the read lock.
+func (idx *Index) namesWithHash(hash string) map[string]float64 {
+	hash = strings.ToLower(hash)
+	scores := make(map[string]float64)
+	for _, peerID := range idx.FilesByHash[hash] {
+		if peer, exists := idx.Peers[peerID]; exists {
+			for _, file := range peer.Files {
+				if file.Hash == hash {
+					scores[file.Name] = scoreExact
+				}
+			}
+		}
+	}
+	return scores
+}
+
+// Search runs a structured query against the index and returns the page of results
+// after req.Cursor. Files are returned once per distinct content, most relevant first,
+// then by number of peers, name and hash.
+func (idx *Index) Search(req SearchRequest) (SearchResponse, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	resp, err := paginate(idx.matchFiles(req), req.Cursor, req.Limit)
+	if err != nil {
+		return resp, err
+	}
+	resp.Peers = idx.peersOf(resp.Files, req)
+	return resp, nil
+}
+
+// SearchAll returns every file matching the request in result order, ignoring
+// the cursor and limit, along with the peers sharing them
+func (idx *Index) SearchAll(req SearchRequest) ([]File, map[string]*Peer) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	files := idx.matchFiles(req)
+	return files, idx.peersOf(files, req)
+}
+
+// matchFiles returns every file matching the request in result order.
+// The caller must hold the read lock.
+func (idx *Index) matchFiles(req SearchRequest) []File {
+	var scores map[string]float64
+	if req.Hash != "" && strings.TrimSpace(req.Query) == "" {
+		scores = idx.namesWithHash(req.Hash)
+	} else {
+		scores = idx.matchNames(req.Query)
+	}
+
+	// Collect the matching names under each content hash
+	type variant struct{ name, hash string }
+	variants := make(map[variant]*File)
+	for name, score := range scores {
+		for _, peerID := range idx.FilesByName[name] {
+			peer, exists := idx.Peers[peerID]
+			if !exists || !req.matchesPeer(peerID) {
+				continue
+			}
+			for _, peerFile := range peer.Files {
+				if peerFile.Name != name || !req.matchesFile(peerFile) || !req.mayAccess(peerFile) || idx.isHidden(peerFile.Hash) {
+					continue
+				}
+
+				key := variant{name, peerFile.Hash}
+				file, exists := variants[key]
+				if !exists {
+					file = &File{
+						Name:       name,
+						Hash:       peerFile.Hash,
+						Size:       peerFile.Size,
+						MerkleRoot: peerFile.MerkleRoot,
+						PeerIDs:    []string{},
+						Score:      score,
+					}
+					variants[key] = file
+				}
+				if !contains(file.PeerIDs, peerID) {
+					file.PeerIDs = append(file.PeerIDs, peerID)
+				}
+			}
+		}
+	}
+
+	files := make([]File, 0, len(variants))
+	for _, file := range variants {
+		sort.Strings(file.PeerIDs)
+		files = append(files, *file)
+	}
+	sortFiles(files)
+	return files
+}
+
+// peersOf returns the peers sharing any of the given files, listing only the files
+// the requester may access. The caller must hold the read lock.
+func (idx *Index) peersOf(files []File, req SearchRequest) map[string]*Peer {
+	peers := make(map[string]*Peer)
+	for _, file := range files {
+		for _, peerID := range file.PeerIDs {
+			peer, exists := idx.Peers[peerID]
+			if !exists {
+				continue
+			}
+			if _, added := peers[peerID]; added {
+				continue
+			}
+			visible := *peer
+			visible.Files = []File{}
+			for _, peerFile := range peer.Files {
+				if req.mayAccess(peerFile) {
+					visible.Files = append(visible.Files, peerFile)
+				}
+			}
+			peers[peerID] = &visible
+		}
+	}
+	return peers
+}
+
+// sortFiles orders search results by relevance, then number of peers, name and hash
+func sortFiles(files []File) {
+	sort.Slice(files, func(i, j int) bool {
+		return fileLess(files[i], files[j])
+	})
+}
+
+// fileLess reports whether a sorts before b in search results
+func fileLess(a, b File) bool {
+	return sortKey(a).less(sortKey(b))
+}
+
+// matchesPeer reports whether files shared by a peer may appear in the results
+func (req *SearchRequest) matchesPeer(peerID string) bool {
+	return len(req.PeerIDs) == 0 || contains(req.PeerIDs, peerID)
+}
+
+// mayAccess reports whether the requester may see a file, anonymous requesters only
+// see public files
+func (req *SearchRequest) mayAccess(file File) bool {
+	if req.unrestricted || len(file.ACL) == 0 {
+		return true
+	}
+	return req.Requester != "" && contains(file.ACL, req.Requester)
+}
+
+// matchesFile reports whether a file passes the hash, size and extension filters
+func (req *SearchRequest) matchesFile(file File) bool {
+	return req.Match(file.Name, file.Hash, file.Size)
+}
+
+// searchCursor is the sort key of the last file on a page. The next page starts
+// with the first file sorting after it, so pages stay stable while the index changes.
+type searchCursor struct {
+	Score    float64 `json:"s"`
+	Replicas int     `json:"r"`
+	Name     string  `json:"n"`
+	Hash     string  `json:"h"`
+}
+
+// sortKey returns the fields search results are ordered by
+func sortKey(file File) searchCursor {
+	return searchCursor{
+		Score:    file.Score,
+		Replicas: len(file.PeerIDs),
+		Name:     file.Name,
+		Hash:     file.Hash,
+	}
+}
+
+// less reports whether key a sorts before b: by relevance, then number of peers, name and hash
+func (a searchCursor) less(b searchCursor) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if a.Replicas != b.Replicas {
+		return a.Replicas > b.Replicas
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Hash < b.Hash
+}
+
+// encodeCursor builds the opaque cursor pointing after file
+func encodeCursor(file File) string {
+	data, _ := json.Marshal(sortKey(file))
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor turns a cursor back into the sort key it was built from
+func decodeCursor(cursor string) (searchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return searchCursor{}, fmt.Errorf("invalid cursor")
+	}
+
+	var c searchCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Replicas < 0 {
+		return searchCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// paginate returns the page of sorted files that follows cursor, limit <= 0 returns them all
+func paginate(files []File, cursor string, limit int) (SearchResponse, error) {
+	resp := SearchResponse{Total: len(files)}
+
+	start := 0
+	if cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return resp, err
+		}
+		start = sort.Search(len(files), func(i int) bool {
+			return after.less(sortKey(files[i]))
+		})
+	}
+
+	end := len(files)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+		resp.NextCursor = encodeCursor(files[end-1])
+	}
+
+	resp.Files = files[start:end]
+	return resp, nil
+}
+
+// abs returns the absolute value of x
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+// testFiles returns n sorted search results with distinct sort keys
+func testFiles(n int) []File {
+	files := make([]File, n)
+	for i := range files {
+		files[i] = File{
+			Name:    fmt.Sprintf("file%02d.txt", i),
+			Hash:    fmt.Sprintf("%064d", i),
+			PeerIDs: []string{"peer1"},
+			Score:   float64(n - i),
+		}
+	}
+	sortFiles(files)
+	return files
+}
+
+func TestPaginate(t *testing.T) {
+	files := testFiles(5)
+
+	tests := []struct {
+		name      string
+		limit     int
+		wantPages [][]string
+	}{
+		{"all at once", 0, [][]string{{"file00.txt", "file01.txt", "file02.txt", "file03.txt", "file04.txt"}}},
+		{"exact pages", 5, [][]string{{"file00.txt", "file01.txt", "file02.txt", "file03.txt", "file04.txt"}}},
+		{"two per page", 2, [][]string{{"file00.txt", "file01.txt"}, {"file02.txt", "file03.txt"}, {"file04.txt"}}},
+		{"one per page", 1, [][]string{{"file00.txt"}, {"file01.txt"}, {"file02.txt"}, {"file03.txt"}, {"file04.txt"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor := ""
+			for i, want := range tt.wantPages {
+				resp, err := paginate(files, cursor, tt.limit)
+				if err != nil {
+					t.Fatalf("page %d: %v", i, err)
+				}
+				if resp.Total != len(files) {
+					t.Errorf("page %d: total = %d, want %d", i, resp.Total, len(files))
+				}
+				if len(resp.Files) != len(want) {
+					t.Fatalf("page %d: got %d files, want %d", i, len(resp.Files), len(want))
+				}
+				for j, file := range resp.Files {
+					if file.Name != want[j] {
+						t.Errorf("page %d file %d = %s, want %s", i, j, file.Name, want[j])
+					}
+				}
+
+				last := i == len(tt.wantPages)-1
+				if last != (resp.NextCursor == "") {
+					t.Fatalf("page %d: next cursor %q on last page = %v", i, resp.NextCursor, last)
+				}
+				cursor = resp.NextCursor
+			}
+		})
+	}
+}
+
+func TestPaginateStableWhileIndexChanges(t *testing.T) {
+	files := testFiles(4)
+	first, err := paginate(files, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file sorting before the cursor is removed and one is added after it
+	changed := append([]File{}, files[1:]...)
+	changed = append(changed, File{Name: "late.txt", Hash: "ff", PeerIDs: []string{"peer2"}})
+	sortFiles(changed)
+
+	second, err := paginate(changed, first.NextCursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Files) != 2 || second.Files[0].Name != "file02.txt" || second.Files[1].Name != "file03.txt" {
+		t.Errorf("second page = %v, want file02.txt and file03.txt", second.Files)
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	encode := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+
+	tests := []struct {
+		name    string
+		cursor  string
+		wantErr bool
+		want    searchCursor
+	}{
+		{"valid", encodeCursor(File{Name: "a.txt", Hash: "aa", PeerIDs: []string{"p1", "p2"}, Score: 2}), false, searchCursor{Score: 2, Replicas: 2, Name: "a.txt", Hash: "aa"}},
+		{"not base64", "!!!", true, searchCursor{}},
+		{"not json", encode("not json"), true, searchCursor{}},
+		{"negative replicas", encode(`{"s":1,"r":-1,"n":"a","h":"b"}`), true, searchCursor{}},
+		{"huge replicas", encode(`{"s":1,"r":2147483647,"n":"a","h":"b"}`), false, searchCursor{Score: 1, Replicas: 2147483647, Name: "a", Hash: "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(tt.cursor)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaginateMaliciousCursor(t *testing.T) {
+	files := testFiles(3)
+
+	// A replica count beyond any file sorts before every result without allocating
+	cursor := base64.RawURLEncoding.EncodeToString([]byte(`{"s":3,"r":2147483647,"n":"","h":""}`))
+	resp, err := paginate(files, cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Files) != 2 || resp.Files[0].Name != "file00.txt" {
+		t.Errorf("got %v, want the first page", resp.Files)
+	}
+
+	if _, err := paginate(files, "%%%", 2); err == nil {
+		t.Error("expected an error for a malformed cursor")
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "index.wal"
+	snapshotFileName = "index.snapshot"
+
+	// snapshotEvery is the number of log records after which the log is compacted into a snapshot
+	snapshotEvery = 1000
+)
+
+// Index operations recorded in the write-ahead log
+const (
+	opRegister   = "register"
+	opUnregister = "unregister"
+	opHeartbeat  = "heartbeat"
+	opBan        = "ban"
+	opUnban      = "unban"
+	opUpdate     = "update"
+)
+
+// walRecord is a single mutation of the index
+type walRecord struct {
+	Op     string     `json:"op"`
+	Peer   *Peer      `json:"peer,omitempty"`
+	PeerID string     `json:"peerId,omitempty"`
+	Ban    *Ban       `json:"ban,omitempty"`
+	Delta  *FileDelta `json:"delta,omitempty"`
+	Time   time.Time  `json:"time"`
+}
+
+// indexSnapshot is the full state of the index at a point in time
+type indexSnapshot struct {
+	Time  time.Time `json:"time"`
+	Peers []*Peer   `json:"peers"`
+	Bans  []*Ban    `json:"bans,omitempty"`
+}
+
+// Store persists the index as a snapshot plus a write-ahead log of later changes
+type Store struct {
+	dir     string
+	wal     *os.File
+	records int // Records appended since the last snapshot
+	mutex   sync.Mutex
+}
+
+// OpenStore opens or creates the store in dir
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{dir: dir, wal: wal}, nil
+}
+
+// Load rebuilds the index from the snapshot and the log. Expired peers are left for
+// the heartbeat service to remove, so every super peer in a cluster removes them alike.
+func (s *Store) Load(idx *Index) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var snapshot indexSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return fmt.Errorf("corrupt snapshot: %v", err)
+		}
+		for _, peer := range snapshot.Peers {
+			idx.restorePeer(peer)
+		}
+		idx.mutex.Lock()
+		for _, ban := range snapshot.Bans {
+			idx.addBan(ban)
+		}
+		idx.mutex.Unlock()
+	}
+
+	// Replay the log on top of the snapshot
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(s.wal)
+	var validBytes int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding incomplete record at the end of the index log")
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("Discarding corrupt record in the index log: %v", err)
+			break
+		}
+		idx.apply(record)
+		validBytes += int64(len(line))
+		s.records++
+	}
+
+	// Cut off a torn tail so new records are appended after valid ones
+	if err := s.wal.Truncate(validBytes); err != nil {
+		return err
+	}
+
+	log.Printf("Loaded index with %d peers from %s", len(idx.Peers), s.dir)
+	return nil
+}
+
+// Append durably writes a record to the log
+func (s *Store) Append(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.wal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.records++
+	return s.wal.Sync()
+}
+
+// NeedsSnapshot reports whether the log has grown enough to be compacted
+func (s *Store) NeedsSnapshot() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.records >= snapshotEvery
+}
+
+// Snapshot writes the full index to disk and truncates the log.
+// Records appended concurrently may end up in both, which is harmless as replaying them is idempotent.
+func (s *Store) Snapshot(idx *Index) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := idx.encodeSnapshot()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a partial snapshot
+	path := filepath.Join(s.dir, snapshotFileName)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(s.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// Everything in the log is now covered by the snapshot
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	s.records = 0
+	return s.wal.Sync()
+}
+
+// encodeSnapshot encodes the full state of the index
+func (idx *Index) encodeSnapshot() ([]byte, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	snapshot := indexSnapshot{
+		Time:  time.Now(),
+		Peers: make([]*Peer, 0, len(idx.Peers)),
+	}
+	for _, peer := range idx.Peers {
+		snapshot.Peers = append(snapshot.Peers, peer)
+	}
+	for _, ban := range idx.bans {
+		snapshot.Bans = append(snapshot.Bans, ban)
+	}
+	return json.Marshal(snapshot)
+}
+
+// restoreSnapshot replaces the whole index with an encoded snapshot
+func (idx *Index) restoreSnapshot(data []byte) error {
+	var snapshot indexSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("corrupt snapshot: %v", err)
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.Peers = make(map[string]*Peer)
+	idx.FilesByName = make(map[string][]string)
+	idx.FilesByHash = make(map[string][]string)
+	idx.tokens = make(map[string]map[string]bool)
+	idx.bans = make(map[string]*Ban)
+	for _, peer := range snapshot.Peers {
+		idx.addPeer(peer)
+	}
+	for _, ban := range snapshot.Bans {
+		idx.addBan(ban)
+	}
+	return nil
+}
+
+// restorePeer adds a peer loaded from disk, keeping its recorded LastSeen time
+func (idx *Index) restorePeer(peer *Peer) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.addPeer(peer)
+}
+
+// apply replays a single log record against the index. It only fails for a delta
+// that does not fit the peer's files, which leaves the index unchanged.
+func (idx *Index) apply(record walRecord) error {
+	switch record.Op {
+	case opRegister:
+		if record.Peer != nil {
+			idx.restorePeer(record.Peer)
+		}
+	case opUnregister:
+		idx.UnregisterPeer(record.PeerID)
+	case opHeartbeat:
+		idx.mutex.Lock()
+		if peer, exists := idx.Peers[record.PeerID]; exists {
+			peer.LastSeen = record.Time
+		}
+		idx.mutex.Unlock()
+	case opUpdate:
+		if record.Delta != nil {
+			idx.mutex.Lock()
+			defer idx.mutex.Unlock()
+			return idx.applyDelta(record.Delta, record.Time)
+		}
+	case opBan:
+		if record.Ban != nil {
+			idx.mutex.Lock()
+			idx.addBan(record.Ban)
+			idx.mutex.Unlock()
+		}
+	case opUnban:
+		if record.Ban != nil {
+			idx.mutex.Lock()
+			delete(idx.bans, record.Ban.key())
+			idx.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+// errIndexLog is returned for changes that were not applied because writing them to
+// the log failed
+var errIndexLog = errors.New("failed to write index log")
+
+// logRecord appends a record to the store if persistence is enabled
+func (sp *SuperPeer) logRecord(record walRecord) error {
+	if sp.store == nil {
+		return nil
+	}
+
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	if err := sp.store.Append(record); err != nil {
+		return fmt.Errorf("%w: %v", errIndexLog, err)
+	}
+	return nil
+}
+
+// commitStatus returns the HTTP status for a change sp.commit refused
+func commitStatus(err error) int {
+	switch {
+	case errors.Is(err, errIndexLog):
+		return http.StatusInternalServerError
+	case errors.Is(err, errUnknownPeer):
+		return http.StatusNotFound
+	case errors.Is(err, errVersionConflict):
+		return http.StatusConflict
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// snapshotService compacts the log into a snapshot every interval, checking every
+// checkInterval whether it has grown enough to do so sooner
+func (sp *SuperPeer) snapshotService(interval, checkInterval time.Duration) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	lastSnapshot := time.Now()
+	for {
+		<-ticker.C
+		if !sp.store.NeedsSnapshot() && time.Since(lastSnapshot) < interval {
+			continue
+		}
+
+		if err := sp.store.Snapshot(sp.index); err != nil {
+			log.Printf("Failed to write index snapshot: %v", err)
+			continue
+		}
+		lastSnapshot = time.Now()
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCommitLogsBeforeApplying(t *testing.T) {
+	tests := []struct {
+		name        string
+		failLog     bool
+		wantErr     error
+		wantApplied bool
+	}{
+		{"log written", false, nil, true},
+		{"log failed", true, errIndexLog, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := OpenStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sp := NewSuperPeer(0, 0)
+			sp.store = store
+			if tt.failLog {
+				store.wal.Close()
+			} else {
+				defer store.wal.Close()
+			}
+
+			err = sp.commit(walRecord{Op: opRegister, Peer: &Peer{ID: "peer1"}})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("commit = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && commitStatus(err) != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d", commitStatus(err), http.StatusInternalServerError)
+			}
+			if _, applied := sp.index.Peers["peer1"]; applied != tt.wantApplied {
+				t.Errorf("peer registered = %v, want %v", applied, tt.wantApplied)
+			}
+
+			// Whatever was acknowledged is there again after a restart
+			if tt.wantApplied {
+				reopened, err := OpenStore(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer reopened.wal.Close()
+				idx := NewIndex()
+				if err := reopened.Load(idx); err != nil {
+					t.Fatal(err)
+				}
+				if _, exists := idx.Peers["peer1"]; !exists {
+					t.Error("acknowledged registration lost on restart")
+				}
+			}
+		})
+	}
+}
+
+func TestLoadKeepsExpiredPeers(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-2 * peerTimeout)
+	if err := store.Append(walRecord{Op: opRegister, Peer: &Peer{ID: "peer1", LastSeen: expired}, Time: expired}); err != nil {
+		t.Fatal(err)
+	}
+	store.wal.Close()
+
+	reopened, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.wal.Close()
+	idx := NewIndex()
+	if err := reopened.Load(idx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the heartbeat service removes them, through the log
+	if _, exists := idx.Peers["peer1"]; !exists {
+		t.Error("expired peer pruned while loading")
+	}
+	if dead := idx.DeadPeers(peerTimeout); len(dead) != 1 || dead[0] != "peer1" {
+		t.Errorf("dead peers = %v, want [peer1]", dead)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"p2p-file-sharing/internal/identity"
+)
+
+// Roles a certificate issued by the cluster CA is given, stored in its organizational unit
+const (
+	rolePeer      = "peer"
+	roleSuperPeer = "super-peer"
+	roleAdmin     = "admin"
+)
+
+// loadTLS loads a certificate and key signed by the CA in caFile. It returns the server
+// configuration, which requires clients to present a certificate from the same CA,
+// and the client configuration for connecting to other super peers.
+func loadTLS(certFile, keyFile, caFile string) (*tls.Config, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// Peers and super peers are reached on whatever address they registered from, so
+	// the chain is checked against the CA but not against the host name
+	client := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return identity.VerifyChain(cs.PeerCertificates, pool, x509.ExtKeyUsageServerAuth)
+		},
+	}
+	return server, client, nil
+}
+
+// certIdentity returns the name and role in the verified client certificate of a request,
+// both empty when the request did not come over TLS
+func certIdentity(r *http.Request) (string, string) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", ""
+	}
+	cert := r.TLS.PeerCertificates[0]
+	return cert.Subject.CommonName, identity.CertRole(cert)
+}
+
+// requireRole only passes requests on to next if their certificate has one of the given
+// roles. Without TLS every request is passed on.
+func (sp *SuperPeer) requireRole(next http.Handler, roles ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sp.tlsConfig != nil {
+			if _, role := certIdentity(r); !contains(roles, role) {
+				http.Error(w, fmt.Sprintf("certificate role %q may not access %s", role, r.URL.Path), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiHandler restricts the peer API by certificate role: cluster replication is only
+// open to super peers, and closed entirely without TLS, everything else to peers and
+// super peers
+func (sp *SuperPeer) apiHandler() http.Handler {
+	cluster := sp.requireRole(sp.apiMux, roleSuperPeer)
+	api := sp.requireRole(sp.apiMux, rolePeer, roleSuperPeer)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/raft/") {
+			if sp.tlsConfig == nil {
+				http.Error(w, errClusterNeedsTLS.Error(), http.StatusForbidden)
+				return
+			}
+			cluster.ServeHTTP(w, r)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+}
+
+// checkPeerIdentity makes sure a request about peerID was sent by that peer, whose ID
+// is the name in its certificate. It writes an error and returns false otherwise.
+func (sp *SuperPeer) checkPeerIdentity(w http.ResponseWriter, r *http.Request, peerID string) bool {
+	if sp.tlsConfig == nil {
+		return true
+	}
+	if name, role := certIdentity(r); role != rolePeer || name != peerID {
+		http.Error(w, fmt.Sprintf("certificate %q may not act for peer %q", name, peerID), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// EnableTLS serves every listener over mutual TLS and uses the certificate when
+// connecting to other super peers
+func (sp *SuperPeer) EnableTLS(certFile, keyFile, caFile string) error {
+	server, client, err := loadTLS(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+	if role := identity.CertRole(server.Certificates[0].Leaf); role != roleSuperPeer {
+		return fmt.Errorf("%s has role %q, not %q", certFile, role, roleSuperPeer)
+	}
+	sp.tlsConfig = server
+	sp.transport.TLSClientConfig = client
+	return nil
+}
+
+// scheme returns the URL scheme the listeners are served on
+func (sp *SuperPeer) scheme() string {
+	if sp.tlsConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// listenAndServe serves handler on addr, over TLS when it is enabled
+func (sp *SuperPeer) listenAndServe(addr string, handler http.Handler) error {
+	if sp.tlsConfig == nil {
+		return http.ListenAndServe(addr, handler)
+	}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: sp.tlsConfig}
+	return server.ListenAndServeTLS("", "")
+}